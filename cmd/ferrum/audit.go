@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runAuditCommand verifies the audit hash chain and prints the result as JSON.
+// The checkpoint from the result should be kept outside the database and passed
+// to the next verification, which then only walks the new entries:
+//
+//	ferrum audit verify -checkpoint last.jwt -save-checkpoint last.jwt
+func runAuditCommand(args []string) {
+	if len(args) == 0 || args[0] != "verify" {
+		log.Fatal("Usage: ferrum audit verify [-checkpoint <file>] [-save-checkpoint <file>]")
+	}
+
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	checkpointFile := flags.String("checkpoint", "", "A file containing the checkpoint to resume the verification from")
+	saveCheckpointFile := flags.String("save-checkpoint", "", "A file to write the new checkpoint to if the chain is intact")
+	c := loadConfig(flags, args[1:])
+
+	var checkpoint string
+	if *checkpointFile != "" {
+		data, err := ioutil.ReadFile(*checkpointFile)
+		if err != nil {
+			log.Fatalf("Failed to read checkpoint: %v", err)
+		}
+		checkpoint = strings.TrimSpace(string(data))
+	}
+
+	ctx, s := connectServer(c)
+
+	result, err := s.VerifyAuditLog(ctx, checkpoint)
+	if err != nil {
+		log.Fatalf("Failed to verify the audit log: %v", err)
+	}
+
+	jsonData, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to serialise audit verification to JSON: %v", err)
+	}
+	fmt.Println(string(jsonData))
+
+	if !result.Valid {
+		log.Fatalf("The audit log hash chain is broken at entry %d: %s", result.BrokenLink.ID, result.BrokenLink.Reason)
+	}
+
+	if *saveCheckpointFile != "" {
+		if err := ioutil.WriteFile(*saveCheckpointFile, []byte(result.Checkpoint+"\n"), 0600); err != nil {
+			log.Fatalf("Failed to save checkpoint: %v", err)
+		}
+	}
+
+	log.Infof("Verified %d audit entries", result.Entries)
+}
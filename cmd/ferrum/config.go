@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/relistan/rubberneck"
+	log "github.com/sirupsen/logrus"
+)
+
+// runConfigCommand prints the configuration which results from the env vars
+// and the flags, without starting anything:
+//
+//	ferrum config print -database-host db.example.com
+func runConfigCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		log.Fatal("Usage: ferrum config print [flags]")
+	}
+
+	c := loadConfig(flag.NewFlagSet("config print", flag.ExitOnError), args[1:])
+
+	printConfig(c)
+}
+
+// printConfig prints the configuration to stdout, with the secrets masked
+func printConfig(c config.Config) {
+	rubberneck.NewPrinterWithKeyMasking(func(format string, v ...interface{}) {
+		fmt.Printf(format, v...)
+	}, config.MaskSecret, rubberneck.AddLineFeed).Print(c)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/mihaitodor/ferrum/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// runExportCommand writes all the physicians, patients and visits as JSON, to
+// stdout by default:
+//
+//	ferrum export -output ferrum.json
+func runExportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("output", "", "The file to write the data to (default stdout)")
+	c := loadConfig(flags, args)
+
+	ctx, s := connectServer(c)
+
+	data, err := s.Export(ctx)
+	if err != nil {
+		log.Fatalf("Failed to export data: %v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Fatalf("Failed to create %q: %v", *output, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		log.Fatalf("Failed to write data: %v", err)
+	}
+
+	log.Infof(
+		"Exported %d physicians, %d patients and %d visits",
+		len(data.Physicians), len(data.Patients), len(data.Visits),
+	)
+}
+
+// runImportCommand adds the data written by `ferrum export` to the database,
+// reading it from stdin by default:
+//
+//	ferrum import -input ferrum.json
+func runImportCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	input := flags.String("input", "", "The file to read the data from (default stdin)")
+	c := loadConfig(flags, args)
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatalf("Failed to open %q: %v", *input, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var data server.Export
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		log.Fatalf("Failed to read data: %v", err)
+	}
+
+	ctx, s := connectServer(c)
+
+	if err := s.Import(ctx, data); err != nil {
+		log.Fatalf("Failed to import data: %v", err)
+	}
+
+	log.Infof(
+		"Imported %d physicians, %d patients and %d visits",
+		len(data.Physicians), len(data.Patients), len(data.Visits),
+	)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runHealthcheckCommand probes the server running on this host and exits with
+// an error if it isn't healthy. It replaces wget in the container health check,
+// so the image doesn't need anything besides the binary:
+//
+//	ferrum healthcheck -probe live -timeout 2s
+//
+// The `ready` probe requires the server to be able to serve requests, which
+// means that it's connected to the database and not shutting down, while the
+// `live` probe only requires the process to respond.
+func runHealthcheckCommand(args []string) {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	probe := flags.String("probe", "ready", "The probe to run: live or ready")
+	timeout := flags.Duration("timeout", 5*time.Second, "How long to wait for the server to respond")
+	c := loadConfig(flags, args)
+
+	if *probe != "live" && *probe != "ready" {
+		log.Fatalf("Unknown probe %q. It must be live or ready", *probe)
+	}
+
+	client := http.Client{Timeout: *timeout}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d/health/%s", c.HTTPAPIPort, *probe))
+	if err != nil {
+		log.Fatalf("Health check failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Health check failed with status %q", resp.Status)
+	}
+}
@@ -2,17 +2,36 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
 
 	"github.com/mihaitodor/ferrum/config"
 	"github.com/mihaitodor/ferrum/server"
-	"github.com/relistan/rubberneck"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// commands are the subcommands of the ferrum binary. Each one parses its own
+// flags, on top of the flags which override the configuration env vars.
+var commands = map[string]func(args []string){
+	"serve":       runServeCommand,
+	"migrate":     runMigrateCommand,
+	"seed":        runSeedCommand,
+	"reencrypt":   runReencryptCommand,
+	"user":        runUserCommand,
+	"token":       runTokenCommand,
+	"export":      runExportCommand,
+	"import":      runImportCommand,
+	"audit":       runAuditCommand,
+	"config":      runConfigCommand,
+	"healthcheck": runHealthcheckCommand,
+}
+
 // initGracefulStop sets up a context which gets cancelled when the process
 // receives and traps either SIGINT or SIGTERM
 func initGracefulStop() context.Context {
@@ -30,19 +49,27 @@ func initGracefulStop() context.Context {
 	return ctx
 }
 
-func main() {
+// loadConfig parses the command line flags and loads the configuration. The
+// flags named after the configuration env vars take precedence over them.
+func loadConfig(flags *flag.FlagSet, args []string) config.Config {
+	config.RegisterFlags(flags)
+	// ExitOnError makes Parse exit on failure
+	_ = flags.Parse(args)
+
 	c, err := config.Load()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Print the configuration to stdout
-	rubberneck.Print(c)
-
 	log.SetLevel(c.LogLevel)
+	server.SetupLogging()
 
-	log.Info("Starting Ferrum server")
+	return c
+}
 
+// connectServer creates a server which is connected to the database, for the
+// commands which need one
+func connectServer(c config.Config) (context.Context, server.Server) {
 	s, err := server.New(c)
 	if err != nil {
 		log.Fatalf("Failed to initialise server: %v", err)
@@ -53,20 +80,30 @@ func main() {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
-	s.SetupHTTPHandlers()
+	return ctx, s
+}
+
+func usage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	// Spin up the HTTP server
-	go s.ListenAndServe()
+	return fmt.Sprintf("Usage: ferrum [%s] [flags]", strings.Join(names, " | "))
+}
 
-	// Wait for shutdown signal
-	<-ctx.Done()
+func main() {
+	// Start the server if no command is given, for backwards compatibility
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
 
-	// Shutdown server gracefully
-	ctx, done := context.WithTimeout(context.Background(), c.HTTPRequestTimeout)
-	defer done()
-	if err := s.Shutdown(ctx); err != nil {
-		log.Fatalf("Ferrum server exited with error: %v", err)
+	run, ok := commands[name]
+	if !ok {
+		log.Fatalf("Unknown command %q. %s", name, usage())
 	}
 
-	log.Info("Ferrum server shut down successfully")
+	run(args)
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runMigrateCommand applies, reverts or lists the schema migrations:
+//
+//	ferrum migrate up
+//	ferrum migrate down -steps 1
+//	ferrum migrate status
+func runMigrateCommand(args []string) {
+	const usage = "Usage: ferrum migrate up | down [-steps <n>] | status"
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		log.Fatal(usage)
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	steps := flags.Int("steps", 1, "The number of migrations to revert")
+	c := loadConfig(flags, args[1:])
+	if *steps < 1 {
+		log.Fatal("The number of steps must be at least 1")
+	}
+
+	// Connecting to the database must not apply the migrations by itself
+	c.DatabaseAutoMigrate = false
+	ctx, s := connectServer(c)
+
+	switch args[0] {
+	case "up":
+		if err := s.MigrateUp(ctx); err != nil {
+			log.Fatalf("Failed to apply migrations: %v", err)
+		}
+	case "down":
+		if err := s.MigrateDown(ctx, *steps); err != nil {
+			log.Fatalf("Failed to revert migrations: %v", err)
+		}
+	case "status":
+		statuses, err := s.MigrationStatus(ctx)
+		if err != nil {
+			log.Fatalf("Failed to get migration status: %v", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt.Valid {
+				appliedAt = status.AppliedAt.Time.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runReencryptCommand re-encrypts the patient contact data with the first key
+// in FERRUM_PATIENT_DATA_KEY_FILES, after it was rotated or enabled:
+//
+//	ferrum reencrypt
+func runReencryptCommand(args []string) {
+	c := loadConfig(flag.NewFlagSet("reencrypt", flag.ExitOnError), args)
+
+	ctx, s := connectServer(c)
+
+	updated, err := s.ReencryptPatients(ctx)
+	if err != nil {
+		log.Fatalf("Failed to re-encrypt patient data: %v", err)
+	}
+
+	log.Infof("Re-encrypted the contact data of %d patients", updated)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runSeedCommand fills an empty database with demo physicians, patients and
+// visits:
+//
+//	ferrum seed
+func runSeedCommand(args []string) {
+	c := loadConfig(flag.NewFlagSet("seed", flag.ExitOnError), args)
+
+	ctx, s := connectServer(c)
+
+	seeded, err := s.Seed(ctx)
+	if err != nil {
+		log.Fatalf("Failed to seed the database: %v", err)
+	}
+
+	if seeded {
+		log.Info("Added the demo data to the database")
+	} else {
+		log.Info("The database already contains data, so it wasn't seeded")
+	}
+}
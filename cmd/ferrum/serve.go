@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/mihaitodor/ferrum/server"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runServeCommand starts the API server and blocks until it's shut down:
+//
+//	ferrum serve -http-api-port 8080
+func runServeCommand(args []string) {
+	c := loadConfig(flag.NewFlagSet("serve", flag.ExitOnError), args)
+
+	// Print the configuration to stdout
+	printConfig(c)
+
+	log.Info("Starting Ferrum server")
+
+	shutdownTracing, err := server.SetupTracing(c)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	s, err := server.New(c)
+	if err != nil {
+		log.Fatalf("Failed to initialise server: %v", err)
+	}
+
+	s.SetupHTTPHandlers()
+
+	// Spin up the HTTP server before connecting to the database, so the health
+	// probes can report that the server is starting up. The other endpoints
+	// return 503 until the connection is established and the migrations ran
+	go s.ListenAndServe()
+
+	ctx := initGracefulStop()
+	if err := s.ConnectDatabase(ctx); err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+
+	// Keep the revoked tokens in sync with the other instances
+	go s.SyncRevokedTokens(ctx)
+
+	// Wait for shutdown signal
+	<-ctx.Done()
+
+	// Shutdown server gracefully, after the load balancers have stopped sending
+	// it new requests
+	ctx, done := context.WithTimeout(context.Background(), c.HTTPShutdownDrainDelay+c.HTTPRequestTimeout)
+	defer done()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Fatalf("Ferrum server exited with error: %v", err)
+	}
+
+	// Flush the spans of the last requests
+	if err := shutdownTracing(ctx); err != nil {
+		log.Warnf("Failed to flush traces: %v", err)
+	}
+
+	log.Info("Ferrum server shut down successfully")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runTokenCommand prints a new access token for an existing user, which is
+// handy for scripts:
+//
+//	TOKEN="$(ferrum token issue -username admin)"
+func runTokenCommand(args []string) {
+	if len(args) == 0 || args[0] != "issue" {
+		log.Fatal("Usage: ferrum token issue -username <username>")
+	}
+
+	flags := flag.NewFlagSet("token issue", flag.ExitOnError)
+	username := flags.String("username", "", "The user to issue the token for")
+	c := loadConfig(flags, args[1:])
+
+	ctx, s := connectServer(c)
+
+	token, err := s.IssueToken(ctx, *username)
+	if err != nil {
+		log.Fatalf("Failed to issue token: %v", err)
+	}
+
+	fmt.Println(token)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/mihaitodor/ferrum/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// runUserCommand manages user accounts. The password is read from the first
+// line of stdin, so it doesn't end up in the shell history or the process list:
+//
+//	echo "$PASSWORD" | ferrum user create -username admin -role admin
+func runUserCommand(args []string) {
+	if len(args) == 0 || args[0] != "create" {
+		log.Fatal("Usage: ferrum user create -username <username> -role <role> < password")
+	}
+
+	flags := flag.NewFlagSet("user create", flag.ExitOnError)
+	username := flags.String("username", "", "The username of the new user")
+	roleName := flags.String("role", "", "The role of the new user: admin, physician, receptionist or auditor")
+	c := loadConfig(flags, args[1:])
+
+	role, err := server.ParseRole(*roleName)
+	if err != nil {
+		log.Fatalf("Invalid role: %v", err)
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalf("Failed to read the password from stdin: %v", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	ctx, s := connectServer(c)
+
+	if err := s.CreateUser(ctx, *username, password, role); err != nil {
+		log.Fatalf("Failed to create user %q: %v", *username, err)
+	}
+
+	log.Infof("Created user %q", *username)
+}
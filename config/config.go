@@ -13,6 +13,9 @@ var (
 	buildDate string
 )
 
+// envPrefix is the prefix of the configuration env vars
+const envPrefix = "ferrum"
+
 // Config contains the configuration parameters of this app
 type Config struct {
 	DatabaseHost       string        `envconfig:"DATABASE_HOST" default:"localhost"`
@@ -26,16 +29,86 @@ type Config struct {
 	HTTPJWTSigningKey  string        `envconfig:"HTTP_JWT_SIGNING_KEY" default:"deadbeef"`
 	HTTPJWTVClaimName  string        `envconfig:"HTTP_JWT_CLAIM_NAME" default:"ferrum"`
 	HTTPJWTExpiration  time.Duration `envconfig:"HTTP_JWT_EXPIRATION" default:"1h"`
-	LogLevelRaw        string        `envconfig:"LOG_LEVEL" default:"info"`
-	LogLevel           log.Level
-	Version            string
-	BuildDate          string
+	// DatabaseAutoMigrate applies the pending schema migrations on startup
+	DatabaseAutoMigrate bool `envconfig:"DATABASE_AUTO_MIGRATE" default:"false"`
+	// HTTPAccessLog writes a JSON line to stdout for every request
+	HTTPAccessLog bool `envconfig:"HTTP_ACCESS_LOG" default:"true"`
+	// HTTPShutdownDrainDelay is how long the server keeps serving requests after
+	// it starts failing the readiness probe, so load balancers have time to stop
+	// routing requests to it
+	HTTPShutdownDrainDelay time.Duration `envconfig:"HTTP_SHUTDOWN_DRAIN_DELAY" default:"5s"`
+	// HTTPJWTRefreshExpiration is how long refresh tokens can be used
+	HTTPJWTRefreshExpiration time.Duration `envconfig:"HTTP_JWT_REFRESH_EXPIRATION" default:"720h"`
+	// HTTPJWTRevocationSyncInterval is how often the revoked tokens are
+	// reloaded from the database, so revocations made by other instances apply
+	HTTPJWTRevocationSyncInterval time.Duration `envconfig:"HTTP_JWT_REVOCATION_SYNC_INTERVAL" default:"30s"`
+	// HTTPJWTPrivateKeyFiles switches JWT signing from HS256 to RS256 / ES256.
+	// The first key signs new tokens and the rest are only used to verify them.
+	HTTPJWTPrivateKeyFiles []string `envconfig:"HTTP_JWT_PRIVATE_KEY_FILES"`
+	// HTTPJWTPublicKeyFiles are retired keys which are still accepted
+	HTTPJWTPublicKeyFiles []string `envconfig:"HTTP_JWT_PUBLIC_KEY_FILES"`
+	// AuditCheckpointKeyFiles are the PEM-encoded RSA / ECDSA private keys which
+	// sign the audit checkpoints. The first key signs new checkpoints and the
+	// rest are only used to verify them. Without any, no checkpoints are issued.
+	AuditCheckpointKeyFiles []string `envconfig:"AUDIT_CHECKPOINT_KEY_FILES"`
+	// PatientDataKeyFiles enable the encryption of the patient contact data.
+	// Each file contains a base64-encoded 256-bit master key. The first key
+	// encrypts new data and the rest are only used to decrypt it.
+	PatientDataKeyFiles []string `envconfig:"PATIENT_DATA_KEY_FILES"`
+	// PatientMRNAllocator assigns the medical record numbers (MRNs) of new
+	// patients: "sequence" numbers them and "client" requires the clients to
+	// send them, for when another system assigns them
+	PatientMRNAllocator string `envconfig:"PATIENT_MRN_ALLOCATOR" default:"sequence"`
+	// PatientMRNPrefix and PatientMRNDigits format the numbers of the sequence
+	// allocator, which look like MRN00000042 by default
+	PatientMRNPrefix string `envconfig:"PATIENT_MRN_PREFIX" default:"MRN"`
+	PatientMRNDigits int    `envconfig:"PATIENT_MRN_DIGITS" default:"8"`
+	// PatientMRNCheckDigit appends a Luhn check digit to the numbers of the
+	// sequence allocator, so most typos make the MRN invalid
+	PatientMRNCheckDigit bool `envconfig:"PATIENT_MRN_CHECK_DIGIT" default:"false"`
+	// TracingExporter sends OpenTelemetry traces to an OTLP/HTTP collector
+	// ("otlp"), prints them to stdout ("stdout") or disables tracing ("none")
+	TracingExporter     string `envconfig:"TRACING_EXPORTER" default:"none"`
+	TracingOTLPEndpoint string `envconfig:"TRACING_OTLP_ENDPOINT" default:"localhost:4318"`
+	TracingOTLPInsecure bool   `envconfig:"TRACING_OTLP_INSECURE" default:"false"`
+	// TracingSampleRatio is the fraction of the traces started by Ferrum which
+	// are sampled. Incoming requests follow the decision of the caller.
+	TracingSampleRatio float64 `envconfig:"TRACING_SAMPLE_RATIO" default:"1"`
+	// OIDCIssuerURL makes the API accept tokens issued by an external OpenID
+	// Connect provider instead of the tokens signed by Ferrum
+	OIDCIssuerURL   string            `envconfig:"OIDC_ISSUER_URL"`
+	OIDCAudience    string            `envconfig:"OIDC_AUDIENCE"`
+	OIDCRolesClaim  string            `envconfig:"OIDC_ROLES_CLAIM" default:"roles"`
+	OIDCRoleMapping map[string]string `envconfig:"OIDC_ROLE_MAPPING"`
+	DevMode         bool              `envconfig:"DEV_MODE" default:"false"`
+	LogLevelRaw     string            `envconfig:"LOG_LEVEL" default:"info"`
+	LogLevel        log.Level
+	Version         string
+	BuildDate       string
+}
+
+// secretFields are the settings which are masked when printing the config
+var secretFields = map[string]bool{
+	"DatabasePassword":  true,
+	"HTTPJWTSigningKey": true,
+}
+
+// MaskSecret returns the value which is printed instead of the value of the
+// given field, or nil if the field isn't secret. It's meant to be used as a
+// rubberneck.MaskFunc.
+func MaskSecret(field string) *string {
+	if !secretFields[field] {
+		return nil
+	}
+
+	masked := "[REDACTED]"
+	return &masked
 }
 
 // Load reads the configuration parameters from environment variables
 func Load() (Config, error) {
 	var c Config
-	err := envconfig.Process("ferrum", &c)
+	err := envconfig.Process(envPrefix, &c)
 	if err != nil {
 		return Config{}, fmt.Errorf("failed to parse configuration env vars: %v", err)
 	}
@@ -0,0 +1,23 @@
+package config
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MaskSecret(t *testing.T) {
+	Convey("MaskSecret test", t, func() {
+		Convey("secrets should be masked", func() {
+			for _, field := range []string{"DatabasePassword", "HTTPJWTSigningKey"} {
+				masked := MaskSecret(field)
+				So(masked, ShouldNotBeNil)
+				So(*masked, ShouldEqual, "[REDACTED]")
+			}
+		})
+
+		Convey("other settings should be printed as they are", func() {
+			So(MaskSecret("DatabaseHost"), ShouldBeNil)
+		})
+	})
+}
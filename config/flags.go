@@ -0,0 +1,48 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// envFlag sets an environment variable, so command line flags can override the
+// configuration env vars
+type envFlag struct {
+	env    string
+	isBool bool
+}
+
+func (f envFlag) String() string { return "" }
+
+func (f envFlag) Set(value string) error { return os.Setenv(f.env, value) }
+
+func (f envFlag) IsBoolFlag() bool { return f.isBool }
+
+// RegisterFlags adds a flag to flags for each configuration env var. The flags
+// are named after the env vars, so `-database-host` overrides
+// FERRUM_DATABASE_HOST. Load has to be called after parsing them.
+func RegisterFlags(flags *flag.FlagSet) {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("envconfig")
+		if name == "" {
+			continue
+		}
+
+		env := strings.ToUpper(envPrefix) + "_" + name
+		usage := "Overrides " + env
+		if value := field.Tag.Get("default"); value != "" {
+			usage += fmt.Sprintf(" (default %q)", value)
+		}
+
+		flags.Var(
+			envFlag{env: env, isBool: field.Type.Kind() == reflect.Bool},
+			strings.ToLower(strings.ReplaceAll(name, "_", "-")),
+			usage,
+		)
+	}
+}
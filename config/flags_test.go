@@ -0,0 +1,49 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_RegisterFlags(t *testing.T) {
+	Convey("Config flags test", t, func() {
+		for _, env := range []string{"FERRUM_DATABASE_HOST", "FERRUM_HTTP_REQUEST_TIMEOUT", "FERRUM_DEV_MODE"} {
+			value, ok := os.LookupEnv(env)
+			env := env
+			Reset(func() {
+				if ok {
+					os.Setenv(env, value)
+				} else {
+					os.Unsetenv(env)
+				}
+			})
+		}
+		So(os.Setenv("FERRUM_DATABASE_HOST", "db.example.com"), ShouldBeNil)
+		So(os.Setenv("FERRUM_HTTP_REQUEST_TIMEOUT", "5s"), ShouldBeNil)
+
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		RegisterFlags(flags)
+
+		Convey("flags should override the env vars", func() {
+			So(flags.Parse([]string{"-http-request-timeout", "10s", "-dev-mode"}), ShouldBeNil)
+
+			c, err := Load()
+			So(err, ShouldBeNil)
+			So(c.DatabaseHost, ShouldEqual, "db.example.com")
+			So(c.HTTPRequestTimeout, ShouldEqual, 10*time.Second)
+			So(c.DevMode, ShouldBeTrue)
+			So(c.DatabasePort, ShouldEqual, 5432)
+		})
+
+		Convey("invalid flag values should fail to load", func() {
+			So(flags.Parse([]string{"-http-request-timeout", "soon"}), ShouldBeNil)
+
+			_, err := Load()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
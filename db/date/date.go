@@ -0,0 +1,106 @@
+// Package date contains the calendar date type used for the Postgres date
+// columns. Unlike time.Time, it's written as YYYY-MM-DD in JSON.
+package date
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Layout is the format of dates in the database and in JSON
+const Layout = "2006-01-02"
+
+// NullDate is a date which can be NULL. Time is always midnight UTC.
+type NullDate struct {
+	Time  time.Time
+	Valid bool
+}
+
+// New returns the given date
+func New(year int, month time.Month, day int) NullDate {
+	return NullDate{Time: time.Date(year, month, day, 0, 0, 0, 0, time.UTC), Valid: true}
+}
+
+// Parse reads a YYYY-MM-DD date. Empty strings are NULL.
+func Parse(s string) (NullDate, error) {
+	if s == "" {
+		return NullDate{}, nil
+	}
+
+	t, err := time.Parse(Layout, s)
+	if err != nil {
+		return NullDate{}, fmt.Errorf("invalid date %q: must be formatted as YYYY-MM-DD", s)
+	}
+
+	return NullDate{Time: t, Valid: true}, nil
+}
+
+// String returns the date as YYYY-MM-DD or an empty string if it's NULL
+func (d NullDate) String() string {
+	if !d.Valid {
+		return ""
+	}
+	return d.Time.Format(Layout)
+}
+
+// Scan implements the sql.Scanner interface
+func (d *NullDate) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*d = NullDate{}
+	case time.Time:
+		// lib/pq returns dates as midnight in UTC, but drop the location
+		// anyway, in case another driver uses the local one
+		*d = New(v.Year(), v.Month(), v.Day())
+	case []byte:
+		return d.Scan(string(v))
+	case string:
+		parsed, err := Parse(v)
+		if err != nil {
+			return err
+		}
+		*d = parsed
+	default:
+		return fmt.Errorf("can't scan %T into a date", value)
+	}
+
+	return nil
+}
+
+// Value implements the driver.Valuer interface
+func (d NullDate) Value() (driver.Value, error) {
+	if !d.Valid {
+		return nil, nil
+	}
+	return d.String(), nil
+}
+
+// MarshalJSON writes the date as YYYY-MM-DD or null
+func (d NullDate) MarshalJSON() ([]byte, error) {
+	if !d.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads YYYY-MM-DD dates, null and empty strings
+func (d *NullDate) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*d = NullDate{}
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+
+	return nil
+}
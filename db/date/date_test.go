@@ -0,0 +1,45 @@
+package date
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_NullDate(t *testing.T) {
+	Convey("NullDate test", t, func() {
+		Convey("dates should be written as YYYY-MM-DD", func() {
+			data, err := json.Marshal([]NullDate{New(1990, time.April, 17), {}})
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `["1990-04-17",null]`)
+
+			value, err := New(1990, time.April, 17).Value()
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, "1990-04-17")
+		})
+
+		Convey("dates should be read back as they were written", func() {
+			var dates []NullDate
+			So(json.Unmarshal([]byte(`["1990-04-17",null,""]`), &dates), ShouldBeNil)
+			So(dates, ShouldResemble, []NullDate{New(1990, time.April, 17), {}, {}})
+
+			So(json.Unmarshal([]byte(`["17/04/1990"]`), &dates), ShouldNotBeNil)
+		})
+
+		Convey("scanned dates should be midnight in UTC", func() {
+			var d NullDate
+			So(d.Scan(time.Date(1990, time.April, 17, 0, 0, 0, 0, time.FixedZone("CEST", 2*60*60))), ShouldBeNil)
+			So(d, ShouldResemble, New(1990, time.April, 17))
+
+			So(d.Scan([]byte("1990-04-18")), ShouldBeNil)
+			So(d.String(), ShouldEqual, "1990-04-18")
+
+			So(d.Scan(nil), ShouldBeNil)
+			So(d.Valid, ShouldBeFalse)
+
+			So(d.Scan(42), ShouldNotBeNil)
+		})
+	})
+}
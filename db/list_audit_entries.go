@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// listAuditEntries is the base query used by ListAuditEntries. sqlc can't
+// generate queries with dynamic filters, so the rest is built by hand.
+const listAuditEntries = `-- name: ListAuditEntries :many
+SELECT
+  id, occurred_at, subject, action, resource_type, resource_id, outcome, request_id, prev_hash, hash
+FROM audit_log`
+
+// ListAuditEntriesParams contains the filters and keyset pagination parameters
+// for ListAuditEntries. Empty filters match every entry.
+type ListAuditEntriesParams struct {
+	Subject      string
+	Action       string
+	ResourceType string
+	ResourceID   string
+	Outcome      string
+	RequestID    string
+	Since        sql.NullTime
+	Until        sql.NullTime
+	// BeforeID is the ID of the last entry from the previous page. It is 0 for
+	// the first page.
+	BeforeID int64
+	Limit    int32
+}
+
+// ListAuditEntries returns one page of audit entries, newest first
+func (q *Queries) ListAuditEntries(ctx context.Context, arg ListAuditEntriesParams) ([]AuditLog, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	addCondition := func(format string, v interface{}) {
+		args = append(args, v)
+		conditions = append(conditions, fmt.Sprintf(format, fmt.Sprintf("$%d", len(args))))
+	}
+
+	for _, filter := range []struct {
+		column string
+		value  string
+	}{
+		{"subject", arg.Subject},
+		{"action", arg.Action},
+		{"resource_type", arg.ResourceType},
+		{"resource_id", arg.ResourceID},
+		{"outcome", arg.Outcome},
+		{"request_id", arg.RequestID},
+	} {
+		if filter.value != "" {
+			addCondition(filter.column+" = %s", filter.value)
+		}
+	}
+	if arg.Since.Valid {
+		addCondition("occurred_at >= %s", arg.Since.Time)
+	}
+	if arg.Until.Valid {
+		addCondition("occurred_at < %s", arg.Until.Time)
+	}
+	if arg.BeforeID != 0 {
+		addCondition("id < %s", arg.BeforeID)
+	}
+
+	var query strings.Builder
+	query.WriteString(listAuditEntries)
+	if len(conditions) > 0 {
+		query.WriteString("\nWHERE\n  ")
+		query.WriteString(strings.Join(conditions, "\n  AND "))
+	}
+	args = append(args, arg.Limit)
+	fmt.Fprintf(&query, "\nORDER BY\n  id DESC\nLIMIT\n  $%d", len(args))
+
+	rows, err := q.db.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AuditLog
+	for rows.Next() {
+		var i AuditLog
+		if err := rows.Scan(
+			&i.ID,
+			&i.OccurredAt,
+			&i.Subject,
+			&i.Action,
+			&i.ResourceType,
+			&i.ResourceID,
+			&i.Outcome,
+			&i.RequestID,
+			&i.PrevHash,
+			&i.Hash,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
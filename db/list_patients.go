@@ -0,0 +1,172 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// PatientSortField is a patient column which ListPatients can sort by
+type PatientSortField string
+
+// Supported PatientSortField values
+const (
+	PatientSortLastName  PatientSortField = "last_name"
+	PatientSortCreatedAt PatientSortField = "created_at"
+)
+
+// listPatients is the base query used by ListPatients. sqlc can't generate
+// queries with dynamic filters and sort orders, so the rest is built by hand.
+const listPatients = `-- name: ListPatients :many
+SELECT
+  id, first_name, last_name, address, phone, email, created_at, date_of_birth, mrn
+FROM patient`
+
+// ListPatientsParams contains the filtering, sorting and keyset pagination
+// parameters for ListPatients
+type ListPatientsParams struct {
+	// Name matches patients whose first or last name contains it
+	Name string
+	// Email matches patients with this email address, ignoring case
+	Email string
+	// EmailIndexes match patients whose email blind index is one of these, as
+	// well as the ones which match Email, so the emails stored as plaintext
+	// before they were encrypted are still found
+	EmailIndexes []string
+	// MRN matches the patient with this medical record number
+	MRN string
+	// IdentifierSystem and IdentifierValue match the patient with this
+	// external identifier
+	IdentifierSystem string
+	IdentifierValue  string
+	CreatedAfter     sql.NullTime
+	CreatedBefore    sql.NullTime
+	SortBy           PatientSortField
+	Descending       bool
+	// AfterKey and AfterID are the sort key and ID of the last patient from the
+	// previous page. AfterID is 0 for the first page.
+	AfterKey string
+	AfterID  int32
+	Limit    int32
+}
+
+// PatientSortKey returns the value of the sort field for the given patient, in
+// the format expected by ListPatientsParams.AfterKey
+func PatientSortKey(p Patient, field PatientSortField) string {
+	if field == PatientSortCreatedAt {
+		// Rows without a creation timestamp are sorted as if they were created
+		// at the Unix epoch
+		if !p.CreatedAt.Valid {
+			return "1970-01-01T00:00:00Z"
+		}
+		return p.CreatedAt.Time.UTC().Format("2006-01-02T15:04:05.999999Z07:00")
+	}
+
+	return p.LastName
+}
+
+// ListPatients returns one page of patients sorted by the requested field,
+// using the patient ID to break ties
+func (q *Queries) ListPatients(ctx context.Context, arg ListPatientsParams) ([]Patient, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	addArg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if arg.Name != "" {
+		pattern := addArg("%" + escapeLikePattern(arg.Name) + "%")
+		conditions = append(conditions, fmt.Sprintf("(first_name ILIKE %[1]s OR last_name ILIKE %[1]s)", pattern))
+	}
+	switch {
+	case len(arg.EmailIndexes) > 0:
+		// The ciphertexts never match the plaintext condition
+		conditions = append(conditions, fmt.Sprintf(
+			"(lower(email) = lower(%s) OR id IN (SELECT patient_id FROM patient_email_index WHERE email_index = ANY(%s)))",
+			addArg(arg.Email), addArg(pq.Array(arg.EmailIndexes)),
+		))
+	case arg.Email != "":
+		conditions = append(conditions, fmt.Sprintf("lower(email) = lower(%s)", addArg(arg.Email)))
+	}
+	if arg.MRN != "" {
+		conditions = append(conditions, fmt.Sprintf("mrn = %s", addArg(arg.MRN)))
+	}
+	if arg.IdentifierValue != "" {
+		conditions = append(conditions, fmt.Sprintf(
+			"id IN (SELECT patient_id FROM patient_identifier WHERE system = %s AND value = %s)",
+			addArg(arg.IdentifierSystem), addArg(arg.IdentifierValue),
+		))
+	}
+	if arg.CreatedAfter.Valid {
+		conditions = append(conditions, fmt.Sprintf("created_at >= %s", addArg(arg.CreatedAfter.Time)))
+	}
+	if arg.CreatedBefore.Valid {
+		conditions = append(conditions, fmt.Sprintf("created_at < %s", addArg(arg.CreatedBefore.Time)))
+	}
+
+	sortExpr, sortType := "last_name", "text"
+	if arg.SortBy == PatientSortCreatedAt {
+		sortExpr, sortType = "COALESCE(created_at, 'epoch'::timestamptz)", "timestamptz"
+	}
+	comparison, direction := ">", "ASC"
+	if arg.Descending {
+		comparison, direction = "<", "DESC"
+	}
+
+	if arg.AfterID != 0 {
+		conditions = append(conditions, fmt.Sprintf(
+			"(%s, id) %s (%s::%s, %s)",
+			sortExpr, comparison, addArg(arg.AfterKey), sortType, addArg(arg.AfterID),
+		))
+	}
+
+	var query strings.Builder
+	query.WriteString(listPatients)
+	if len(conditions) > 0 {
+		query.WriteString("\nWHERE\n  ")
+		query.WriteString(strings.Join(conditions, "\n  AND "))
+	}
+	fmt.Fprintf(&query, "\nORDER BY\n  %[1]s %[2]s, id %[2]s\nLIMIT\n  %[3]s", sortExpr, direction, addArg(arg.Limit))
+
+	rows, err := q.db.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Patient
+	for rows.Next() {
+		var i Patient
+		if err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Address,
+			&i.Phone,
+			&i.Email,
+			&i.CreatedAt,
+			&i.DateOfBirth,
+			&i.MRN,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// escapeLikePattern escapes the LIKE wildcards in s so they match literally
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
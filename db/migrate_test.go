@@ -0,0 +1,55 @@
+package db
+
+import (
+	"testing"
+	"testing/fstest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_LoadMigrations(t *testing.T) {
+	Convey("Load migrations test", t, func() {
+		Convey("the embedded migrations should be valid", func() {
+			m, err := NewMigrator(nil)
+			So(err, ShouldBeNil)
+			So(m.migrations, ShouldNotBeEmpty)
+			So(m.migrations[0].Version, ShouldEqual, 1)
+			So(m.migrations[0].Name, ShouldEqual, "initial")
+		})
+
+		Convey("migrations should be sorted by version", func() {
+			migrations, err := loadMigrations(fstest.MapFS{
+				"0010_visits.up.sql":    {Data: []byte("CREATE TABLE visit ();")},
+				"0010_visits.down.sql":  {Data: []byte("DROP TABLE visit;")},
+				"0002_patient.up.sql":   {Data: []byte("CREATE TABLE patient ();")},
+				"0002_patient.down.sql": {Data: []byte("DROP TABLE patient;")},
+			})
+			So(err, ShouldBeNil)
+			So(migrations, ShouldResemble, []Migration{
+				{Version: 2, Name: "patient", Up: "CREATE TABLE patient ();", Down: "DROP TABLE patient;"},
+				{Version: 10, Name: "visits", Up: "CREATE TABLE visit ();", Down: "DROP TABLE visit;"},
+			})
+		})
+
+		Convey("invalid migrations should be rejected", func() {
+			for _, test := range []struct {
+				name  string
+				files fstest.MapFS
+			}{
+				{"no migrations", fstest.MapFS{}},
+				{"invalid name", fstest.MapFS{"patient.sql": {}}},
+				{"missing down", fstest.MapFS{"0001_patient.up.sql": {Data: []byte("CREATE TABLE patient ();")}}},
+				{"name mismatch", fstest.MapFS{
+					"0001_patient.up.sql":    {Data: []byte("CREATE TABLE patient ();")},
+					"0001_patients.down.sql": {Data: []byte("DROP TABLE patient;")},
+				}},
+			} {
+				files := test.files
+				Convey(test.name, func() {
+					_, err := loadMigrations(files)
+					So(err, ShouldNotBeNil)
+				})
+			}
+		})
+	})
+}
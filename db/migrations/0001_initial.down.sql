@@ -0,0 +1,11 @@
+-- 0001_initial.down.sql
+DROP TABLE IF EXISTS audit_log;
+DROP FUNCTION IF EXISTS audit_log_append_only();
+DROP TABLE IF EXISTS revoked_token;
+DROP TABLE IF EXISTS refresh_token;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS visit;
+DROP FUNCTION IF EXISTS visit_period(timestamptz, integer);
+DROP EXTENSION IF EXISTS btree_gist;
+DROP TABLE IF EXISTS physician;
+DROP TABLE IF EXISTS patient;
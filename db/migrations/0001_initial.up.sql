@@ -0,0 +1,103 @@
+-- 0001_initial.up.sql
+-- This is the schema which used to be loaded from db/schema.sql. It's
+-- idempotent, so it can also be applied to databases created from it.
+CREATE TABLE IF NOT EXISTS patient (
+  id serial PRIMARY KEY,
+  first_name text NOT NULL,
+  last_name text NOT NULL,
+  address text NOT NULL,
+  phone text NOT NULL,
+  email text NOT NULL,
+  created_at timestamptz DEFAULT NOW(),
+  CONSTRAINT unique_patient_name UNIQUE(first_name, last_name)
+);
+-- Indexes for the keyset pagination of the patients list
+CREATE INDEX IF NOT EXISTS patient_last_name_idx ON patient (last_name, id);
+CREATE INDEX IF NOT EXISTS patient_created_at_idx ON patient (
+  (COALESCE(created_at, 'epoch'::timestamptz)), id
+);
+CREATE TABLE IF NOT EXISTS physician (
+  id serial PRIMARY KEY,
+  first_name text NOT NULL,
+  last_name text NOT NULL,
+  created_at timestamptz DEFAULT NOW(),
+  CONSTRAINT unique_physician_name UNIQUE(first_name, last_name)
+);
+-- btree_gist allows the visit exclusion constraints to combine equality on the
+-- patient and physician IDs with overlap checks on the visit periods
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+-- visit_period can be IMMUTABLE (as required by the exclusion constraints)
+-- because adding whole minutes to a timestamp doesn't depend on the time zone
+CREATE OR REPLACE FUNCTION visit_period(visited_at timestamptz, duration_minutes integer)
+  RETURNS tstzrange AS $$
+  SELECT tstzrange(visited_at, visited_at + make_interval(mins => duration_minutes))
+$$ LANGUAGE sql IMMUTABLE;
+CREATE TABLE IF NOT EXISTS visit (
+  id serial PRIMARY KEY,
+  patient_id integer NOT NULL REFERENCES patient(id),
+  physician_id integer NOT NULL REFERENCES physician(id),
+  visited_at timestamptz NOT NULL DEFAULT NOW(),
+  location text NOT NULL,
+  reason text NOT NULL,
+  duration_minutes integer NOT NULL DEFAULT 30,
+  cancelled_at timestamptz,
+  CONSTRAINT visit_duration_check CHECK (duration_minutes BETWEEN 1 AND 720),
+  CONSTRAINT no_overlapping_physician_visits EXCLUDE USING gist (
+    physician_id WITH =, visit_period(visited_at, duration_minutes) WITH &&
+  ) WHERE (cancelled_at IS NULL),
+  CONSTRAINT no_overlapping_patient_visits EXCLUDE USING gist (
+    patient_id WITH =, visit_period(visited_at, duration_minutes) WITH &&
+  ) WHERE (cancelled_at IS NULL)
+);
+CREATE INDEX IF NOT EXISTS visit_visited_at_idx ON visit (visited_at, id);
+CREATE TABLE IF NOT EXISTS users (
+  id serial PRIMARY KEY,
+  username text NOT NULL,
+  password_hash text NOT NULL,
+  role text NOT NULL,
+  created_at timestamptz DEFAULT NOW(),
+  CONSTRAINT unique_username UNIQUE(username),
+  CONSTRAINT user_role_check CHECK (role IN ('admin', 'physician', 'receptionist', 'auditor'))
+);
+CREATE TABLE IF NOT EXISTS refresh_token (
+  id serial PRIMARY KEY,
+  user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  token_hash text NOT NULL,
+  expires_at timestamptz NOT NULL,
+  created_at timestamptz DEFAULT NOW(),
+  revoked_at timestamptz,
+  CONSTRAINT unique_refresh_token_hash UNIQUE(token_hash)
+);
+CREATE TABLE IF NOT EXISTS revoked_token (
+  jti text PRIMARY KEY,
+  expires_at timestamptz NOT NULL
+);
+CREATE TABLE IF NOT EXISTS audit_log (
+  id bigserial PRIMARY KEY,
+  occurred_at timestamptz NOT NULL DEFAULT NOW(),
+  subject text NOT NULL,
+  action text NOT NULL,
+  resource_type text NOT NULL,
+  resource_id text NOT NULL,
+  outcome text NOT NULL,
+  request_id text NOT NULL,
+  -- Each entry is chained to the previous one by hashing its contents together
+  -- with the previous hash, so edits can be detected
+  prev_hash text NOT NULL,
+  hash text NOT NULL,
+  CONSTRAINT audit_outcome_check CHECK (outcome IN ('success', 'denied', 'failure'))
+);
+CREATE INDEX IF NOT EXISTS audit_log_subject_idx ON audit_log (subject, id);
+CREATE INDEX IF NOT EXISTS audit_log_resource_idx ON audit_log (resource_type, resource_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_occurred_at_idx ON audit_log (occurred_at);
+-- The audit log is append-only, even for the database owner
+CREATE OR REPLACE FUNCTION audit_log_append_only()
+  RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only
+  BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+  FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only();
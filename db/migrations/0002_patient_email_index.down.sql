@@ -0,0 +1,2 @@
+-- 0002_patient_email_index.down.sql
+DROP TABLE IF EXISTS patient_email_index;
@@ -0,0 +1,9 @@
+-- 0002_patient_email_index.up.sql
+-- The patient contact data can be encrypted, so emails are looked up through a
+-- blind index: a keyed hash of the normalised email, prefixed with the ID of
+-- the key which computed it
+CREATE TABLE IF NOT EXISTS patient_email_index (
+  patient_id integer PRIMARY KEY REFERENCES patient (id) ON DELETE CASCADE,
+  email_index text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS patient_email_index_idx ON patient_email_index (email_index);
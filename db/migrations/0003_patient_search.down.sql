@@ -0,0 +1,6 @@
+-- 0003_patient_search.down.sql
+DROP INDEX IF EXISTS patient_name_fts_idx;
+DROP INDEX IF EXISTS patient_phone_trgm_idx;
+DROP INDEX IF EXISTS patient_email_trgm_idx;
+DROP INDEX IF EXISTS patient_name_trgm_idx;
+DROP EXTENSION IF EXISTS pg_trgm;
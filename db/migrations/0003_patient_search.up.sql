@@ -0,0 +1,13 @@
+-- 0003_patient_search.up.sql
+-- pg_trgm matches misspelled and partial names, emails and phone numbers. The
+-- expressions of the indexes must match the ones used by SearchPatients.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS patient_name_trgm_idx ON patient USING gin (
+  (first_name || ' ' || last_name) gin_trgm_ops
+);
+CREATE INDEX IF NOT EXISTS patient_email_trgm_idx ON patient USING gin (email gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS patient_phone_trgm_idx ON patient USING gin (phone gin_trgm_ops);
+-- The simple configuration doesn't stem, which doesn't make sense for names
+CREATE INDEX IF NOT EXISTS patient_name_fts_idx ON patient USING gin (
+  to_tsvector('simple', first_name || ' ' || last_name)
+);
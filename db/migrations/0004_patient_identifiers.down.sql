@@ -0,0 +1,8 @@
+-- 0004_patient_identifiers.down.sql
+-- Restoring the name constraint fails if patients with the same name have been
+-- registered since, which rolls back the whole migration
+ALTER TABLE patient ADD CONSTRAINT unique_patient_name UNIQUE(first_name, last_name);
+DROP TABLE IF EXISTS patient_identifier;
+DROP INDEX IF EXISTS unique_patient_mrn;
+ALTER TABLE patient DROP COLUMN IF EXISTS mrn;
+ALTER TABLE patient DROP COLUMN IF EXISTS date_of_birth;
@@ -0,0 +1,27 @@
+-- 0004_patient_identifiers.up.sql
+-- Patients used to be identified by their names, which aren't unique. They get
+-- a medical record number (MRN) and external identifiers instead, which are.
+ALTER TABLE patient ADD COLUMN IF NOT EXISTS date_of_birth date;
+ALTER TABLE patient ADD COLUMN IF NOT EXISTS mrn text;
+-- The existing patients get MRNs in the default format of the sequence
+-- allocator, derived from their IDs. The sequence starts after the largest ID,
+-- so the allocator can't hand out any of them again.
+CREATE SEQUENCE IF NOT EXISTS patient_mrn_seq OWNED BY patient.mrn;
+UPDATE patient SET mrn = 'MRN' || lpad(id::text, 8, '0') WHERE mrn IS NULL;
+SELECT setval('patient_mrn_seq', COALESCE(MAX(id), 0) + 1, false) FROM patient;
+ALTER TABLE patient ALTER COLUMN mrn SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS unique_patient_mrn ON patient (mrn);
+-- Identifiers issued by other systems, such as national health numbers. The
+-- system is a URI which tells who issued the value.
+CREATE TABLE IF NOT EXISTS patient_identifier (
+  id serial PRIMARY KEY,
+  patient_id integer NOT NULL REFERENCES patient (id) ON DELETE CASCADE,
+  system text NOT NULL,
+  value text NOT NULL,
+  created_at timestamptz DEFAULT NOW(),
+  CONSTRAINT unique_patient_identifier UNIQUE (system, value)
+);
+CREATE INDEX IF NOT EXISTS patient_identifier_patient_id_idx ON patient_identifier (patient_id, id);
+-- The name constraint goes last, so the patients stay unique if any of the
+-- statements above fails and the migration is rolled back
+ALTER TABLE patient DROP CONSTRAINT IF EXISTS unique_patient_name;
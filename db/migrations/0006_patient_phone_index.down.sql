@@ -0,0 +1,2 @@
+-- 0006_patient_phone_index.down.sql
+DROP TABLE IF EXISTS patient_phone_index;
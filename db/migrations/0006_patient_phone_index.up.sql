@@ -0,0 +1,9 @@
+-- 0006_patient_phone_index.up.sql
+-- Encrypted phone numbers are compared through a blind index, like the emails,
+-- so duplicate patients can still be found by phone. The numbers are stored in
+-- E.164 format, so they don't need further normalisation.
+CREATE TABLE IF NOT EXISTS patient_phone_index (
+  patient_id integer PRIMARY KEY REFERENCES patient (id) ON DELETE CASCADE,
+  phone_index text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS patient_phone_index_idx ON patient_phone_index (phone_index);
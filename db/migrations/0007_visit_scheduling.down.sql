@@ -0,0 +1,3 @@
+-- 0007_visit_scheduling.down.sql
+-- The columns and constraints can't be told apart from the ones which 0001
+-- created, so they're left in place and dropped with the visit table by 0001.
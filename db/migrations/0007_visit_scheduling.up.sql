@@ -0,0 +1,31 @@
+-- 0007_visit_scheduling.up.sql
+-- Databases created from db/schema.sql already had a visit table, so 0001
+-- didn't add the scheduling columns and constraints to it. They're only added
+-- here if they're missing, which leaves the other databases as they are.
+--
+-- Existing visits without a time or which overlap make this fail, which rolls
+-- back the whole migration. They have to be fixed before it's applied again.
+ALTER TABLE visit
+  ALTER COLUMN visited_at SET NOT NULL,
+  ADD COLUMN IF NOT EXISTS duration_minutes integer NOT NULL DEFAULT 30,
+  ADD COLUMN IF NOT EXISTS cancelled_at timestamptz;
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT FROM pg_constraint WHERE conrelid = 'visit'::regclass AND conname = 'visit_duration_check') THEN
+    ALTER TABLE visit
+      ADD CONSTRAINT visit_duration_check CHECK (duration_minutes BETWEEN 1 AND 720);
+  END IF;
+  IF NOT EXISTS (SELECT FROM pg_constraint WHERE conrelid = 'visit'::regclass AND conname = 'no_overlapping_physician_visits') THEN
+    ALTER TABLE visit
+      ADD CONSTRAINT no_overlapping_physician_visits EXCLUDE USING gist (
+        physician_id WITH =, visit_period(visited_at, duration_minutes) WITH &&
+      ) WHERE (cancelled_at IS NULL);
+  END IF;
+  IF NOT EXISTS (SELECT FROM pg_constraint WHERE conrelid = 'visit'::regclass AND conname = 'no_overlapping_patient_visits') THEN
+    ALTER TABLE visit
+      ADD CONSTRAINT no_overlapping_patient_visits EXCLUDE USING gist (
+        patient_id WITH =, visit_period(visited_at, duration_minutes) WITH &&
+      ) WHERE (cancelled_at IS NULL);
+  END IF;
+END
+$$;
@@ -0,0 +1,5 @@
+-- 0008_patient_contact_trgm.down.sql
+DROP INDEX IF EXISTS patient_phone_trgm_idx;
+DROP INDEX IF EXISTS patient_email_trgm_idx;
+CREATE INDEX patient_email_trgm_idx ON patient USING gin (email gin_trgm_ops);
+CREATE INDEX patient_phone_trgm_idx ON patient USING gin (phone gin_trgm_ops);
@@ -0,0 +1,10 @@
+-- 0008_patient_contact_trgm.up.sql
+-- Encrypted emails and phone numbers are only matched through their blind
+-- indexes, so the trigram indexes leave their ciphertexts out. The predicates
+-- must match the ones used by SearchPatients.
+DROP INDEX IF EXISTS patient_email_trgm_idx;
+DROP INDEX IF EXISTS patient_phone_trgm_idx;
+CREATE INDEX patient_email_trgm_idx ON patient USING gin (email gin_trgm_ops)
+  WHERE email NOT LIKE 'enc:v1:%';
+CREATE INDEX patient_phone_trgm_idx ON patient USING gin (phone gin_trgm_ops)
+  WHERE phone NOT LIKE 'enc:v1:%';
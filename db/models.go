@@ -4,18 +4,41 @@ package db
 
 import (
 	"database/sql"
+	"time"
+
+	"github.com/mihaitodor/ferrum/db/date"
 )
 
 type Patient struct {
+	ID          int32         `json:"id"`
+	FirstName   string        `json:"first_name"`
+	LastName    string        `json:"last_name"`
+	Address     string        `json:"address"`
+	Phone       string        `json:"phone"`
+	Email       string        `json:"email"`
+	CreatedAt   sql.NullTime  `json:"created_at"`
+	DateOfBirth date.NullDate `json:"date_of_birth"`
+	MRN         string        `json:"mrn"`
+}
+
+type PatientEmailIndex struct {
+	PatientID  int32  `json:"patient_id"`
+	EmailIndex string `json:"email_index"`
+}
+
+type PatientIdentifier struct {
 	ID        int32        `json:"id"`
-	FirstName string       `json:"first_name"`
-	LastName  string       `json:"last_name"`
-	Address   string       `json:"address"`
-	Phone     string       `json:"phone"`
-	Email     string       `json:"email"`
+	PatientID int32        `json:"patient_id"`
+	System    string       `json:"system"`
+	Value     string       `json:"value"`
 	CreatedAt sql.NullTime `json:"created_at"`
 }
 
+type PatientPhoneIndex struct {
+	PatientID  int32  `json:"patient_id"`
+	PhoneIndex string `json:"phone_index"`
+}
+
 type Physician struct {
 	ID        int32        `json:"id"`
 	FirstName string       `json:"first_name"`
@@ -24,10 +47,47 @@ type Physician struct {
 }
 
 type Visit struct {
-	ID          int32        `json:"id"`
-	PatientID   int32        `json:"patient_id"`
-	PhysicianID int32        `json:"physician_id"`
-	VisitedAt   sql.NullTime `json:"visited_at"`
-	Location    string       `json:"location"`
-	Reason      string       `json:"reason"`
+	ID              int32        `json:"id"`
+	PatientID       int32        `json:"patient_id"`
+	PhysicianID     int32        `json:"physician_id"`
+	VisitedAt       time.Time    `json:"visited_at"`
+	Location        string       `json:"location"`
+	Reason          string       `json:"reason"`
+	DurationMinutes int32        `json:"duration_minutes"`
+	CancelledAt     sql.NullTime `json:"cancelled_at"`
+}
+
+type User struct {
+	ID           int32        `json:"id"`
+	Username     string       `json:"username"`
+	PasswordHash string       `json:"password_hash"`
+	Role         string       `json:"role"`
+	CreatedAt    sql.NullTime `json:"created_at"`
+}
+
+type RefreshToken struct {
+	ID        int32        `json:"id"`
+	UserID    int32        `json:"user_id"`
+	TokenHash string       `json:"token_hash"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	CreatedAt sql.NullTime `json:"created_at"`
+	RevokedAt sql.NullTime `json:"revoked_at"`
+}
+
+type RevokedToken struct {
+	Jti       string    `json:"jti"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type AuditLog struct {
+	ID           int64     `json:"id"`
+	OccurredAt   time.Time `json:"occurred_at"`
+	Subject      string    `json:"subject"`
+	Action       string    `json:"action"`
+	ResourceType string    `json:"resource_type"`
+	ResourceID   string    `json:"resource_id"`
+	Outcome      string    `json:"outcome"`
+	RequestID    string    `json:"request_id"`
+	PrevHash     string    `json:"prev_hash"`
+	Hash         string    `json:"hash"`
 }
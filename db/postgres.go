@@ -2,13 +2,21 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 
-	// Import postgres driver
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/mihaitodor/ferrum/config"
 )
 
+// Postgres error codes which the API maps to specific HTTP statuses
+const (
+	ForeignKeyViolation pq.ErrorCode = "23503"
+	UniqueViolation     pq.ErrorCode = "23505"
+	CheckViolation      pq.ErrorCode = "23514"
+	ExclusionViolation  pq.ErrorCode = "23P01"
+)
+
 // GetConnectionURL constructs the Postgres connection URL
 func GetConnectionURL(c config.Config) string {
 	return fmt.Sprintf(
@@ -30,3 +38,14 @@ func Connect(connURL string) (*sql.DB, error) {
 
 	return conn, nil
 }
+
+// IsConstraintViolation checks if err is a Postgres error with the given code
+// raised by the given constraint. An empty constraint matches any constraint.
+func IsConstraintViolation(err error, code pq.ErrorCode, constraint string) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	return pqErr.Code == code && (constraint == "" || pqErr.Constraint == constraint)
+}
@@ -1,8 +1,4 @@
 -- queries.sql
--- name: GetPatients :many
-SELECT
-  *
-FROM patient;
 -- name: GetPatient :one
 SELECT
   *
@@ -13,7 +9,297 @@ LIMIT
   1;
 -- name: AddPatient :one
 INSERT INTO patient (
-    first_name, last_name, address, phone, email
+    first_name, last_name, address, phone, email, date_of_birth, mrn
+  )
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7) RETURNING *;
+-- name: UpdatePatient :one
+UPDATE patient
+SET
+  first_name = $2, last_name = $3, address = $4, phone = $5, email = $6, date_of_birth = $7
+WHERE
+  id = $1 RETURNING *;
+-- name: DeletePatient :one
+DELETE FROM patient
+WHERE
+  id = $1 RETURNING id;
+-- name: NextPatientMRN :one
+SELECT
+  nextval('patient_mrn_seq');
+-- name: PatientMRNExists :one
+SELECT
+  EXISTS (SELECT 1 FROM patient WHERE mrn = $1);
+-- name: ListPatientIdentifiers :many
+SELECT
+  *
+FROM patient_identifier
+WHERE
+  patient_id = $1
+ORDER BY
+  id;
+-- name: ListIdentifiers :many
+SELECT
+  *
+FROM patient_identifier
+WHERE
+  id > $1
+ORDER BY
+  id
+LIMIT
+  $2;
+-- name: AddPatientIdentifier :one
+INSERT INTO patient_identifier (
+    patient_id, system, value
+  )
+VALUES
+  ($1, $2, $3) RETURNING *;
+-- name: DeletePatientIdentifier :one
+DELETE FROM patient_identifier
+WHERE
+  id = $1 AND patient_id = $2 RETURNING id;
+-- name: MovePatientIdentifiers :execrows
+UPDATE patient_identifier
+SET
+  patient_id = sqlc.arg(to_patient_id)
+WHERE
+  patient_id = sqlc.arg(from_patient_id);
+-- name: SetPatientEmailIndex :exec
+INSERT INTO patient_email_index (patient_id, email_index)
+VALUES
+  ($1, $2) ON CONFLICT (patient_id) DO UPDATE
+SET
+  email_index = EXCLUDED.email_index;
+-- name: SetPatientPhoneIndex :exec
+INSERT INTO patient_phone_index (patient_id, phone_index)
+VALUES
+  ($1, $2) ON CONFLICT (patient_id) DO UPDATE
+SET
+  phone_index = EXCLUDED.phone_index;
+-- name: ReencryptPatient :execrows
+UPDATE patient
+SET
+  address = sqlc.arg(address), phone = sqlc.arg(phone), email = sqlc.arg(email)
+WHERE
+  id = sqlc.arg(id) AND address = sqlc.arg(old_address) AND phone = sqlc.arg(old_phone) AND email = sqlc.arg(old_email);
+-- name: GetPatientForUpdate :one
+SELECT
+  *
+FROM patient
+WHERE
+  id = $1
+LIMIT
+  1 FOR UPDATE;
+-- name: ListDuplicateCandidates :many
+SELECT
+  candidate.id, candidate.first_name, candidate.last_name, candidate.address, candidate.phone, candidate.email, candidate.created_at,
+  candidate.date_of_birth, candidate.mrn,
+  similarity(candidate.first_name || ' ' || candidate.last_name, patient.first_name || ' ' || patient.last_name)::real AS name_similarity
+FROM patient
+JOIN patient AS candidate ON candidate.id <> patient.id
+LEFT JOIN patient_email_index AS patient_index ON patient_index.patient_id = patient.id
+LEFT JOIN patient_email_index AS candidate_index ON candidate_index.patient_id = candidate.id
+LEFT JOIN patient_phone_index AS patient_phone ON patient_phone.patient_id = patient.id
+LEFT JOIN patient_phone_index AS candidate_phone ON candidate_phone.patient_id = candidate.id
+WHERE
+  patient.id = $1
+  AND (
+    (candidate.first_name || ' ' || candidate.last_name) % (patient.first_name || ' ' || patient.last_name)
+    OR (patient.email <> '' AND lower(candidate.email) = lower(patient.email))
+    OR (patient.phone <> '' AND candidate.phone = patient.phone)
+    OR (patient_index.email_index <> '' AND candidate_index.email_index = patient_index.email_index)
+    OR (patient_phone.phone_index <> '' AND candidate_phone.phone_index = patient_phone.phone_index)
+  )
+ORDER BY
+  name_similarity DESC, candidate.id
+LIMIT
+  $2;
+-- name: ListPhysicians :many
+SELECT
+  *
+FROM physician
+WHERE
+  id > $1
+ORDER BY
+  id
+LIMIT
+  $2;
+-- name: GetPhysician :one
+SELECT
+  *
+FROM physician
+WHERE
+  id = $1
+LIMIT
+  1;
+-- name: AddPhysician :one
+INSERT INTO physician (
+    first_name, last_name
+  )
+VALUES
+  ($1, $2) RETURNING *;
+-- name: UpdatePhysician :one
+UPDATE physician
+SET
+  first_name = $2, last_name = $3
+WHERE
+  id = $1 RETURNING *;
+-- name: DeletePhysician :one
+DELETE FROM physician
+WHERE
+  id = $1 RETURNING id;
+-- name: ListVisits :many
+SELECT
+  *
+FROM visit
+WHERE
+  (visited_at, id) > ($1, $2)
+ORDER BY
+  visited_at, id
+LIMIT
+  $3;
+-- name: ListPatientVisits :many
+SELECT
+  *
+FROM visit
+WHERE
+  patient_id = $1 AND (visited_at, id) > ($2, $3)
+ORDER BY
+  visited_at, id
+LIMIT
+  $4;
+-- name: ListPhysicianVisits :many
+SELECT
+  *
+FROM visit
+WHERE
+  physician_id = $1 AND (visited_at, id) > ($2, $3)
+ORDER BY
+  visited_at, id
+LIMIT
+  $4;
+-- name: MovePatientVisits :execrows
+UPDATE visit
+SET
+  patient_id = sqlc.arg(to_patient_id)
+WHERE
+  patient_id = sqlc.arg(from_patient_id);
+-- name: GetVisit :one
+SELECT
+  *
+FROM visit
+WHERE
+  id = $1
+LIMIT
+  1;
+-- name: AddVisit :one
+INSERT INTO visit (
+    patient_id, physician_id, visited_at, duration_minutes, location, reason
   )
 VALUES
-  ($1, $2, $3, $4, $5) RETURNING *;
\ No newline at end of file
+  ($1, $2, $3, $4, $5, $6) RETURNING *;
+-- name: ImportVisit :one
+INSERT INTO visit (
+    patient_id, physician_id, visited_at, duration_minutes, location, reason,
+    cancelled_at
+  )
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7) RETURNING *;
+-- name: RescheduleVisit :one
+UPDATE visit
+SET
+  visited_at = $2, duration_minutes = $3, location = $4
+WHERE
+  id = $1 AND cancelled_at IS NULL RETURNING *;
+-- name: CancelVisit :one
+UPDATE visit
+SET
+  cancelled_at = NOW()
+WHERE
+  id = $1 AND cancelled_at IS NULL RETURNING *;
+-- name: AddUser :one
+INSERT INTO users (
+    username, password_hash, role
+  )
+VALUES
+  ($1, $2, $3) RETURNING *;
+-- name: GetUserByUsername :one
+SELECT
+  *
+FROM users
+WHERE
+  username = $1
+LIMIT
+  1;
+-- name: GetUser :one
+SELECT
+  *
+FROM users
+WHERE
+  id = $1
+LIMIT
+  1;
+-- name: AddRefreshToken :one
+INSERT INTO refresh_token (
+    user_id, token_hash, expires_at
+  )
+VALUES
+  ($1, $2, $3) RETURNING *;
+-- name: RevokeRefreshToken :one
+UPDATE refresh_token
+SET
+  revoked_at = NOW()
+WHERE
+  token_hash = $1 AND revoked_at IS NULL AND expires_at > NOW() RETURNING *;
+-- name: DeleteExpiredRefreshTokens :exec
+DELETE FROM refresh_token
+WHERE
+  expires_at <= NOW();
+-- name: AddRevokedToken :exec
+INSERT INTO revoked_token (
+    jti, expires_at
+  )
+VALUES
+  ($1, $2) ON CONFLICT (jti) DO NOTHING;
+-- name: ListRevokedTokens :many
+SELECT
+  *
+FROM revoked_token
+WHERE
+  expires_at > NOW();
+-- name: DeleteExpiredRevokedTokens :exec
+DELETE FROM revoked_token
+WHERE
+  expires_at <= NOW();
+-- name: LockAuditLog :exec
+SELECT pg_advisory_xact_lock(8411239);
+-- name: GetLastAuditEntry :one
+SELECT
+  *
+FROM audit_log
+ORDER BY
+  id DESC
+LIMIT
+  1;
+-- name: GetAuditEntry :one
+SELECT
+  *
+FROM audit_log
+WHERE
+  id = $1;
+-- name: AddAuditEntry :exec
+INSERT INTO audit_log (
+    occurred_at, subject, action, resource_type, resource_id, outcome,
+    request_id, prev_hash, hash
+  )
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+-- name: ListAuditChain :many
+SELECT
+  *
+FROM audit_log
+WHERE
+  id > $1
+ORDER BY
+  id
+LIMIT
+  $2;
@@ -5,22 +5,64 @@ package db
 
 import (
 	"context"
+	"database/sql"
+	"time"
+
+	"github.com/mihaitodor/ferrum/db/date"
 )
 
+const addAuditEntry = `-- name: AddAuditEntry :exec
+INSERT INTO audit_log (
+    occurred_at, subject, action, resource_type, resource_id, outcome,
+    request_id, prev_hash, hash
+  )
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+`
+
+type AddAuditEntryParams struct {
+	OccurredAt   time.Time `json:"occurred_at"`
+	Subject      string    `json:"subject"`
+	Action       string    `json:"action"`
+	ResourceType string    `json:"resource_type"`
+	ResourceID   string    `json:"resource_id"`
+	Outcome      string    `json:"outcome"`
+	RequestID    string    `json:"request_id"`
+	PrevHash     string    `json:"prev_hash"`
+	Hash         string    `json:"hash"`
+}
+
+func (q *Queries) AddAuditEntry(ctx context.Context, arg AddAuditEntryParams) error {
+	_, err := q.db.ExecContext(ctx, addAuditEntry,
+		arg.OccurredAt,
+		arg.Subject,
+		arg.Action,
+		arg.ResourceType,
+		arg.ResourceID,
+		arg.Outcome,
+		arg.RequestID,
+		arg.PrevHash,
+		arg.Hash,
+	)
+	return err
+}
+
 const addPatient = `-- name: AddPatient :one
 INSERT INTO patient (
-    first_name, last_name, address, phone, email
+    first_name, last_name, address, phone, email, date_of_birth, mrn
   )
 VALUES
-  ($1, $2, $3, $4, $5) RETURNING id, first_name, last_name, address, phone, email, created_at
+  ($1, $2, $3, $4, $5, $6, $7) RETURNING id, first_name, last_name, address, phone, email, created_at, date_of_birth, mrn
 `
 
 type AddPatientParams struct {
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Address   string `json:"address"`
-	Phone     string `json:"phone"`
-	Email     string `json:"email"`
+	FirstName   string        `json:"first_name"`
+	LastName    string        `json:"last_name"`
+	Address     string        `json:"address"`
+	Phone       string        `json:"phone"`
+	Email       string        `json:"email"`
+	DateOfBirth date.NullDate `json:"date_of_birth"`
+	MRN         string        `json:"mrn"`
 }
 
 func (q *Queries) AddPatient(ctx context.Context, arg AddPatientParams) (Patient, error) {
@@ -30,6 +72,8 @@ func (q *Queries) AddPatient(ctx context.Context, arg AddPatientParams) (Patient
 		arg.Address,
 		arg.Phone,
 		arg.Email,
+		arg.DateOfBirth,
+		arg.MRN,
 	)
 	var i Patient
 	err := row.Scan(
@@ -40,13 +84,322 @@ func (q *Queries) AddPatient(ctx context.Context, arg AddPatientParams) (Patient
 		&i.Phone,
 		&i.Email,
 		&i.CreatedAt,
+		&i.DateOfBirth,
+		&i.MRN,
+	)
+	return i, err
+}
+
+const addPatientIdentifier = `-- name: AddPatientIdentifier :one
+INSERT INTO patient_identifier (
+    patient_id, system, value
+  )
+VALUES
+  ($1, $2, $3) RETURNING id, patient_id, system, value, created_at
+`
+
+type AddPatientIdentifierParams struct {
+	PatientID int32  `json:"patient_id"`
+	System    string `json:"system"`
+	Value     string `json:"value"`
+}
+
+func (q *Queries) AddPatientIdentifier(ctx context.Context, arg AddPatientIdentifierParams) (PatientIdentifier, error) {
+	row := q.db.QueryRowContext(ctx, addPatientIdentifier, arg.PatientID, arg.System, arg.Value)
+	var i PatientIdentifier
+	err := row.Scan(
+		&i.ID,
+		&i.PatientID,
+		&i.System,
+		&i.Value,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const addPhysician = `-- name: AddPhysician :one
+INSERT INTO physician (
+    first_name, last_name
+  )
+VALUES
+  ($1, $2) RETURNING id, first_name, last_name, created_at
+`
+
+type AddPhysicianParams struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+func (q *Queries) AddPhysician(ctx context.Context, arg AddPhysicianParams) (Physician, error) {
+	row := q.db.QueryRowContext(ctx, addPhysician, arg.FirstName, arg.LastName)
+	var i Physician
+	err := row.Scan(
+		&i.ID,
+		&i.FirstName,
+		&i.LastName,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const addRefreshToken = `-- name: AddRefreshToken :one
+INSERT INTO refresh_token (
+    user_id, token_hash, expires_at
+  )
+VALUES
+  ($1, $2, $3) RETURNING id, user_id, token_hash, expires_at, created_at, revoked_at
+`
+
+type AddRefreshTokenParams struct {
+	UserID    int32     `json:"user_id"`
+	TokenHash string    `json:"token_hash"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (q *Queries) AddRefreshToken(ctx context.Context, arg AddRefreshTokenParams) (RefreshToken, error) {
+	row := q.db.QueryRowContext(ctx, addRefreshToken, arg.UserID, arg.TokenHash, arg.ExpiresAt)
+	var i RefreshToken
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.TokenHash,
+		&i.ExpiresAt,
+		&i.CreatedAt,
+		&i.RevokedAt,
+	)
+	return i, err
+}
+
+const addRevokedToken = `-- name: AddRevokedToken :exec
+INSERT INTO revoked_token (
+    jti, expires_at
+  )
+VALUES
+  ($1, $2) ON CONFLICT (jti) DO NOTHING
+`
+
+type AddRevokedTokenParams struct {
+	Jti       string    `json:"jti"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (q *Queries) AddRevokedToken(ctx context.Context, arg AddRevokedTokenParams) error {
+	_, err := q.db.ExecContext(ctx, addRevokedToken, arg.Jti, arg.ExpiresAt)
+	return err
+}
+
+const addUser = `-- name: AddUser :one
+INSERT INTO users (
+    username, password_hash, role
+  )
+VALUES
+  ($1, $2, $3) RETURNING id, username, password_hash, role, created_at
+`
+
+type AddUserParams struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	Role         string `json:"role"`
+}
+
+func (q *Queries) AddUser(ctx context.Context, arg AddUserParams) (User, error) {
+	row := q.db.QueryRowContext(ctx, addUser, arg.Username, arg.PasswordHash, arg.Role)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.Username,
+		&i.PasswordHash,
+		&i.Role,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const addVisit = `-- name: AddVisit :one
+INSERT INTO visit (
+    patient_id, physician_id, visited_at, duration_minutes, location, reason
+  )
+VALUES
+  ($1, $2, $3, $4, $5, $6) RETURNING id, patient_id, physician_id, visited_at, location, reason, duration_minutes, cancelled_at
+`
+
+type AddVisitParams struct {
+	PatientID       int32     `json:"patient_id"`
+	PhysicianID     int32     `json:"physician_id"`
+	VisitedAt       time.Time `json:"visited_at"`
+	DurationMinutes int32     `json:"duration_minutes"`
+	Location        string    `json:"location"`
+	Reason          string    `json:"reason"`
+}
+
+func (q *Queries) AddVisit(ctx context.Context, arg AddVisitParams) (Visit, error) {
+	row := q.db.QueryRowContext(ctx, addVisit,
+		arg.PatientID,
+		arg.PhysicianID,
+		arg.VisitedAt,
+		arg.DurationMinutes,
+		arg.Location,
+		arg.Reason,
+	)
+	var i Visit
+	err := row.Scan(
+		&i.ID,
+		&i.PatientID,
+		&i.PhysicianID,
+		&i.VisitedAt,
+		&i.Location,
+		&i.Reason,
+		&i.DurationMinutes,
+		&i.CancelledAt,
+	)
+	return i, err
+}
+
+const cancelVisit = `-- name: CancelVisit :one
+UPDATE visit
+SET
+  cancelled_at = NOW()
+WHERE
+  id = $1 AND cancelled_at IS NULL RETURNING id, patient_id, physician_id, visited_at, location, reason, duration_minutes, cancelled_at
+`
+
+func (q *Queries) CancelVisit(ctx context.Context, id int32) (Visit, error) {
+	row := q.db.QueryRowContext(ctx, cancelVisit, id)
+	var i Visit
+	err := row.Scan(
+		&i.ID,
+		&i.PatientID,
+		&i.PhysicianID,
+		&i.VisitedAt,
+		&i.Location,
+		&i.Reason,
+		&i.DurationMinutes,
+		&i.CancelledAt,
+	)
+	return i, err
+}
+
+const deleteExpiredRefreshTokens = `-- name: DeleteExpiredRefreshTokens :exec
+DELETE FROM refresh_token
+WHERE
+  expires_at <= NOW()
+`
+
+func (q *Queries) DeleteExpiredRefreshTokens(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, deleteExpiredRefreshTokens)
+	return err
+}
+
+const deleteExpiredRevokedTokens = `-- name: DeleteExpiredRevokedTokens :exec
+DELETE FROM revoked_token
+WHERE
+  expires_at <= NOW()
+`
+
+func (q *Queries) DeleteExpiredRevokedTokens(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, deleteExpiredRevokedTokens)
+	return err
+}
+
+const deletePatient = `-- name: DeletePatient :one
+DELETE FROM patient
+WHERE
+  id = $1 RETURNING id
+`
+
+func (q *Queries) DeletePatient(ctx context.Context, id int32) (int32, error) {
+	row := q.db.QueryRowContext(ctx, deletePatient, id)
+	err := row.Scan(&id)
+	return id, err
+}
+
+const deletePatientIdentifier = `-- name: DeletePatientIdentifier :one
+DELETE FROM patient_identifier
+WHERE
+  id = $1 AND patient_id = $2 RETURNING id
+`
+
+type DeletePatientIdentifierParams struct {
+	ID        int32 `json:"id"`
+	PatientID int32 `json:"patient_id"`
+}
+
+func (q *Queries) DeletePatientIdentifier(ctx context.Context, arg DeletePatientIdentifierParams) (int32, error) {
+	row := q.db.QueryRowContext(ctx, deletePatientIdentifier, arg.ID, arg.PatientID)
+	var id int32
+	err := row.Scan(&id)
+	return id, err
+}
+
+const deletePhysician = `-- name: DeletePhysician :one
+DELETE FROM physician
+WHERE
+  id = $1 RETURNING id
+`
+
+func (q *Queries) DeletePhysician(ctx context.Context, id int32) (int32, error) {
+	row := q.db.QueryRowContext(ctx, deletePhysician, id)
+	err := row.Scan(&id)
+	return id, err
+}
+
+const getAuditEntry = `-- name: GetAuditEntry :one
+SELECT
+  id, occurred_at, subject, action, resource_type, resource_id, outcome, request_id, prev_hash, hash
+FROM audit_log
+WHERE
+  id = $1
+`
+
+func (q *Queries) GetAuditEntry(ctx context.Context, id int64) (AuditLog, error) {
+	row := q.db.QueryRowContext(ctx, getAuditEntry, id)
+	var i AuditLog
+	err := row.Scan(
+		&i.ID,
+		&i.OccurredAt,
+		&i.Subject,
+		&i.Action,
+		&i.ResourceType,
+		&i.ResourceID,
+		&i.Outcome,
+		&i.RequestID,
+		&i.PrevHash,
+		&i.Hash,
+	)
+	return i, err
+}
+
+const getLastAuditEntry = `-- name: GetLastAuditEntry :one
+SELECT
+  id, occurred_at, subject, action, resource_type, resource_id, outcome, request_id, prev_hash, hash
+FROM audit_log
+ORDER BY
+  id DESC
+LIMIT
+  1
+`
+
+func (q *Queries) GetLastAuditEntry(ctx context.Context) (AuditLog, error) {
+	row := q.db.QueryRowContext(ctx, getLastAuditEntry)
+	var i AuditLog
+	err := row.Scan(
+		&i.ID,
+		&i.OccurredAt,
+		&i.Subject,
+		&i.Action,
+		&i.ResourceType,
+		&i.ResourceID,
+		&i.Outcome,
+		&i.RequestID,
+		&i.PrevHash,
+		&i.Hash,
 	)
 	return i, err
 }
 
 const getPatient = `-- name: GetPatient :one
 SELECT
-  id, first_name, last_name, address, phone, email, created_at
+  id, first_name, last_name, address, phone, email, created_at, date_of_birth, mrn
 FROM patient
 WHERE
   id = $1
@@ -54,6 +407,7 @@ LIMIT
   1
 `
 
+// queries.sql
 func (q *Queries) GetPatient(ctx context.Context, id int32) (Patient, error) {
 	row := q.db.QueryRowContext(ctx, getPatient, id)
 	var i Patient
@@ -65,34 +419,213 @@ func (q *Queries) GetPatient(ctx context.Context, id int32) (Patient, error) {
 		&i.Phone,
 		&i.Email,
 		&i.CreatedAt,
+		&i.DateOfBirth,
+		&i.MRN,
 	)
 	return i, err
 }
 
-const getPatients = `-- name: GetPatients :many
+const getPatientForUpdate = `-- name: GetPatientForUpdate :one
 SELECT
-  id, first_name, last_name, address, phone, email, created_at
+  id, first_name, last_name, address, phone, email, created_at, date_of_birth, mrn
 FROM patient
+WHERE
+  id = $1
+LIMIT
+  1 FOR UPDATE
 `
 
-// queries.sql
-func (q *Queries) GetPatients(ctx context.Context) ([]Patient, error) {
-	rows, err := q.db.QueryContext(ctx, getPatients)
+func (q *Queries) GetPatientForUpdate(ctx context.Context, id int32) (Patient, error) {
+	row := q.db.QueryRowContext(ctx, getPatientForUpdate, id)
+	var i Patient
+	err := row.Scan(
+		&i.ID,
+		&i.FirstName,
+		&i.LastName,
+		&i.Address,
+		&i.Phone,
+		&i.Email,
+		&i.CreatedAt,
+		&i.DateOfBirth,
+		&i.MRN,
+	)
+	return i, err
+}
+
+const getPhysician = `-- name: GetPhysician :one
+SELECT
+  id, first_name, last_name, created_at
+FROM physician
+WHERE
+  id = $1
+LIMIT
+  1
+`
+
+func (q *Queries) GetPhysician(ctx context.Context, id int32) (Physician, error) {
+	row := q.db.QueryRowContext(ctx, getPhysician, id)
+	var i Physician
+	err := row.Scan(
+		&i.ID,
+		&i.FirstName,
+		&i.LastName,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getUser = `-- name: GetUser :one
+SELECT
+  id, username, password_hash, role, created_at
+FROM users
+WHERE
+  id = $1
+LIMIT
+  1
+`
+
+func (q *Queries) GetUser(ctx context.Context, id int32) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUser, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.Username,
+		&i.PasswordHash,
+		&i.Role,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getUserByUsername = `-- name: GetUserByUsername :one
+SELECT
+  id, username, password_hash, role, created_at
+FROM users
+WHERE
+  username = $1
+LIMIT
+  1
+`
+
+func (q *Queries) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByUsername, username)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.Username,
+		&i.PasswordHash,
+		&i.Role,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getVisit = `-- name: GetVisit :one
+SELECT
+  id, patient_id, physician_id, visited_at, location, reason, duration_minutes, cancelled_at
+FROM visit
+WHERE
+  id = $1
+LIMIT
+  1
+`
+
+func (q *Queries) GetVisit(ctx context.Context, id int32) (Visit, error) {
+	row := q.db.QueryRowContext(ctx, getVisit, id)
+	var i Visit
+	err := row.Scan(
+		&i.ID,
+		&i.PatientID,
+		&i.PhysicianID,
+		&i.VisitedAt,
+		&i.Location,
+		&i.Reason,
+		&i.DurationMinutes,
+		&i.CancelledAt,
+	)
+	return i, err
+}
+
+const importVisit = `-- name: ImportVisit :one
+INSERT INTO visit (
+    patient_id, physician_id, visited_at, duration_minutes, location, reason,
+    cancelled_at
+  )
+VALUES
+  ($1, $2, $3, $4, $5, $6, $7) RETURNING id, patient_id, physician_id, visited_at, location, reason, duration_minutes, cancelled_at
+`
+
+type ImportVisitParams struct {
+	PatientID       int32        `json:"patient_id"`
+	PhysicianID     int32        `json:"physician_id"`
+	VisitedAt       time.Time    `json:"visited_at"`
+	DurationMinutes int32        `json:"duration_minutes"`
+	Location        string       `json:"location"`
+	Reason          string       `json:"reason"`
+	CancelledAt     sql.NullTime `json:"cancelled_at"`
+}
+
+func (q *Queries) ImportVisit(ctx context.Context, arg ImportVisitParams) (Visit, error) {
+	row := q.db.QueryRowContext(ctx, importVisit,
+		arg.PatientID,
+		arg.PhysicianID,
+		arg.VisitedAt,
+		arg.DurationMinutes,
+		arg.Location,
+		arg.Reason,
+		arg.CancelledAt,
+	)
+	var i Visit
+	err := row.Scan(
+		&i.ID,
+		&i.PatientID,
+		&i.PhysicianID,
+		&i.VisitedAt,
+		&i.Location,
+		&i.Reason,
+		&i.DurationMinutes,
+		&i.CancelledAt,
+	)
+	return i, err
+}
+
+const listAuditChain = `-- name: ListAuditChain :many
+SELECT
+  id, occurred_at, subject, action, resource_type, resource_id, outcome, request_id, prev_hash, hash
+FROM audit_log
+WHERE
+  id > $1
+ORDER BY
+  id
+LIMIT
+  $2
+`
+
+type ListAuditChainParams struct {
+	ID    int64 `json:"id"`
+	Limit int32 `json:"limit"`
+}
+
+func (q *Queries) ListAuditChain(ctx context.Context, arg ListAuditChainParams) ([]AuditLog, error) {
+	rows, err := q.db.QueryContext(ctx, listAuditChain, arg.ID, arg.Limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []Patient
+	var items []AuditLog
 	for rows.Next() {
-		var i Patient
+		var i AuditLog
 		if err := rows.Scan(
 			&i.ID,
-			&i.FirstName,
-			&i.LastName,
-			&i.Address,
-			&i.Phone,
-			&i.Email,
-			&i.CreatedAt,
+			&i.OccurredAt,
+			&i.Subject,
+			&i.Action,
+			&i.ResourceType,
+			&i.ResourceID,
+			&i.Outcome,
+			&i.RequestID,
+			&i.PrevHash,
+			&i.Hash,
 		); err != nil {
 			return nil, err
 		}
@@ -106,3 +639,676 @@ func (q *Queries) GetPatients(ctx context.Context) ([]Patient, error) {
 	}
 	return items, nil
 }
+
+const listDuplicateCandidates = `-- name: ListDuplicateCandidates :many
+SELECT
+  candidate.id, candidate.first_name, candidate.last_name, candidate.address, candidate.phone, candidate.email, candidate.created_at,
+  candidate.date_of_birth, candidate.mrn,
+  similarity(candidate.first_name || ' ' || candidate.last_name, patient.first_name || ' ' || patient.last_name)::real AS name_similarity
+FROM patient
+JOIN patient AS candidate ON candidate.id <> patient.id
+LEFT JOIN patient_email_index AS patient_index ON patient_index.patient_id = patient.id
+LEFT JOIN patient_email_index AS candidate_index ON candidate_index.patient_id = candidate.id
+LEFT JOIN patient_phone_index AS patient_phone ON patient_phone.patient_id = patient.id
+LEFT JOIN patient_phone_index AS candidate_phone ON candidate_phone.patient_id = candidate.id
+WHERE
+  patient.id = $1
+  AND (
+    (candidate.first_name || ' ' || candidate.last_name) % (patient.first_name || ' ' || patient.last_name)
+    OR (patient.email <> '' AND lower(candidate.email) = lower(patient.email))
+    OR (patient.phone <> '' AND candidate.phone = patient.phone)
+    OR (patient_index.email_index <> '' AND candidate_index.email_index = patient_index.email_index)
+    OR (patient_phone.phone_index <> '' AND candidate_phone.phone_index = patient_phone.phone_index)
+  )
+ORDER BY
+  name_similarity DESC, candidate.id
+LIMIT
+  $2
+`
+
+type ListDuplicateCandidatesParams struct {
+	ID    int32 `json:"id"`
+	Limit int32 `json:"limit"`
+}
+
+type ListDuplicateCandidatesRow struct {
+	ID             int32         `json:"id"`
+	FirstName      string        `json:"first_name"`
+	LastName       string        `json:"last_name"`
+	Address        string        `json:"address"`
+	Phone          string        `json:"phone"`
+	Email          string        `json:"email"`
+	CreatedAt      sql.NullTime  `json:"created_at"`
+	DateOfBirth    date.NullDate `json:"date_of_birth"`
+	MRN            string        `json:"mrn"`
+	NameSimilarity float32       `json:"name_similarity"`
+}
+
+func (q *Queries) ListDuplicateCandidates(ctx context.Context, arg ListDuplicateCandidatesParams) ([]ListDuplicateCandidatesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listDuplicateCandidates, arg.ID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDuplicateCandidatesRow
+	for rows.Next() {
+		var i ListDuplicateCandidatesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Address,
+			&i.Phone,
+			&i.Email,
+			&i.CreatedAt,
+			&i.DateOfBirth,
+			&i.MRN,
+			&i.NameSimilarity,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listIdentifiers = `-- name: ListIdentifiers :many
+SELECT
+  id, patient_id, system, value, created_at
+FROM patient_identifier
+WHERE
+  id > $1
+ORDER BY
+  id
+LIMIT
+  $2
+`
+
+type ListIdentifiersParams struct {
+	ID    int32 `json:"id"`
+	Limit int32 `json:"limit"`
+}
+
+func (q *Queries) ListIdentifiers(ctx context.Context, arg ListIdentifiersParams) ([]PatientIdentifier, error) {
+	rows, err := q.db.QueryContext(ctx, listIdentifiers, arg.ID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []PatientIdentifier
+	for rows.Next() {
+		var i PatientIdentifier
+		if err := rows.Scan(
+			&i.ID,
+			&i.PatientID,
+			&i.System,
+			&i.Value,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPatientIdentifiers = `-- name: ListPatientIdentifiers :many
+SELECT
+  id, patient_id, system, value, created_at
+FROM patient_identifier
+WHERE
+  patient_id = $1
+ORDER BY
+  id
+`
+
+func (q *Queries) ListPatientIdentifiers(ctx context.Context, patientID int32) ([]PatientIdentifier, error) {
+	rows, err := q.db.QueryContext(ctx, listPatientIdentifiers, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []PatientIdentifier
+	for rows.Next() {
+		var i PatientIdentifier
+		if err := rows.Scan(
+			&i.ID,
+			&i.PatientID,
+			&i.System,
+			&i.Value,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPatientVisits = `-- name: ListPatientVisits :many
+SELECT
+  id, patient_id, physician_id, visited_at, location, reason, duration_minutes, cancelled_at
+FROM visit
+WHERE
+  patient_id = $1 AND (visited_at, id) > ($2, $3)
+ORDER BY
+  visited_at, id
+LIMIT
+  $4
+`
+
+type ListPatientVisitsParams struct {
+	PatientID int32     `json:"patient_id"`
+	VisitedAt time.Time `json:"visited_at"`
+	ID        int32     `json:"id"`
+	Limit     int32     `json:"limit"`
+}
+
+func (q *Queries) ListPatientVisits(ctx context.Context, arg ListPatientVisitsParams) ([]Visit, error) {
+	rows, err := q.db.QueryContext(ctx, listPatientVisits,
+		arg.PatientID,
+		arg.VisitedAt,
+		arg.ID,
+		arg.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Visit
+	for rows.Next() {
+		var i Visit
+		if err := rows.Scan(
+			&i.ID,
+			&i.PatientID,
+			&i.PhysicianID,
+			&i.VisitedAt,
+			&i.Location,
+			&i.Reason,
+			&i.DurationMinutes,
+			&i.CancelledAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPhysicianVisits = `-- name: ListPhysicianVisits :many
+SELECT
+  id, patient_id, physician_id, visited_at, location, reason, duration_minutes, cancelled_at
+FROM visit
+WHERE
+  physician_id = $1 AND (visited_at, id) > ($2, $3)
+ORDER BY
+  visited_at, id
+LIMIT
+  $4
+`
+
+type ListPhysicianVisitsParams struct {
+	PhysicianID int32     `json:"physician_id"`
+	VisitedAt   time.Time `json:"visited_at"`
+	ID          int32     `json:"id"`
+	Limit       int32     `json:"limit"`
+}
+
+func (q *Queries) ListPhysicianVisits(ctx context.Context, arg ListPhysicianVisitsParams) ([]Visit, error) {
+	rows, err := q.db.QueryContext(ctx, listPhysicianVisits,
+		arg.PhysicianID,
+		arg.VisitedAt,
+		arg.ID,
+		arg.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Visit
+	for rows.Next() {
+		var i Visit
+		if err := rows.Scan(
+			&i.ID,
+			&i.PatientID,
+			&i.PhysicianID,
+			&i.VisitedAt,
+			&i.Location,
+			&i.Reason,
+			&i.DurationMinutes,
+			&i.CancelledAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPhysicians = `-- name: ListPhysicians :many
+SELECT
+  id, first_name, last_name, created_at
+FROM physician
+WHERE
+  id > $1
+ORDER BY
+  id
+LIMIT
+  $2
+`
+
+type ListPhysiciansParams struct {
+	ID    int32 `json:"id"`
+	Limit int32 `json:"limit"`
+}
+
+func (q *Queries) ListPhysicians(ctx context.Context, arg ListPhysiciansParams) ([]Physician, error) {
+	rows, err := q.db.QueryContext(ctx, listPhysicians, arg.ID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Physician
+	for rows.Next() {
+		var i Physician
+		if err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRevokedTokens = `-- name: ListRevokedTokens :many
+SELECT
+  jti, expires_at
+FROM revoked_token
+WHERE
+  expires_at > NOW()
+`
+
+func (q *Queries) ListRevokedTokens(ctx context.Context) ([]RevokedToken, error) {
+	rows, err := q.db.QueryContext(ctx, listRevokedTokens)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []RevokedToken
+	for rows.Next() {
+		var i RevokedToken
+		if err := rows.Scan(&i.Jti, &i.ExpiresAt); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listVisits = `-- name: ListVisits :many
+SELECT
+  id, patient_id, physician_id, visited_at, location, reason, duration_minutes, cancelled_at
+FROM visit
+WHERE
+  (visited_at, id) > ($1, $2)
+ORDER BY
+  visited_at, id
+LIMIT
+  $3
+`
+
+type ListVisitsParams struct {
+	VisitedAt time.Time `json:"visited_at"`
+	ID        int32     `json:"id"`
+	Limit     int32     `json:"limit"`
+}
+
+func (q *Queries) ListVisits(ctx context.Context, arg ListVisitsParams) ([]Visit, error) {
+	rows, err := q.db.QueryContext(ctx, listVisits, arg.VisitedAt, arg.ID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Visit
+	for rows.Next() {
+		var i Visit
+		if err := rows.Scan(
+			&i.ID,
+			&i.PatientID,
+			&i.PhysicianID,
+			&i.VisitedAt,
+			&i.Location,
+			&i.Reason,
+			&i.DurationMinutes,
+			&i.CancelledAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const lockAuditLog = `-- name: LockAuditLog :exec
+SELECT pg_advisory_xact_lock(8411239)
+`
+
+func (q *Queries) LockAuditLog(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, lockAuditLog)
+	return err
+}
+
+const movePatientIdentifiers = `-- name: MovePatientIdentifiers :execrows
+UPDATE patient_identifier
+SET
+  patient_id = $1
+WHERE
+  patient_id = $2
+`
+
+type MovePatientIdentifiersParams struct {
+	ToPatientID   int32 `json:"to_patient_id"`
+	FromPatientID int32 `json:"from_patient_id"`
+}
+
+func (q *Queries) MovePatientIdentifiers(ctx context.Context, arg MovePatientIdentifiersParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, movePatientIdentifiers, arg.ToPatientID, arg.FromPatientID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const movePatientVisits = `-- name: MovePatientVisits :execrows
+UPDATE visit
+SET
+  patient_id = $1
+WHERE
+  patient_id = $2
+`
+
+type MovePatientVisitsParams struct {
+	ToPatientID   int32 `json:"to_patient_id"`
+	FromPatientID int32 `json:"from_patient_id"`
+}
+
+func (q *Queries) MovePatientVisits(ctx context.Context, arg MovePatientVisitsParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, movePatientVisits, arg.ToPatientID, arg.FromPatientID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const nextPatientMRN = `-- name: NextPatientMRN :one
+SELECT
+  nextval('patient_mrn_seq')
+`
+
+func (q *Queries) NextPatientMRN(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, nextPatientMRN)
+	var nextval int64
+	err := row.Scan(&nextval)
+	return nextval, err
+}
+
+const patientMRNExists = `-- name: PatientMRNExists :one
+SELECT
+  EXISTS (SELECT 1 FROM patient WHERE mrn = $1)
+`
+
+func (q *Queries) PatientMRNExists(ctx context.Context, mrn string) (bool, error) {
+	row := q.db.QueryRowContext(ctx, patientMRNExists, mrn)
+	var exists bool
+	err := row.Scan(&exists)
+	return exists, err
+}
+
+const reencryptPatient = `-- name: ReencryptPatient :execrows
+UPDATE patient
+SET
+  address = $1, phone = $2, email = $3
+WHERE
+  id = $4 AND address = $5 AND phone = $6 AND email = $7
+`
+
+type ReencryptPatientParams struct {
+	Address    string `json:"address"`
+	Phone      string `json:"phone"`
+	Email      string `json:"email"`
+	ID         int32  `json:"id"`
+	OldAddress string `json:"old_address"`
+	OldPhone   string `json:"old_phone"`
+	OldEmail   string `json:"old_email"`
+}
+
+func (q *Queries) ReencryptPatient(ctx context.Context, arg ReencryptPatientParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, reencryptPatient,
+		arg.Address,
+		arg.Phone,
+		arg.Email,
+		arg.ID,
+		arg.OldAddress,
+		arg.OldPhone,
+		arg.OldEmail,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const rescheduleVisit = `-- name: RescheduleVisit :one
+UPDATE visit
+SET
+  visited_at = $2, duration_minutes = $3, location = $4
+WHERE
+  id = $1 AND cancelled_at IS NULL RETURNING id, patient_id, physician_id, visited_at, location, reason, duration_minutes, cancelled_at
+`
+
+type RescheduleVisitParams struct {
+	ID              int32     `json:"id"`
+	VisitedAt       time.Time `json:"visited_at"`
+	DurationMinutes int32     `json:"duration_minutes"`
+	Location        string    `json:"location"`
+}
+
+func (q *Queries) RescheduleVisit(ctx context.Context, arg RescheduleVisitParams) (Visit, error) {
+	row := q.db.QueryRowContext(ctx, rescheduleVisit,
+		arg.ID,
+		arg.VisitedAt,
+		arg.DurationMinutes,
+		arg.Location,
+	)
+	var i Visit
+	err := row.Scan(
+		&i.ID,
+		&i.PatientID,
+		&i.PhysicianID,
+		&i.VisitedAt,
+		&i.Location,
+		&i.Reason,
+		&i.DurationMinutes,
+		&i.CancelledAt,
+	)
+	return i, err
+}
+
+const revokeRefreshToken = `-- name: RevokeRefreshToken :one
+UPDATE refresh_token
+SET
+  revoked_at = NOW()
+WHERE
+  token_hash = $1 AND revoked_at IS NULL AND expires_at > NOW() RETURNING id, user_id, token_hash, expires_at, created_at, revoked_at
+`
+
+func (q *Queries) RevokeRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, error) {
+	row := q.db.QueryRowContext(ctx, revokeRefreshToken, tokenHash)
+	var i RefreshToken
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.TokenHash,
+		&i.ExpiresAt,
+		&i.CreatedAt,
+		&i.RevokedAt,
+	)
+	return i, err
+}
+
+const setPatientEmailIndex = `-- name: SetPatientEmailIndex :exec
+INSERT INTO patient_email_index (patient_id, email_index)
+VALUES
+  ($1, $2) ON CONFLICT (patient_id) DO UPDATE
+SET
+  email_index = EXCLUDED.email_index
+`
+
+type SetPatientEmailIndexParams struct {
+	PatientID  int32  `json:"patient_id"`
+	EmailIndex string `json:"email_index"`
+}
+
+func (q *Queries) SetPatientEmailIndex(ctx context.Context, arg SetPatientEmailIndexParams) error {
+	_, err := q.db.ExecContext(ctx, setPatientEmailIndex, arg.PatientID, arg.EmailIndex)
+	return err
+}
+
+const setPatientPhoneIndex = `-- name: SetPatientPhoneIndex :exec
+INSERT INTO patient_phone_index (patient_id, phone_index)
+VALUES
+  ($1, $2) ON CONFLICT (patient_id) DO UPDATE
+SET
+  phone_index = EXCLUDED.phone_index
+`
+
+type SetPatientPhoneIndexParams struct {
+	PatientID  int32  `json:"patient_id"`
+	PhoneIndex string `json:"phone_index"`
+}
+
+func (q *Queries) SetPatientPhoneIndex(ctx context.Context, arg SetPatientPhoneIndexParams) error {
+	_, err := q.db.ExecContext(ctx, setPatientPhoneIndex, arg.PatientID, arg.PhoneIndex)
+	return err
+}
+
+const updatePatient = `-- name: UpdatePatient :one
+UPDATE patient
+SET
+  first_name = $2, last_name = $3, address = $4, phone = $5, email = $6, date_of_birth = $7
+WHERE
+  id = $1 RETURNING id, first_name, last_name, address, phone, email, created_at, date_of_birth, mrn
+`
+
+type UpdatePatientParams struct {
+	ID          int32         `json:"id"`
+	FirstName   string        `json:"first_name"`
+	LastName    string        `json:"last_name"`
+	Address     string        `json:"address"`
+	Phone       string        `json:"phone"`
+	Email       string        `json:"email"`
+	DateOfBirth date.NullDate `json:"date_of_birth"`
+}
+
+func (q *Queries) UpdatePatient(ctx context.Context, arg UpdatePatientParams) (Patient, error) {
+	row := q.db.QueryRowContext(ctx, updatePatient,
+		arg.ID,
+		arg.FirstName,
+		arg.LastName,
+		arg.Address,
+		arg.Phone,
+		arg.Email,
+		arg.DateOfBirth,
+	)
+	var i Patient
+	err := row.Scan(
+		&i.ID,
+		&i.FirstName,
+		&i.LastName,
+		&i.Address,
+		&i.Phone,
+		&i.Email,
+		&i.CreatedAt,
+		&i.DateOfBirth,
+		&i.MRN,
+	)
+	return i, err
+}
+
+const updatePhysician = `-- name: UpdatePhysician :one
+UPDATE physician
+SET
+  first_name = $2, last_name = $3
+WHERE
+  id = $1 RETURNING id, first_name, last_name, created_at
+`
+
+type UpdatePhysicianParams struct {
+	ID        int32  `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+func (q *Queries) UpdatePhysician(ctx context.Context, arg UpdatePhysicianParams) (Physician, error) {
+	row := q.db.QueryRowContext(ctx, updatePhysician, arg.ID, arg.FirstName, arg.LastName)
+	var i Physician
+	err := row.Scan(
+		&i.ID,
+		&i.FirstName,
+		&i.LastName,
+		&i.CreatedAt,
+	)
+	return i, err
+}
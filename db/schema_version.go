@@ -0,0 +1,17 @@
+package db
+
+import "context"
+
+// getSchemaVersion is written by hand, since the schema_migrations table is
+// created by the Migrator instead of a migration
+const getSchemaVersion = `-- name: GetSchemaVersion :one
+SELECT COALESCE(MAX(version), 0)::bigint FROM schema_migrations`
+
+// GetSchemaVersion returns the version of the newest applied migration, or 0 if
+// none have been applied
+func (q *Queries) GetSchemaVersion(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getSchemaVersion)
+	var version int64
+	err := row.Scan(&version)
+	return version, err
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// patientName is the expression which the name search indexes are built on
+const patientName = `(first_name || ' ' || last_name)`
+
+// encryptedValuePattern matches the encrypted emails and phone numbers, which
+// the contact trigram indexes leave out
+const encryptedValuePattern = `'enc:v1:%'`
+
+// searchPatients is the base query used by SearchPatients. The matching
+// conditions and the score depend on the columns being searched, so the rest
+// is built by hand.
+const searchPatients = `-- name: SearchPatients :many
+SELECT
+  id, first_name, last_name, address, phone, email, created_at, date_of_birth, mrn, score
+FROM (
+  SELECT
+    id, first_name, last_name, address, phone, email, created_at, date_of_birth, mrn, LEAST(GREATEST(%s), 1)::real AS score
+  FROM patient
+  WHERE
+    %s
+) AS matches`
+
+// SearchPatientsParams contains the search query and the keyset pagination
+// parameters for SearchPatients
+type SearchPatientsParams struct {
+	// Query matches names through trigram similarity and full-text search
+	// and emails and phone numbers through trigram similarity
+	Query string
+	// ExcludeContact only matches names, since trigrams of encrypted emails and
+	// phone numbers are meaningless
+	ExcludeContact bool
+	// EmailIndexes match patients whose email blind index is one of these with
+	// the highest score
+	EmailIndexes []string
+	// AfterScore and AfterID are the score and ID of the last patient from the
+	// previous page. AfterID is 0 for the first page.
+	AfterScore float32
+	AfterID    int32
+	Limit      int32
+}
+
+// SearchPatientsRow is a patient matched by SearchPatients, together with how
+// well it matches, between 0 and 1
+type SearchPatientsRow struct {
+	Patient
+	Score float32 `json:"score"`
+}
+
+// SearchPatients returns one page of the patients which match the query, with
+// the best matches first and using the patient ID to break ties
+func (q *Queries) SearchPatients(ctx context.Context, arg SearchPatientsParams) ([]SearchPatientsRow, error) {
+	var args []interface{}
+	addArg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	query := addArg(arg.Query)
+	// % and <% use the pg_trgm similarity thresholds, which default to 0.3 and
+	// 0.6, so the indexes can be used
+	scores := []string{
+		fmt.Sprintf("similarity(%s, %s)", patientName, query),
+		fmt.Sprintf("word_similarity(%s, %s)", query, patientName),
+		fmt.Sprintf("ts_rank(to_tsvector('simple', first_name || ' ' || last_name), plainto_tsquery('simple', %s))", query),
+	}
+	matches := []string{
+		fmt.Sprintf("%s %% %s", patientName, query),
+		fmt.Sprintf("%s <%% %s", query, patientName),
+		fmt.Sprintf("to_tsvector('simple', first_name || ' ' || last_name) @@ plainto_tsquery('simple', %s)", query),
+	}
+	if !arg.ExcludeContact {
+		for _, column := range []string{"email", "phone"} {
+			scores = append(scores, fmt.Sprintf("word_similarity(%s, %s)", query, column))
+			matches = append(matches, fmt.Sprintf("(%[2]s NOT LIKE %[3]s AND %[1]s <%% %[2]s)", query, column, encryptedValuePattern))
+		}
+	}
+	if len(arg.EmailIndexes) > 0 {
+		emailMatch := fmt.Sprintf(
+			"id IN (SELECT patient_id FROM patient_email_index WHERE email_index = ANY(%s))",
+			addArg(pq.Array(arg.EmailIndexes)),
+		)
+		scores = append(scores, fmt.Sprintf("CASE WHEN %s THEN 1 ELSE 0 END", emailMatch))
+		matches = append(matches, emailMatch)
+	}
+
+	var stmt strings.Builder
+	fmt.Fprintf(&stmt, searchPatients, strings.Join(scores, ", "), strings.Join(matches, "\n    OR "))
+	if arg.AfterID != 0 {
+		fmt.Fprintf(&stmt, "\nWHERE\n  score < %[1]s::real OR (score = %[1]s::real AND id > %[2]s)", addArg(arg.AfterScore), addArg(arg.AfterID))
+	}
+	fmt.Fprintf(&stmt, "\nORDER BY\n  score DESC, id ASC\nLIMIT\n  %s", addArg(arg.Limit))
+
+	rows, err := q.db.QueryContext(ctx, stmt.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SearchPatientsRow
+	for rows.Next() {
+		var i SearchPatientsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Address,
+			&i.Phone,
+			&i.Email,
+			&i.CreatedAt,
+			&i.DateOfBirth,
+			&i.MRN,
+			&i.Score,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -37,23 +37,133 @@ while ! is_healthy ferrum; do sleep 1; done
 
 echo "Starting integration tests"
 
-echo "Generating authentication token"
-token="$(curl -s http://${service_url}/generate-token | jq -r '.token')" || die "Failed generate token test"
-[ -n "${token}" ] || die "Failed to generate authentication token"
+echo "Testing the health probes"
+curl -sf http://${service_url}/health/live | jq -e '.status == "up"' > /dev/null || die "Failed liveness probe test"
+ready="$(curl -sf http://${service_url}/health/ready)" || die "Failed readiness probe test"
+echo "${ready}" | jq -e '[.components[].status] == ["up", "up", "up"]' > /dev/null || die "Failed readiness probe test: ${ready}"
+
+echo "Testing the metrics"
+curl -sf http://${service_url}/metrics | grep -q '^ferrum_build_info{' || die "Failed metrics test"
+
+echo "Testing the database migrations"
+migrations="$(docker-compose exec -T ferrum /opt/ferrum migrate status)" || die "Failed migration status test"
+echo "${migrations}" | grep -q pending && die "Failed migration status test with pending migrations: ${migrations}"
+
+echo "Creating a user"
+echo "integration-password" | docker-compose exec -T ferrum /opt/ferrum user create -username integration -role admin || die "Failed create user test"
+
+echo "Testing login with a wrong password"
+status="$(curl -s -o /dev/null -w "%{http_code}" --data '{"username":"integration","password":"wrong"}' http://${service_url}/auth/login)" || die "Failed wrong password login test"
+[ "${status}" == "401" ] || die "Failed wrong password login test with status: ${status}"
+
+echo "Logging in"
+token="$(curl -s --data '{"username":"integration","password":"integration-password"}' http://${service_url}/auth/login | jq -r '.token')" || die "Failed login test"
+[ -n "${token}" ] && [ "${token}" != "null" ] || die "Failed to log in"
 
 echo "Testing unauthorised requests"
 status="$(curl -s -o /dev/null -w "%{http_code}" http://${service_url}/api/v1/patients)" || die "Failed unauthorised access test"
 [ "${status}" == "401" ] || die "Failed unauthorised access test with status: ${status}"
 
+echo "Testing error responses"
+problem="$(curl -s -D - http://${service_url}/api/v1/patients)" || die "Failed error response test"
+echo "${problem}" | grep -qi "^content-type: application/problem+json" || die "Failed error response test with: ${problem}"
+echo "${problem}" | tail -n 1 | jq -e '.type == "urn:ferrum:problem:unauthorized" and .status == 401' > /dev/null || die "Failed error response test with: ${problem}"
+
+echo "Testing request IDs"
+request_id="$(curl -s -o /dev/null -D - -H "X-Request-ID: integration-1" http://${service_url}/health/live | grep -i "^X-Request-ID: " | cut -d' ' -f2- | tr -cd '[:print:]')" || die "Failed request ID test"
+[ "${request_id}" == "integration-1" ] || die "Failed request ID test with: ${request_id}"
+
 echo "Testing returned status when adding a patient"
-status="$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ${token}" --data '{"first_name":"Hoenir"}' http://${service_url}/api/v1/patients)" || die "Failed add patient test"
+status="$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ${token}" --data '{"first_name":"Hoenir","last_name":"Aesir"}' http://${service_url}/api/v1/patients)" || die "Failed add patient test"
 [ "${status}" == "201" ] || die "Failed add patient test with status: ${status}"
 
+echo "Testing patient validation"
+problem="$(curl -s -w "\n%{http_code}" -H "Authorization: Bearer ${token}" --data '{"first_name":"Loki","email":"loki","shapeshifter":true}' http://${service_url}/api/v1/patients)" || die "Failed patient validation test"
+[ "$(echo "${problem}" | tail -n 1)" == "422" ] || die "Failed patient validation test with: ${problem}"
+echo "${problem}" | head -n 1 | jq -e '[.errors[].field] | sort == ["email", "last_name", "shapeshifter"]' > /dev/null || die "Failed patient validation test with: ${problem}"
+
 echo "Testing retrieving an added patient"
-patient_link="$(curl -s -o /dev/null -H "Authorization: Bearer ${token}" --data '{"first_name":"Heimdall"}' -D - http://${service_url}/api/v1/patients | grep "Location: " | cut -d' ' -f2- | tr -cd '[:print:]')" || die "Failed retrieve added patient test"
+patient_link="$(curl -s -o /dev/null -H "Authorization: Bearer ${token}" --data '{"first_name":"Heimdall","last_name":"Aesir","email":"heimdall@asgard.example"}' -D - http://${service_url}/api/v1/patients | grep "Location: " | cut -d' ' -f2- | tr -cd '[:print:]')" || die "Failed retrieve added patient test"
 first_name="$(curl -s -H "Authorization: Bearer ${token}" "${patient_link}" | jq -r '.first_name')"  || die "Failed retrieve added patient test"
 [ "${first_name}" == "Heimdall" ] || die "Failed add second patient test from URL '${patient_link}' with wrong name: ${first_name}"
 
 echo "Testing added patients count"
-patient_count="$(curl -s -H "Authorization: Bearer ${token}" http://${service_url}/api/v1/patients | jq length)"  || die "Failed added patients count test"
-[ "${patient_count}" == "2" ] || die "Failed get patients test with wrong patient count: ${patient_count}"
\ No newline at end of file
+patient_count="$(curl -s -H "Authorization: Bearer ${token}" http://${service_url}/api/v1/patients | jq '.data | length')"  || die "Failed added patients count test"
+[ "${patient_count}" == "2" ] || die "Failed get patients test with wrong patient count: ${patient_count}"
+
+echo "Testing looking patients up by email"
+patient_count="$(curl -s -H "Authorization: Bearer ${token}" "http://${service_url}/api/v1/patients?email=Heimdall@asgard.example" | jq '.data | length')"  || die "Failed email lookup test"
+[ "${patient_count}" == "1" ] || die "Failed email lookup test with wrong patient count: ${patient_count}"
+
+echo "Testing the patient search"
+first_name="$(curl -s -H "Authorization: Bearer ${token}" "http://${service_url}/api/v1/patients/search?q=heimdal" | jq -r '.data[0].first_name')"  || die "Failed patient search test"
+[ "${first_name}" == "Heimdall" ] || die "Failed patient search test with wrong first match: ${first_name}"
+
+echo "Testing adding a patient with the same name"
+twin_mrn="$(curl -s -H "Authorization: Bearer ${token}" --data '{"first_name":"Hoenir","last_name":"Aesir"}' http://${service_url}/api/v1/patients | jq -r '.mrn')" || die "Failed same name patient test"
+[ -n "${twin_mrn}" ] && [ "${twin_mrn}" != "null" ] || die "Failed same name patient test without an MRN"
+patient_count="$(curl -s -H "Authorization: Bearer ${token}" "http://${service_url}/api/v1/patients?mrn=${twin_mrn}" | jq '.data | length')"  || die "Failed MRN lookup test"
+[ "${patient_count}" == "1" ] || die "Failed MRN lookup test with wrong patient count: ${patient_count}"
+
+echo "Testing external patient identifiers"
+status="$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ${token}" --data '{"system":"https://asgard.example/ids","value":"H-1"}' "${patient_link}/identifiers")" || die "Failed add identifier test"
+[ "${status}" == "201" ] || die "Failed add identifier test with status: ${status}"
+first_name="$(curl -s -G -H "Authorization: Bearer ${token}" --data-urlencode "identifier=https://asgard.example/ids|H-1" http://${service_url}/api/v1/patients | jq -r '.data[0].first_name')"  || die "Failed identifier lookup test"
+[ "${first_name}" == "Heimdall" ] || die "Failed identifier lookup test with wrong name: ${first_name}"
+status="$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ${token}" --data '{"system":"https://asgard.example/ids","value":"H-1"}' "${patient_link}/identifiers")" || die "Failed duplicate identifier test"
+[ "${status}" == "409" ] || die "Failed duplicate identifier test with status: ${status}"
+
+echo "Testing updating a patient"
+status="$(curl -s -o /dev/null -w "%{http_code}" -X PATCH -H "Authorization: Bearer ${token}" --data '{"last_name":"Watchman"}' "${patient_link}")" || die "Failed update patient test"
+[ "${status}" == "200" ] || die "Failed update patient test with status: ${status}"
+last_name="$(curl -s -H "Authorization: Bearer ${token}" "${patient_link}" | jq -r '.last_name')"  || die "Failed update patient test"
+[ "${last_name}" == "Watchman" ] || die "Failed update patient test with wrong last name: ${last_name}"
+status="$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer ${token}" --data '{"first_name":"Heimdall","last_name":"Watchman","mrn":"MRN-CHANGED"}' "${patient_link}")" || die "Failed MRN change test"
+[ "${status}" == "422" ] || die "Failed MRN change test with status: ${status}"
+
+echo "Testing duplicate detection and merging"
+duplicate_link="$(curl -s -o /dev/null -H "Authorization: Bearer ${token}" --data '{"first_name":"Heimdal","last_name":"Watchman","email":"heimdall@asgard.example"}' -D - http://${service_url}/api/v1/patients | grep "Location: " | cut -d' ' -f2- | tr -cd '[:print:]')" || die "Failed add duplicate patient test"
+duplicate_id="${duplicate_link##*/}"
+duplicate_mrn="$(curl -s -H "Authorization: Bearer ${token}" "${duplicate_link}" | jq -r '.mrn')" || die "Failed add duplicate patient test"
+candidate_id="$(curl -s -H "Authorization: Bearer ${token}" "${patient_link}/duplicates" | jq -r '.data[0].patient.id')" || die "Failed duplicate detection test"
+[ "${candidate_id}" == "${duplicate_id}" ] || die "Failed duplicate detection test with wrong first candidate: ${candidate_id}"
+status="$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ${token}" --data "{\"duplicate_id\":${duplicate_id}}" "${patient_link}/merge")" || die "Failed merge test"
+[ "${status}" == "200" ] || die "Failed merge test with status: ${status}"
+status="$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ${token}" "${duplicate_link}")" || die "Failed merge test"
+[ "${status}" == "404" ] || die "Failed merge test with duplicate status: ${status}"
+merged_id="$(curl -s -G -H "Authorization: Bearer ${token}" --data-urlencode "identifier=urn:ferrum:mrn|${duplicate_mrn}" http://${service_url}/api/v1/patients | jq -r '.data[0].id')" || die "Failed merged MRN lookup test"
+[ "${merged_id}" == "${patient_link##*/}" ] || die "Failed merged MRN lookup test with wrong patient: ${merged_id}"
+
+echo "Testing deleting a patient"
+status="$(curl -s -o /dev/null -w "%{http_code}" -X DELETE -H "Authorization: Bearer ${token}" "${patient_link}")" || die "Failed delete patient test"
+[ "${status}" == "204" ] || die "Failed delete patient test with status: ${status}"
+status="$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ${token}" "${patient_link}")" || die "Failed delete patient test"
+[ "${status}" == "404" ] || die "Failed delete patient test with status: ${status}"
+echo "Testing refreshing the token"
+refresh_token="$(curl -s --data '{"username":"integration","password":"integration-password"}' http://${service_url}/auth/login | jq -r '.refresh_token')" || die "Failed refresh token test"
+token="$(curl -s --data "{\"refresh_token\":\"${refresh_token}\"}" http://${service_url}/auth/refresh | jq -r '.token')" || die "Failed refresh token test"
+[ -n "${token}" ] && [ "${token}" != "null" ] || die "Failed to refresh the token"
+status="$(curl -s -o /dev/null -w "%{http_code}" --data "{\"refresh_token\":\"${refresh_token}\"}" http://${service_url}/auth/refresh)" || die "Failed refresh token reuse test"
+[ "${status}" == "401" ] || die "Failed refresh token reuse test with status: ${status}"
+
+echo "Testing logging out"
+status="$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "Authorization: Bearer ${token}" http://${service_url}/auth/logout)" || die "Failed logout test"
+[ "${status}" == "204" ] || die "Failed logout test with status: ${status}"
+status="$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ${token}" http://${service_url}/api/v1/patients)" || die "Failed logout test"
+[ "${status}" == "401" ] || die "Failed logout test with status: ${status}"
+
+echo "Testing the audit log"
+echo "auditor-password" | docker-compose exec -T ferrum /opt/ferrum user create -username auditor -role auditor || die "Failed create auditor test"
+auditor_token="$(curl -s --data '{"username":"auditor","password":"auditor-password"}' http://${service_url}/auth/login | jq -r '.token')" || die "Failed auditor login test"
+deletes="$(curl -s -H "Authorization: Bearer ${auditor_token}" "http://${service_url}/api/v1/audit?subject=integration&action=delete&outcome=success" | jq '.data | length')" || die "Failed audit log test"
+[ "${deletes}" == "1" ] || die "Failed audit log test with wrong delete count: ${deletes}"
+valid="$(curl -s -H "Authorization: Bearer ${auditor_token}" "http://${service_url}/api/v1/audit/verify" | jq -r '.valid')" || die "Failed audit verify test"
+[ "${valid}" == "true" ] || die "Failed audit verify test with a broken hash chain"
+docker-compose exec -T ferrum /opt/ferrum audit verify > /dev/null || die "Failed audit verify command test"
+
+echo "Testing the admin commands"
+cli_token="$(docker-compose exec -T ferrum /opt/ferrum token issue -username integration)" || die "Failed token issue test"
+status="$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ${cli_token}" http://${service_url}/api/v1/patients)" || die "Failed token issue test"
+[ "${status}" == "200" ] || die "Failed token issue test with status: ${status}"
+docker-compose exec -T ferrum /opt/ferrum seed || die "Failed seed test"
+docker-compose exec -T ferrum /opt/ferrum export | jq -e '.physicians and .patients and .visits' > /dev/null || die "Failed export test"
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// Audit entry outcomes
+const (
+	auditSuccess = "success"
+	auditDenied  = "denied"
+	auditFailure = "failure"
+)
+
+// auditAnonymousSubject is the subject of the requests which don't carry a
+// valid token
+const auditAnonymousSubject = "anonymous"
+
+// auditEvent describes the API access which is being audited. The audit
+// middleware records it after the handler returns, unless the handler already
+// recorded it in the same transaction as a mutation.
+type auditEvent struct {
+	subject      string
+	action       string
+	resourceType string
+	resourceID   string
+	requestID    string
+	recorded     bool
+}
+
+func (e *auditEvent) entry(outcome string) db.AddAuditEntryParams {
+	return db.AddAuditEntryParams{
+		Subject:      e.subject,
+		Action:       e.action,
+		ResourceType: e.resourceType,
+		ResourceID:   e.resourceID,
+		Outcome:      outcome,
+		RequestID:    e.requestID,
+	}
+}
+
+type auditContextKey struct{}
+
+// auditActions maps HTTP methods to the audited actions
+var auditActions = map[string]string{
+	http.MethodGet:    "read",
+	http.MethodPost:   "create",
+	http.MethodPut:    "update",
+	http.MethodPatch:  "update",
+	http.MethodDelete: "delete",
+}
+
+// statusRecorder captures the status code and the size of the response written
+// by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// audit records one audit log entry for every request. The resource ID is taken
+// from the `id` URL variable and the action is derived from the request method,
+// unless one is given. It must run before the JWT middleware, so the requests
+// which it rejects are audited as well, with the anonymous subject. The
+// middleware sets the subject once it has validated the token.
+func (s Server) audit(resourceType, action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event := &auditEvent{
+			action:       action,
+			resourceType: resourceType,
+			resourceID:   mux.Vars(r)["id"],
+			requestID:    requestIDFromContext(r.Context()),
+		}
+		if event.action == "" {
+			event.action = auditActions[r.Method]
+		}
+		event.subject = auditAnonymousSubject
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, event)))
+
+		if event.recorded {
+			return
+		}
+
+		outcome := auditSuccess
+		switch {
+		case recorder.status == http.StatusUnauthorized, recorder.status == http.StatusForbidden:
+			outcome = auditDenied
+		case recorder.status >= http.StatusBadRequest:
+			outcome = auditFailure
+		}
+
+		// Don't let the client cancel the request before it is audited
+		ctx, done := context.WithTimeout(context.Background(), s.config.HTTPRequestTimeout)
+		defer done()
+		err := s.database.ExecTx(ctx, func(q queries) error {
+			return s.appendAuditEntry(ctx, q, event.entry(outcome))
+		})
+		if err != nil {
+			log.WithContext(r.Context()).Errorf("Failed to write audit entry %+v: %v", event.entry(outcome), err)
+		}
+	}
+}
+
+// setAuditSubject records the authenticated subject in the audit event of the
+// request, if it's audited
+func setAuditSubject(ctx context.Context, subject string) {
+	if event, ok := ctx.Value(auditContextKey{}).(*auditEvent); ok {
+		event.subject = subject
+	}
+}
+
+// mutate runs a mutation and records its audit entry in the same transaction,
+// so changes are never made without being audited. fn returns the type and ID
+// of the resource it changed.
+func (s Server) mutate(ctx context.Context, fn func(q queries) (resourceType string, resourceID int32, err error)) error {
+	event, _ := ctx.Value(auditContextKey{}).(*auditEvent)
+
+	err := s.database.ExecTx(ctx, func(q queries) error {
+		resourceType, resourceID, err := fn(q)
+		if err != nil || event == nil {
+			return err
+		}
+
+		event.resourceType = resourceType
+		event.resourceID = strconv.Itoa(int(resourceID))
+		if err := s.appendAuditEntry(ctx, q, event.entry(auditSuccess)); err != nil {
+			return fmt.Errorf("failed to write audit entry: %v", err)
+		}
+
+		return nil
+	})
+	if err == nil && event != nil {
+		event.recorded = true
+	}
+
+	return err
+}
+
+// auditRelated records an audit entry for a resource which the audited request
+// changed besides its own, such as the duplicate deleted by a merge
+func (s Server) auditRelated(ctx context.Context, q queries, resourceType string, resourceID int32) error {
+	event, _ := ctx.Value(auditContextKey{}).(*auditEvent)
+	if event == nil {
+		return nil
+	}
+
+	related := *event
+	related.resourceType = resourceType
+	related.resourceID = strconv.Itoa(int(resourceID))
+	if err := s.appendAuditEntry(ctx, q, related.entry(auditSuccess)); err != nil {
+		return fmt.Errorf("failed to write audit entry: %v", err)
+	}
+
+	return nil
+}
+
+func (s Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListAuditEntriesParams(r.URL.Query())
+	if err != nil {
+		log.WithContext(r.Context()).Debugf("Invalid audit query %q: %v", r.URL.RawQuery, err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	// Fetch one extra row to find out if there is a next page
+	pageSize := params.Limit
+	params.Limit++
+
+	entries, err := s.database.ListAuditEntries(ctx, params)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to retrieve audit entries from the database: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	payload := pagePayload{Data: entries}
+	if int32(len(entries)) > pageSize {
+		entries = entries[:pageSize]
+		payload.Data = entries
+
+		setNextPage(w, r, &payload, pageCursor{ID: entries[len(entries)-1].ID})
+	} else if entries == nil {
+		payload.Data = []db.AuditLog{}
+	}
+
+	jsonData, err := marshalJSON(r.Context(), payload)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise audit entries to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+// parseListAuditEntriesParams reads the filters and pagination query
+// parameters of the audit log, which is sorted newest first
+func parseListAuditEntriesParams(query url.Values) (db.ListAuditEntriesParams, error) {
+	params := db.ListAuditEntriesParams{
+		Subject:      query.Get("subject"),
+		Action:       query.Get("action"),
+		ResourceType: query.Get("resource_type"),
+		ResourceID:   query.Get("resource_id"),
+		Outcome:      query.Get("outcome"),
+		RequestID:    query.Get("request_id"),
+	}
+
+	limit, err := parsePageLimit(query)
+	if err != nil {
+		return db.ListAuditEntriesParams{}, err
+	}
+	params.Limit = limit
+
+	for name, t := range map[string]*sql.NullTime{"since": &params.Since, "until": &params.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return db.ListAuditEntriesParams{}, &requestError{detail: name + " must be an RFC 3339 timestamp", cause: err}
+			}
+			*t = sql.NullTime{Time: parsed, Valid: true}
+		}
+	}
+
+	if cursorString := query.Get("cursor"); cursorString != "" {
+		cursor, err := decodePageCursor(cursorString)
+		if err != nil {
+			return db.ListAuditEntriesParams{}, err
+		}
+		params.BeforeID = cursor.ID
+	}
+
+	return params, nil
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Audit(t *testing.T) {
+	Convey("Audit test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+		}
+
+		queries := &mockQueries{
+			Patients: []db.Patient{{ID: 123}},
+			Visits:   []db.Visit{{ID: 7, PatientID: 123, PhysicianID: 1}},
+		}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+
+		serveAs := func(method, url string, body []byte, subject string, roles ...Role) *httptest.ResponseRecorder {
+			token, err := s.issueToken(subject, roles...)
+			So(err, ShouldBeNil)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("X-Request-ID", "req-1")
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("the API should", func() {
+			Convey("audit reads", func() {
+				resp := serveAs(http.MethodGet, "http://example.com/api/v1/patients/123", nil, "bilbo", RolePhysician)
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(resp.Header().Get("X-Request-ID"), ShouldEqual, "req-1")
+
+				So(queries.AuditEntries, ShouldHaveLength, 1)
+				So(queries.AuditEntries[0].Hash, ShouldNotBeEmpty)
+				So(queries.AuditEntries[0], ShouldResemble, db.AuditLog{
+					ID:           1,
+					OccurredAt:   jwt.TimeFunc(),
+					Subject:      "bilbo",
+					Action:       "read",
+					ResourceType: "patient",
+					ResourceID:   "123",
+					Outcome:      "success",
+					RequestID:    "req-1",
+					Hash:         queries.AuditEntries[0].Hash,
+				})
+			})
+
+			Convey("audit mutations once, with the ID of the created resource", func() {
+				resp := serveAs(http.MethodPost, "http://example.com/api/v1/patients/123/visits", []byte(`{
+					"physician_id": 1, "visited_at": "2020-04-20T10:00:00Z", "location": "Rivendell"
+				}`), "bilbo", RoleReceptionist)
+				So(resp.Code, ShouldEqual, http.StatusCreated)
+
+				So(queries.AuditEntries, ShouldHaveLength, 1)
+				So(queries.AuditEntries[0].Action, ShouldEqual, "create")
+				So(queries.AuditEntries[0].ResourceType, ShouldEqual, "visit")
+				So(queries.AuditEntries[0].ResourceID, ShouldEqual, "2")
+				So(queries.AuditEntries[0].Outcome, ShouldEqual, "success")
+			})
+
+			Convey("fail mutations which can't be audited", func() {
+				queries.AuditErr = errors.New("disk full")
+				resp := serveAs(http.MethodPost, "http://example.com/api/v1/visits/7/cancel", nil, "bilbo", RoleReceptionist)
+				So(resp.Code, ShouldEqual, http.StatusInternalServerError)
+			})
+
+			Convey("audit custom actions", func() {
+				resp := serveAs(http.MethodPost, "http://example.com/api/v1/visits/7/cancel", nil, "bilbo", RoleReceptionist)
+				So(resp.Code, ShouldEqual, http.StatusOK)
+
+				So(queries.AuditEntries, ShouldHaveLength, 1)
+				So(queries.AuditEntries[0].Action, ShouldEqual, "cancel")
+				So(queries.AuditEntries[0].ResourceID, ShouldEqual, "7")
+			})
+
+			Convey("audit denied requests", func() {
+				resp := serveAs(http.MethodDelete, "http://example.com/api/v1/patients/123", nil, "bilbo", RoleReceptionist)
+				So(resp.Code, ShouldEqual, http.StatusForbidden)
+
+				So(queries.AuditEntries, ShouldHaveLength, 1)
+				So(queries.AuditEntries[0].Action, ShouldEqual, "delete")
+				So(queries.AuditEntries[0].Outcome, ShouldEqual, "denied")
+			})
+
+			Convey("audit requests without a valid token as anonymous", func() {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/patients/123", nil)
+				req.Header.Set("Authorization", "Bearer garbage")
+				s.getHTTPRouter().ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+				So(queries.AuditEntries, ShouldHaveLength, 1)
+				So(queries.AuditEntries[0].Subject, ShouldEqual, "anonymous")
+				So(queries.AuditEntries[0].ResourceID, ShouldEqual, "123")
+				So(queries.AuditEntries[0].Outcome, ShouldEqual, "denied")
+			})
+
+			Convey("audit requests with revoked tokens", func() {
+				token, err := s.issueToken("bilbo", RolePhysician)
+				So(err, ShouldBeNil)
+
+				for _, method := range []string{http.MethodPost, http.MethodGet} {
+					url := "http://example.com/api/v1/patients/123"
+					if method == http.MethodPost {
+						url = "http://example.com/auth/logout"
+					}
+					w := httptest.NewRecorder()
+					req := httptest.NewRequest(method, url, nil)
+					req.Header.Set("Authorization", "Bearer "+token)
+					s.getHTTPRouter().ServeHTTP(w, req)
+				}
+
+				So(queries.AuditEntries, ShouldHaveLength, 1)
+				So(queries.AuditEntries[0].Subject, ShouldEqual, "bilbo")
+				So(queries.AuditEntries[0].Outcome, ShouldEqual, "denied")
+			})
+
+			Convey("audit failed requests", func() {
+				resp := serveAs(http.MethodGet, "http://example.com/api/v1/visits/8", nil, "bilbo", RolePhysician)
+				So(resp.Code, ShouldEqual, http.StatusNotFound)
+
+				So(queries.AuditEntries, ShouldHaveLength, 1)
+				So(queries.AuditEntries[0].ResourceID, ShouldEqual, "8")
+				So(queries.AuditEntries[0].Outcome, ShouldEqual, "failure")
+			})
+
+			Convey("generate missing request IDs", func() {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/patients/123", nil)
+				req.Header.Set("Authorization", "Bearer "+dummyJWTToken)
+				s.getHTTPRouter().ServeHTTP(w, req)
+
+				So(w.Header().Get("X-Request-ID"), ShouldNotBeEmpty)
+				So(queries.AuditEntries[0].RequestID, ShouldEqual, w.Header().Get("X-Request-ID"))
+			})
+		})
+
+		Convey("the audit log should", func() {
+			for _, subject := range []string{"bilbo", "frodo", "bilbo"} {
+				serveAs(http.MethodGet, "http://example.com/api/v1/patients/123", nil, subject, RolePhysician)
+			}
+
+			Convey("only be available to auditors", func() {
+				resp := serveAs(http.MethodGet, "http://example.com/api/v1/audit", nil, "gandalf", RoleAdmin)
+				So(resp.Code, ShouldEqual, http.StatusForbidden)
+			})
+
+			Convey("list the newest entries first", func() {
+				resp := serveAs(http.MethodGet, "http://example.com/api/v1/audit?limit=2", nil, "elrond", RoleAuditor)
+				So(resp.Code, ShouldEqual, http.StatusOK)
+
+				type auditPage struct {
+					Data       []db.AuditLog `json:"data"`
+					NextCursor string        `json:"next_cursor"`
+				}
+				var page auditPage
+				So(json.NewDecoder(resp.Body).Decode(&page), ShouldBeNil)
+				So(page.Data, ShouldHaveLength, 2)
+				So(page.Data[0].ID, ShouldEqual, 3)
+				So(page.Data[1].ID, ShouldEqual, 2)
+
+				// Reading the audit log is audited too, but the new entries
+				// don't show up on the next pages
+				resp = serveAs(http.MethodGet, "http://example.com/api/v1/audit?limit=2&cursor="+page.NextCursor, nil, "elrond", RoleAuditor)
+				var nextPage auditPage
+				So(json.NewDecoder(resp.Body).Decode(&nextPage), ShouldBeNil)
+				So(nextPage.Data, ShouldHaveLength, 1)
+				So(nextPage.Data[0].ID, ShouldEqual, 1)
+				So(nextPage.NextCursor, ShouldBeEmpty)
+				So(queries.AuditEntries[3].ResourceType, ShouldEqual, "audit")
+			})
+
+			Convey("filter the entries", func() {
+				resp := serveAs(http.MethodGet, "http://example.com/api/v1/audit?subject=frodo", nil, "elrond", RoleAuditor)
+				So(resp.Code, ShouldEqual, http.StatusOK)
+
+				var payload struct {
+					Data []db.AuditLog `json:"data"`
+				}
+				So(json.NewDecoder(resp.Body).Decode(&payload), ShouldBeNil)
+				So(payload.Data, ShouldHaveLength, 1)
+				So(payload.Data[0].Subject, ShouldEqual, "frodo")
+			})
+
+			Convey("reject invalid filters", func() {
+				resp := serveAs(http.MethodGet, "http://example.com/api/v1/audit?since=yesterday", nil, "elrond", RoleAuditor)
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+	})
+}
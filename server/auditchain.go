@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// auditVerifyBatchSize is the number of audit entries fetched at a time
+	// while walking the hash chain
+	auditVerifyBatchSize = 1000
+	// auditCheckpointAudience sets audit checkpoints apart from other tokens
+	auditCheckpointAudience = "ferrum-audit-checkpoint"
+)
+
+// errAuditCheckpointsDisabled is returned when a checkpoint is given to a
+// server which doesn't have any checkpoint keys
+var errAuditCheckpointsDisabled = errors.New("audit checkpoints are disabled, since there are no checkpoint keys")
+
+// loadCheckpointKeyring reads the keys which sign the audit checkpoints. They
+// can't be the JWT keys: the default HS256 secret is public, so anyone could
+// forge a checkpoint which vouches for a rewritten chain, and with OIDC the
+// same secret would sign access tokens. Without any keys, checkpoints are
+// neither issued nor accepted.
+func loadCheckpointKeyring(c config.Config) (*keyring, error) {
+	if len(c.AuditCheckpointKeyFiles) == 0 {
+		return nil, nil
+	}
+
+	k, err := loadPrivateKeyring(c.AuditCheckpointKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Signing audit checkpoints with key %q", k.signingKeyID)
+
+	return k, nil
+}
+
+// auditChainContents is the canonical form of an audit entry which gets hashed.
+// The fields are serialised in the order they are declared in.
+type auditChainContents struct {
+	PrevHash     string `json:"prev_hash"`
+	OccurredAt   string `json:"occurred_at"`
+	Subject      string `json:"subject"`
+	Action       string `json:"action"`
+	ResourceType string `json:"resource_type"`
+	ResourceID   string `json:"resource_id"`
+	Outcome      string `json:"outcome"`
+	RequestID    string `json:"request_id"`
+}
+
+// auditHash chains an audit entry to the previous one by hashing its contents
+// together with the hash of the previous entry
+func auditHash(entry db.AddAuditEntryParams) string {
+	// Marshalling a struct of strings can't fail
+	jsonData, _ := json.Marshal(auditChainContents{
+		PrevHash:     entry.PrevHash,
+		OccurredAt:   entry.OccurredAt.UTC().Format(time.RFC3339Nano),
+		Subject:      entry.Subject,
+		Action:       entry.Action,
+		ResourceType: entry.ResourceType,
+		ResourceID:   entry.ResourceID,
+		Outcome:      entry.Outcome,
+		RequestID:    entry.RequestID,
+	})
+
+	sum := sha256.Sum256(jsonData)
+	return hex.EncodeToString(sum[:])
+}
+
+// storedAuditHash recomputes the hash of an entry read from the audit log
+func storedAuditHash(entry db.AuditLog) string {
+	return auditHash(db.AddAuditEntryParams{
+		OccurredAt:   entry.OccurredAt,
+		Subject:      entry.Subject,
+		Action:       entry.Action,
+		ResourceType: entry.ResourceType,
+		ResourceID:   entry.ResourceID,
+		Outcome:      entry.Outcome,
+		RequestID:    entry.RequestID,
+		PrevHash:     entry.PrevHash,
+	})
+}
+
+// appendAuditEntry adds an entry to the end of the audit hash chain. It must
+// run in a transaction: the lock is held until the transaction ends, so the
+// entries get chained in ID order, even when there are multiple instances.
+func (s Server) appendAuditEntry(ctx context.Context, q queries, entry db.AddAuditEntryParams) error {
+	if err := q.LockAuditLog(ctx); err != nil {
+		return fmt.Errorf("failed to lock audit log: %v", err)
+	}
+
+	last, err := q.GetLastAuditEntry(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to retrieve the last audit entry: %v", err)
+	}
+
+	// The database stores timestamps with microsecond precision, so truncate
+	// it here to make sure the hash can be verified later
+	entry.OccurredAt = s.currentTimeFn().UTC().Truncate(time.Microsecond)
+	// The first entry has an empty previous hash
+	entry.PrevHash = last.Hash
+	entry.Hash = auditHash(entry)
+
+	return q.AddAuditEntry(ctx, entry)
+}
+
+// AuditVerification is the result of walking the audit hash chain
+type AuditVerification struct {
+	Valid bool `json:"valid"`
+	// Entries is the number of entries verified so far, including the ones
+	// covered by the checkpoint which the verification started from
+	Entries  int64  `json:"entries"`
+	LastID   int64  `json:"last_id"`
+	LastHash string `json:"last_hash"`
+	// BrokenLink is the first entry which doesn't fit in the chain
+	BrokenLink *AuditBrokenLink `json:"broken_link,omitempty"`
+	// Checkpoint is a signed token which records the end of a valid chain. It
+	// should be kept outside the database, so it can be used to detect entries
+	// which have been removed from the end of the chain. It's only issued when
+	// there are checkpoint keys.
+	Checkpoint string `json:"checkpoint,omitempty"`
+}
+
+// AuditBrokenLink identifies an audit entry which has been tampered with
+type AuditBrokenLink struct {
+	ID     int64  `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// auditCheckpointClaims are the claims of a signed audit checkpoint
+type auditCheckpointClaims struct {
+	LastID   int64  `json:"last_id"`
+	LastHash string `json:"last_hash"`
+	Entries  int64  `json:"entries"`
+	jwt.StandardClaims
+}
+
+// parseAuditCheckpoint validates the signature of a checkpoint returned by a
+// previous verification
+func (s Server) parseAuditCheckpoint(checkpoint string) (auditCheckpointClaims, error) {
+	if s.checkpointKeys == nil {
+		return auditCheckpointClaims{}, errAuditCheckpointsDisabled
+	}
+
+	var claims auditCheckpointClaims
+	if _, err := jwt.ParseWithClaims(checkpoint, &claims, s.checkpointKeys.validationKey); err != nil {
+		return auditCheckpointClaims{}, fmt.Errorf("failed to validate checkpoint: %v", err)
+	}
+	if !claims.VerifyAudience(auditCheckpointAudience, true) {
+		return auditCheckpointClaims{}, errors.New("token is not an audit checkpoint")
+	}
+
+	return claims, nil
+}
+
+// verifyAuditChain walks the audit hash chain, starting after the given
+// checkpoint, and stops at the first broken link. The zero checkpoint starts
+// from the first entry.
+func (s Server) verifyAuditChain(ctx context.Context, from auditCheckpointClaims) (AuditVerification, error) {
+	result := AuditVerification{
+		Entries:  from.Entries,
+		LastID:   from.LastID,
+		LastHash: from.LastHash,
+	}
+
+	if from.LastID != 0 {
+		entry, err := s.database.GetAuditEntry(ctx, from.LastID)
+		switch {
+		case err == sql.ErrNoRows:
+			result.BrokenLink = &AuditBrokenLink{ID: from.LastID, Reason: "the checkpoint entry is missing"}
+			return result, nil
+		case err != nil:
+			return AuditVerification{}, fmt.Errorf("failed to retrieve audit entry %d: %v", from.LastID, err)
+		case entry.Hash != from.LastHash || storedAuditHash(entry) != from.LastHash:
+			result.BrokenLink = &AuditBrokenLink{ID: from.LastID, Reason: "the checkpoint entry has changed"}
+			return result, nil
+		}
+	}
+
+	for {
+		entries, err := s.database.ListAuditChain(ctx, db.ListAuditChainParams{
+			ID:    result.LastID,
+			Limit: auditVerifyBatchSize,
+		})
+		if err != nil {
+			return AuditVerification{}, fmt.Errorf("failed to retrieve audit entries after %d: %v", result.LastID, err)
+		}
+
+		for _, entry := range entries {
+			var reason string
+			switch {
+			case entry.PrevHash != result.LastHash:
+				reason = "the previous hash doesn't match the previous entry"
+			case storedAuditHash(entry) != entry.Hash:
+				reason = "the hash doesn't match the contents of the entry"
+			}
+			if reason != "" {
+				result.BrokenLink = &AuditBrokenLink{ID: entry.ID, Reason: reason}
+				return result, nil
+			}
+
+			result.Entries++
+			result.LastID = entry.ID
+			result.LastHash = entry.Hash
+		}
+
+		if len(entries) < auditVerifyBatchSize {
+			break
+		}
+	}
+
+	result.Valid = true
+	if s.checkpointKeys == nil {
+		return result, nil
+	}
+
+	checkpoint, err := s.checkpointKeys.sign(auditCheckpointClaims{
+		LastID:   result.LastID,
+		LastHash: result.LastHash,
+		Entries:  result.Entries,
+		StandardClaims: jwt.StandardClaims{
+			Audience: auditCheckpointAudience,
+			IssuedAt: s.currentTimeFn().Unix(),
+		},
+	})
+	if err != nil {
+		return AuditVerification{}, fmt.Errorf("failed to sign checkpoint: %v", err)
+	}
+	result.Checkpoint = checkpoint
+
+	return result, nil
+}
+
+// VerifyAuditLog walks the audit hash chain and reports the first broken link.
+// Given a checkpoint from a previous verification, it only walks the entries
+// added since, after checking that the checkpoint entry is still intact.
+func (s Server) VerifyAuditLog(ctx context.Context, checkpoint string) (AuditVerification, error) {
+	var from auditCheckpointClaims
+	if checkpoint != "" {
+		var err error
+		if from, err = s.parseAuditCheckpoint(checkpoint); err != nil {
+			return AuditVerification{}, err
+		}
+	}
+
+	return s.verifyAuditChain(ctx, from)
+}
+
+func (s Server) auditVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	var from auditCheckpointClaims
+	if checkpoint := r.URL.Query().Get("checkpoint"); checkpoint != "" {
+		var err error
+		if from, err = s.parseAuditCheckpoint(checkpoint); err != nil {
+			log.WithContext(r.Context()).Debugf("Invalid audit checkpoint: %v", err)
+			if err == errAuditCheckpointsDisabled {
+				writeProblem(w, r, problemBadRequest, "Audit checkpoints aren't enabled on this server")
+			} else {
+				writeProblem(w, r, problemBadRequest, "The checkpoint must be one returned by a previous verification")
+			}
+			return
+		}
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	result, err := s.verifyAuditChain(ctx, from)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to verify the audit log: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+	if !result.Valid {
+		log.WithContext(r.Context()).Errorf("The audit log hash chain is broken at entry %d: %s", result.BrokenLink.ID, result.BrokenLink.Reason)
+	}
+
+	jsonData, err := marshalJSON(r.Context(), result)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise audit verification to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
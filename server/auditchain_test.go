@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_AuditChain(t *testing.T) {
+	Convey("Audit hash chain test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+		}
+
+		dir, err := ioutil.TempDir("", "ferrum-checkpoint-keys")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		checkpointKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		checkpointDER, err := x509.MarshalECPrivateKey(checkpointKey)
+		So(err, ShouldBeNil)
+		c.AuditCheckpointKeyFiles = []string{writePEM(dir, "checkpoint.pem", "EC PRIVATE KEY", checkpointDER)}
+		checkpointKeys, err := loadCheckpointKeyring(c)
+		So(err, ShouldBeNil)
+
+		queries := &mockQueries{
+			Patients: []db.Patient{{ID: 123}},
+		}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+		s.checkpointKeys = checkpointKeys
+
+		serveAs := func(url, subject string, roles ...Role) *httptest.ResponseRecorder {
+			token, err := s.issueToken(subject, roles...)
+			So(err, ShouldBeNil)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, url, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w
+		}
+
+		for _, subject := range []string{"bilbo", "frodo", "sam"} {
+			serveAs("http://example.com/api/v1/patients/123", subject, RolePhysician)
+		}
+		ctx := context.Background()
+
+		Convey("chain each entry to the previous one", func() {
+			So(queries.AuditEntries, ShouldHaveLength, 3)
+			So(queries.AuditEntries[0].PrevHash, ShouldBeEmpty)
+			So(queries.AuditEntries[1].PrevHash, ShouldEqual, queries.AuditEntries[0].Hash)
+			So(queries.AuditEntries[2].PrevHash, ShouldEqual, queries.AuditEntries[1].Hash)
+			So(queries.AuditEntries[2].Hash, ShouldEqual, storedAuditHash(queries.AuditEntries[2]))
+		})
+
+		Convey("verify an intact chain", func() {
+			result, err := s.VerifyAuditLog(ctx, "")
+			So(err, ShouldBeNil)
+			So(result.Valid, ShouldBeTrue)
+			So(result.Entries, ShouldEqual, 3)
+			So(result.LastID, ShouldEqual, 3)
+			So(result.BrokenLink, ShouldBeNil)
+			So(result.Checkpoint, ShouldNotBeEmpty)
+		})
+
+		Convey("verify an empty chain", func() {
+			queries.AuditEntries = nil
+			result, err := s.VerifyAuditLog(ctx, "")
+			So(err, ShouldBeNil)
+			So(result.Valid, ShouldBeTrue)
+			So(result.Entries, ShouldEqual, 0)
+		})
+
+		Convey("report edited entries", func() {
+			queries.AuditEntries[1].Subject = "gollum"
+			result, err := s.VerifyAuditLog(ctx, "")
+			So(err, ShouldBeNil)
+			So(result.Valid, ShouldBeFalse)
+			So(result.Entries, ShouldEqual, 1)
+			So(result.BrokenLink, ShouldResemble, &AuditBrokenLink{
+				ID: 2, Reason: "the hash doesn't match the contents of the entry",
+			})
+			So(result.Checkpoint, ShouldBeEmpty)
+		})
+
+		Convey("report removed entries", func() {
+			queries.AuditEntries = append(queries.AuditEntries[:1], queries.AuditEntries[2:]...)
+			result, err := s.VerifyAuditLog(ctx, "")
+			So(err, ShouldBeNil)
+			So(result.Valid, ShouldBeFalse)
+			So(result.BrokenLink.ID, ShouldEqual, 3)
+			So(result.BrokenLink.Reason, ShouldEqual, "the previous hash doesn't match the previous entry")
+		})
+
+		Convey("resume from a checkpoint", func() {
+			first, err := s.VerifyAuditLog(ctx, "")
+			So(err, ShouldBeNil)
+
+			serveAs("http://example.com/api/v1/patients/123", "merry", RolePhysician)
+			result, err := s.VerifyAuditLog(ctx, first.Checkpoint)
+			So(err, ShouldBeNil)
+			So(result.Valid, ShouldBeTrue)
+			So(result.Entries, ShouldEqual, 4)
+			So(result.LastID, ShouldEqual, 4)
+
+			Convey("and report entries removed from the end of the chain", func() {
+				queries.AuditEntries = queries.AuditEntries[:2]
+				result, err := s.VerifyAuditLog(ctx, first.Checkpoint)
+				So(err, ShouldBeNil)
+				So(result.Valid, ShouldBeFalse)
+				So(result.BrokenLink, ShouldResemble, &AuditBrokenLink{
+					ID: 3, Reason: "the checkpoint entry is missing",
+				})
+			})
+
+			Convey("and report a changed checkpoint entry", func() {
+				queries.AuditEntries[2].Outcome = "denied"
+				result, err := s.VerifyAuditLog(ctx, first.Checkpoint)
+				So(err, ShouldBeNil)
+				So(result.Valid, ShouldBeFalse)
+				So(result.BrokenLink.ID, ShouldEqual, 3)
+			})
+		})
+
+		Convey("reject tokens which aren't checkpoints", func() {
+			token, err := s.issueToken("elrond", RoleAuditor)
+			So(err, ShouldBeNil)
+
+			_, err = s.VerifyAuditLog(ctx, token)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("reject checkpoints signed with the JWT keys", func() {
+			forged, err := s.keys.sign(auditCheckpointClaims{
+				LastID:         3,
+				LastHash:       queries.AuditEntries[2].Hash,
+				Entries:        3,
+				StandardClaims: jwt.StandardClaims{Audience: auditCheckpointAudience},
+			})
+			So(err, ShouldBeNil)
+
+			_, err = s.VerifyAuditLog(ctx, forged)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("neither issue nor accept checkpoints without checkpoint keys", func() {
+			first, err := s.VerifyAuditLog(ctx, "")
+			So(err, ShouldBeNil)
+
+			s.checkpointKeys = nil
+			result, err := s.VerifyAuditLog(ctx, "")
+			So(err, ShouldBeNil)
+			So(result.Valid, ShouldBeTrue)
+			So(result.Checkpoint, ShouldBeEmpty)
+
+			_, err = s.VerifyAuditLog(ctx, first.Checkpoint)
+			So(err, ShouldEqual, errAuditCheckpointsDisabled)
+
+			resp := serveAs("http://example.com/api/v1/audit/verify?checkpoint="+url.QueryEscape(first.Checkpoint), "elrond", RoleAuditor)
+			So(resp.Code, ShouldEqual, http.StatusBadRequest)
+			So(resp.Body.String(), ShouldContainSubstring, "aren't enabled")
+		})
+
+		Convey("the verify endpoint should", func() {
+			Convey("only be available to auditors", func() {
+				resp := serveAs("http://example.com/api/v1/audit/verify", "gandalf", RoleAdmin)
+				So(resp.Code, ShouldEqual, http.StatusForbidden)
+			})
+
+			Convey("report the verification result", func() {
+				resp := serveAs("http://example.com/api/v1/audit/verify", "elrond", RoleAuditor)
+				So(resp.Code, ShouldEqual, http.StatusOK)
+
+				var result AuditVerification
+				So(json.NewDecoder(resp.Body).Decode(&result), ShouldBeNil)
+				So(result.Valid, ShouldBeTrue)
+				So(result.Entries, ShouldEqual, 3)
+
+				// Verifying the audit log is audited too
+				So(queries.AuditEntries[3].Action, ShouldEqual, "verify")
+
+				resp = serveAs("http://example.com/api/v1/audit/verify?checkpoint="+url.QueryEscape(result.Checkpoint), "elrond", RoleAuditor)
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(json.NewDecoder(resp.Body).Decode(&result), ShouldBeNil)
+				So(result.Valid, ShouldBeTrue)
+				So(result.Entries, ShouldEqual, 4)
+			})
+
+			Convey("reject invalid checkpoints", func() {
+				resp := serveAs("http://example.com/api/v1/audit/verify?checkpoint=foobar", "elrond", RoleAuditor)
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+	})
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+// ErrUserExists is returned by CreateUser when the username is already taken
+var ErrUserExists = errors.New("user already exists")
+
+type loginPayload struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type refreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+var (
+	dummyPasswordHashOnce sync.Once
+	dummyPasswordHash     []byte
+)
+
+// compareDummyPassword burns roughly the same amount of time as checking a real
+// password, so the login endpoint doesn't reveal which usernames exist
+func compareDummyPassword(password string) {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	})
+
+	_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+}
+
+// randomToken returns n random bytes encoded as base64url
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashRefreshToken is what gets stored in the database instead of the refresh
+// token itself. Refresh tokens are random, so they don't need a slow hash.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueToken signs a JWT which identifies the given user and grants it the
+// given roles. Its `jti` claim can be used to revoke it.
+func (s Server) issueToken(username string, roles ...Role) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token ID: %v", err)
+	}
+
+	now := s.currentTimeFn()
+	return s.keys.sign(jwt.MapClaims{
+		"sub":   username,
+		"roles": roles,
+		"name":  s.config.HTTPJWTVClaimName,
+		"jti":   jti,
+		"iat":   now.Unix(),
+		"exp":   now.Add(s.config.HTTPJWTExpiration).Unix(),
+	})
+}
+
+// issueTokens creates a new access token and a new refresh token for the user
+func (s Server) issueTokens(ctx context.Context, user db.User) (tokenPayload, error) {
+	signedToken, err := s.issueToken(user.Username, Role(user.Role))
+	if err != nil {
+		return tokenPayload{}, fmt.Errorf("failed to sign the JWT token: %v", err)
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return tokenPayload{}, fmt.Errorf("failed to generate refresh token: %v", err)
+	}
+
+	_, err = s.database.AddRefreshToken(ctx, db.AddRefreshTokenParams{
+		UserID:    user.ID,
+		TokenHash: hashRefreshToken(refreshToken),
+		ExpiresAt: s.currentTimeFn().Add(s.config.HTTPJWTRefreshExpiration),
+	})
+	if err != nil {
+		return tokenPayload{}, fmt.Errorf("failed to store refresh token: %v", err)
+	}
+
+	return tokenPayload{Token: signedToken, RefreshToken: refreshToken}, nil
+}
+
+func (s Server) writeTokens(ctx context.Context, w http.ResponseWriter, r *http.Request, user db.User) {
+	tokens, err := s.issueTokens(ctx, user)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to issue tokens for user %q: %v", user.Username, err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	jsonData, err := marshalJSON(r.Context(), tokens)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise JWT token payload to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+func (s Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	var credentials loginPayload
+	if err := json.Unmarshal(body, &credentials); err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to decode login data: %v", err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	user, err := s.database.GetUserByUsername(ctx, credentials.Username)
+	if err == sql.ErrNoRows {
+		compareDummyPassword(credentials.Password)
+		log.WithContext(r.Context()).Infof("Login attempt for unknown user %q", credentials.Username)
+		writeProblem(w, r, problemUnauthorized, "")
+		return
+	} else if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to retrieve user %q from the database: %v", credentials.Username, err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(credentials.Password)); err != nil {
+		log.WithContext(r.Context()).Infof("Failed login attempt for user %q", credentials.Username)
+		writeProblem(w, r, problemUnauthorized, "")
+		return
+	}
+
+	s.writeTokens(ctx, w, r, user)
+}
+
+// refreshHandler exchanges a refresh token for a new access token. Refresh
+// tokens are rotated, so each one can only be used once.
+func (s Server) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	var payload refreshPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to decode refresh token data: %v", err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+	if payload.RefreshToken == "" {
+		log.WithContext(r.Context()).Debug("Rejecting refresh request without a refresh token")
+		writeRequestProblem(w, r, invalidField("refresh_token", "is required"))
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	// Revoking the token first guarantees that concurrent requests can't use
+	// it more than once
+	refreshToken, err := s.database.RevokeRefreshToken(ctx, hashRefreshToken(payload.RefreshToken))
+	if err == sql.ErrNoRows {
+		log.WithContext(r.Context()).Info("Refresh attempt with an unknown, expired or revoked token")
+		writeProblem(w, r, problemUnauthorized, "")
+		return
+	} else if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to revoke refresh token: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	user, err := s.database.GetUser(ctx, refreshToken.UserID)
+	if err == sql.ErrNoRows {
+		log.WithContext(r.Context()).Infof("Refresh attempt for deleted user %d", refreshToken.UserID)
+		writeProblem(w, r, problemUnauthorized, "")
+		return
+	} else if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to retrieve user %d from the database: %v", refreshToken.UserID, err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	s.writeTokens(ctx, w, r, user)
+}
+
+// logoutHandler revokes the access token of the request and, optionally, the
+// refresh token in the request body
+func (s Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value("user").(*jwt.Token)
+	if !ok {
+		writeProblem(w, r, problemUnauthorized, "")
+		return
+	}
+
+	body, ok := s.readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	var payload refreshPayload
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			log.WithContext(r.Context()).Warnf("Failed to decode logout data: %v", err)
+			writeRequestProblem(w, r, err)
+			return
+		}
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	if err := s.revokeToken(ctx, token); err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to revoke access token: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	if payload.RefreshToken != "" {
+		_, err := s.database.RevokeRefreshToken(ctx, hashRefreshToken(payload.RefreshToken))
+		if err != nil && err != sql.ErrNoRows {
+			log.WithContext(r.Context()).Warnf("Failed to revoke refresh token: %v", err)
+			writeProblem(w, r, problemInternal, "")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUser adds a user account with the given role, which can log in via
+// /auth/login
+func (s Server) CreateUser(ctx context.Context, username, password string, role Role) error {
+	if username == "" {
+		return errors.New("the username can't be empty")
+	}
+	if _, err := ParseRole(string(role)); err != nil {
+		return err
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("the password must have at least %d characters", minPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	_, err = s.database.AddUser(ctx, db.AddUserParams{
+		Username:     username,
+		PasswordHash: string(hash),
+		Role:         string(role),
+	})
+	if db.IsConstraintViolation(err, db.UniqueViolation, "unique_username") {
+		return ErrUserExists
+	} else if err != nil {
+		return fmt.Errorf("failed to insert user into database: %v", err)
+	}
+
+	return nil
+}
+
+// IssueToken signs a new access token for an existing user, for scripts which
+// can't log in with a password
+func (s Server) IssueToken(ctx context.Context, username string) (string, error) {
+	if s.oidc != nil {
+		return "", errors.New("tokens are issued by the OpenID Connect provider")
+	}
+
+	user, err := s.database.GetUserByUsername(ctx, username)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("user %q doesn't exist", username)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to retrieve user %q: %v", username, err)
+	}
+
+	return s.issueToken(user.Username, Role(user.Role))
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_Auth(t *testing.T) {
+	Convey("Auth test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:   102400,
+			HTTPJWTVClaimName: "test",
+			HTTPJWTSigningKey: "deadbeef",
+			HTTPJWTExpiration: 1 * time.Second,
+		}
+
+		queries := &mockQueries{}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+
+		w := httptest.NewRecorder()
+
+		login := func(username, password string) *http.Response {
+			body, err := json.Marshal(loginPayload{Username: username, Password: password})
+			So(err, ShouldBeNil)
+
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/auth/login", bytes.NewReader(body))
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w.Result()
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte("speakfriend"), bcrypt.MinCost)
+		So(err, ShouldBeNil)
+		queries.Users = []db.User{{ID: 1, Username: "gandalf", PasswordHash: string(hash), Role: "physician"}}
+
+		Convey("login should", func() {
+			Convey("issue a token for the authenticated user", func() {
+				resp := login("gandalf", "speakfriend")
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+				var payload tokenPayload
+				So(json.NewDecoder(resp.Body).Decode(&payload), ShouldBeNil)
+
+				token, err := jwt.Parse(payload.Token, func(*jwt.Token) (interface{}, error) {
+					return []byte(c.HTTPJWTSigningKey), nil
+				})
+				So(err, ShouldBeNil)
+				So(principalFromToken(token), ShouldResemble, principal{Subject: "gandalf", Roles: []Role{RolePhysician}})
+			})
+
+			Convey("reject wrong passwords", func() {
+				So(login("gandalf", "mellon").StatusCode, ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("reject unknown users", func() {
+				So(login("saruman", "speakfriend").StatusCode, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+
+		post := func(url, token string, payload interface{}) *httptest.ResponseRecorder {
+			body, err := json.Marshal(payload)
+			So(err, ShouldBeNil)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w
+		}
+
+		getPatients := func(token string) int {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/patients", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w.Result().StatusCode
+		}
+
+		Convey("refresh should", func() {
+			var tokens tokenPayload
+			So(json.NewDecoder(login("gandalf", "speakfriend").Body).Decode(&tokens), ShouldBeNil)
+			So(tokens.RefreshToken, ShouldNotBeEmpty)
+
+			Convey("only store the refresh token hash", func() {
+				So(queries.RefreshTokens, ShouldHaveLength, 1)
+				So(queries.RefreshTokens[0].TokenHash, ShouldEqual, hashRefreshToken(tokens.RefreshToken))
+				So(queries.RefreshTokens[0].UserID, ShouldEqual, 1)
+			})
+
+			Convey("rotate the refresh token", func() {
+				resp := post("http://example.com/auth/refresh", "", refreshPayload{RefreshToken: tokens.RefreshToken})
+				So(resp.Code, ShouldEqual, http.StatusOK)
+
+				var refreshed tokenPayload
+				So(json.NewDecoder(resp.Body).Decode(&refreshed), ShouldBeNil)
+				So(refreshed.Token, ShouldNotBeEmpty)
+				So(refreshed.RefreshToken, ShouldNotEqual, tokens.RefreshToken)
+				So(getPatients(refreshed.Token), ShouldEqual, http.StatusOK)
+
+				Convey("which can't be used again", func() {
+					resp := post("http://example.com/auth/refresh", "", refreshPayload{RefreshToken: tokens.RefreshToken})
+					So(resp.Code, ShouldEqual, http.StatusUnauthorized)
+				})
+			})
+
+			Convey("reject unknown refresh tokens", func() {
+				resp := post("http://example.com/auth/refresh", "", refreshPayload{RefreshToken: "bogus"})
+				So(resp.Code, ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("reject requests without a refresh token", func() {
+				resp := post("http://example.com/auth/refresh", "", refreshPayload{})
+				So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+			})
+		})
+
+		Convey("logout should", func() {
+			var tokens tokenPayload
+			So(json.NewDecoder(login("gandalf", "speakfriend").Body).Decode(&tokens), ShouldBeNil)
+			So(getPatients(tokens.Token), ShouldEqual, http.StatusOK)
+
+			resp := post("http://example.com/auth/logout", tokens.Token, refreshPayload{RefreshToken: tokens.RefreshToken})
+			So(resp.Code, ShouldEqual, http.StatusNoContent)
+
+			Convey("revoke the access token immediately", func() {
+				So(queries.RevokedTokens, ShouldHaveLength, 1)
+				So(getPatients(tokens.Token), ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("revoke the refresh token", func() {
+				resp := post("http://example.com/auth/refresh", "", refreshPayload{RefreshToken: tokens.RefreshToken})
+				So(resp.Code, ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("require a valid access token", func() {
+				So(post("http://example.com/auth/logout", "", nil).Code, ShouldEqual, http.StatusUnauthorized)
+				So(post("http://example.com/auth/logout", tokens.Token, nil).Code, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+
+		Convey("revoked tokens should be synced from the database", func() {
+			var tokens tokenPayload
+			So(json.NewDecoder(login("gandalf", "speakfriend").Body).Decode(&tokens), ShouldBeNil)
+
+			token, err := jwt.Parse(tokens.Token, s.keys.validationKey)
+			So(err, ShouldBeNil)
+			jti := token.Claims.(jwt.MapClaims)["jti"].(string)
+
+			// Revoked by another instance
+			queries.RevokedTokens = []db.RevokedToken{
+				{Jti: jti, ExpiresAt: jwt.TimeFunc().Add(time.Hour)},
+				{Jti: "expired", ExpiresAt: jwt.TimeFunc().Add(-time.Hour)},
+			}
+			So(getPatients(tokens.Token), ShouldEqual, http.StatusOK)
+
+			s.syncRevokedTokens(context.Background())
+			So(getPatients(tokens.Token), ShouldEqual, http.StatusUnauthorized)
+			So(s.revokedTokens.contains("expired"), ShouldBeFalse)
+		})
+
+		Convey("the token generator should only be available in dev mode", func() {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/generate-token", nil)
+			s.getHTTPRouter().ServeHTTP(w, req)
+			So(w.Result().StatusCode, ShouldEqual, http.StatusNotFound)
+
+			s.config.DevMode = true
+			w = httptest.NewRecorder()
+			s.getHTTPRouter().ServeHTTP(w, req)
+			So(w.Result().StatusCode, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("CreateUser should", func() {
+			Convey("store a password hash", func() {
+				So(s.CreateUser(context.Background(), "frodo", "precious!", RoleReceptionist), ShouldBeNil)
+				So(queries.Users[1].Username, ShouldEqual, "frodo")
+				So(queries.Users[1].Role, ShouldEqual, "receptionist")
+				So(bcrypt.CompareHashAndPassword([]byte(queries.Users[1].PasswordHash), []byte("precious!")), ShouldBeNil)
+			})
+
+			Convey("reject short passwords", func() {
+				So(s.CreateUser(context.Background(), "frodo", "ring", RoleReceptionist), ShouldNotBeNil)
+			})
+
+			Convey("reject unknown roles", func() {
+				So(s.CreateUser(context.Background(), "frodo", "precious!", Role("hobbit")), ShouldNotBeNil)
+			})
+
+			Convey("report duplicate usernames", func() {
+				queries.Err = &pq.Error{Code: db.UniqueViolation, Constraint: "unique_username"}
+				So(s.CreateUser(context.Background(), "gandalf", "speakfriend", RoleAdmin), ShouldEqual, ErrUserExists)
+			})
+		})
+
+		Convey("IssueToken should", func() {
+			Convey("sign a token for an existing user", func() {
+				signedToken, err := s.IssueToken(context.Background(), "gandalf")
+				So(err, ShouldBeNil)
+
+				token, err := jwt.Parse(signedToken, s.keys.validationKey)
+				So(err, ShouldBeNil)
+				So(principalFromToken(token), ShouldResemble, principal{Subject: "gandalf", Roles: []Role{RolePhysician}})
+			})
+
+			Convey("reject unknown users", func() {
+				_, err := s.IssueToken(context.Background(), "saruman")
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDuplicateCandidates is the number of candidates which are scored for each
+// patient
+const maxDuplicateCandidates = 20
+
+// duplicateSignals are the similarities between two patients, between 0 and 1
+type duplicateSignals struct {
+	Name    float64 `json:"name"`
+	Email   float64 `json:"email"`
+	Phone   float64 `json:"phone"`
+	Address float64 `json:"address"`
+}
+
+// duplicateWeights add up to 1. Names carry the most weight, but two people
+// can share a name, so matching contact data is needed for high scores.
+var duplicateWeights = duplicateSignals{Name: 0.4, Email: 0.3, Phone: 0.2, Address: 0.1}
+
+// duplicateCandidate is a patient which might be the same person as the one
+// whose duplicates were requested
+type duplicateCandidate struct {
+	Patient db.Patient       `json:"patient"`
+	Score   float64          `json:"score"`
+	Signals duplicateSignals `json:"signals"`
+}
+
+// mergePayload is the body of the requests which merge a duplicate into the
+// patient in the URL
+type mergePayload struct {
+	DuplicateID int32 `json:"duplicate_id" validate:"required"`
+}
+
+// mergeResult is the response to a merge
+type mergeResult struct {
+	Patient         db.Patient `json:"patient"`
+	MergedPatientID int32      `json:"merged_patient_id"`
+	MovedVisits     int64      `json:"moved_visits"`
+}
+
+// scoreDuplicate compares a candidate with a patient. The name similarity is
+// computed by the database and the contact data is compared here, since it
+// can be encrypted.
+func scoreDuplicate(patient db.Patient, candidate db.ListDuplicateCandidatesRow) duplicateCandidate {
+	matches := func(a, b string, normalise func(string) string) float64 {
+		if a != "" && normalise(a) == normalise(b) {
+			return 1
+		}
+		return 0
+	}
+
+	signals := duplicateSignals{
+		Name:    float64(candidate.NameSimilarity),
+		Email:   matches(patient.Email, candidate.Email, strings.ToLower),
+		Phone:   matches(patient.Phone, candidate.Phone, strings.TrimSpace),
+		Address: matches(patient.Address, candidate.Address, normaliseAddress),
+	}
+
+	score := signals.Name*duplicateWeights.Name +
+		signals.Email*duplicateWeights.Email +
+		signals.Phone*duplicateWeights.Phone +
+		signals.Address*duplicateWeights.Address
+
+	return duplicateCandidate{
+		Patient: db.Patient{
+			ID:          candidate.ID,
+			FirstName:   candidate.FirstName,
+			LastName:    candidate.LastName,
+			Address:     candidate.Address,
+			Phone:       candidate.Phone,
+			Email:       candidate.Email,
+			CreatedAt:   candidate.CreatedAt,
+			DateOfBirth: candidate.DateOfBirth,
+			MRN:         candidate.MRN,
+		},
+		// Round the score, so floating point noise doesn't leak into the API
+		Score:   float64(int(score*1000+0.5)) / 1000,
+		Signals: signals,
+	}
+}
+
+// normaliseAddress ignores case, punctuation and spacing, so "1 Bag End, Hobbiton"
+// matches "1 bag end hobbiton"
+func normaliseAddress(address string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(address), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// patientDuplicatesHandler lists the patients which might be duplicates of the
+// one in the URL, with the most likely first
+func (s Server) patientDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	patient, err := s.database.GetPatient(ctx, id)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to retrieve patient %d data from the database: %v", id, err)
+		if err == sql.ErrNoRows {
+			writeProblem(w, r, problemNotFound, "")
+		} else {
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	rows, err := s.database.ListDuplicateCandidates(ctx, db.ListDuplicateCandidatesParams{ID: id, Limit: maxDuplicateCandidates})
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to retrieve duplicates of patient %d from the database: %v", id, err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	candidates := make([]duplicateCandidate, 0, len(rows))
+	for _, row := range rows {
+		candidates = append(candidates, scoreDuplicate(patient, row))
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	jsonData, err := marshalJSON(r.Context(), pagePayload{Data: candidates})
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise duplicate candidates to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+// mergePatientHandler merges the duplicate in the request body into the patient
+// in the URL. Both patients are audited, in the same transaction as the merge.
+func (s Server) mergePatientHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r)
+	if !ok {
+		return
+	}
+
+	body, ok := s.readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	var payload mergePayload
+	if err := decodePayload(body, &payload); err != nil {
+		log.WithContext(r.Context()).Debugf("Rejecting patient merge: %v", err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+	if payload.DuplicateID == id {
+		writeProblem(w, r, problemValidation, "", fieldError{Field: "duplicate_id", Message: "must be a different patient"})
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	var result mergeResult
+	err := s.mutate(ctx, func(q queries) (string, int32, error) {
+		var err error
+		if result, err = mergePatients(ctx, q, id, payload.DuplicateID); err != nil {
+			return "patient", id, err
+		}
+		return "patient", id, s.auditRelated(ctx, q, "patient", payload.DuplicateID)
+	})
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to merge patient %d into patient %d: %v", payload.DuplicateID, id, err)
+		switch {
+		case err == sql.ErrNoRows:
+			writeProblem(w, r, problemNotFound, "The patient or the duplicate doesn't exist")
+		case db.IsConstraintViolation(err, db.ExclusionViolation, ""):
+			writeProblem(w, r, problemBookingConflict, "The patients have overlapping visits")
+		case db.IsConstraintViolation(err, db.UniqueViolation, "unique_patient_identifier"):
+			writeProblem(w, r, problemDuplicateID, "Another patient already has the MRN of the duplicate as an identifier")
+		default:
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	jsonData, err := marshalJSON(r.Context(), result)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise merged patient data to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+// mergePatients moves the visits and the identifiers of the duplicate to the
+// surviving patient, fills in the data which the survivor is missing from the
+// duplicate and deletes the duplicate
+func mergePatients(ctx context.Context, q queries, survivorID, duplicateID int32) (mergeResult, error) {
+	// Lock the patients in ID order, so concurrent merges can't deadlock
+	ids := []int32{survivorID, duplicateID}
+	if duplicateID < survivorID {
+		ids[0], ids[1] = duplicateID, survivorID
+	}
+	locked := make(map[int32]db.Patient, len(ids))
+	for _, id := range ids {
+		patient, err := q.GetPatientForUpdate(ctx, id)
+		if err != nil {
+			return mergeResult{}, err
+		}
+		locked[id] = patient
+	}
+	survivor, duplicate := locked[survivorID], locked[duplicateID]
+
+	moved, err := q.MovePatientVisits(ctx, db.MovePatientVisitsParams{ToPatientID: survivorID, FromPatientID: duplicateID})
+	if err != nil {
+		return mergeResult{}, err
+	}
+	// The identifiers would be deleted together with the duplicate otherwise.
+	// A patient only has one MRN, so the duplicate's MRN is kept as an
+	// identifier of the survivor, where records which refer to it can find it.
+	if _, err := q.MovePatientIdentifiers(ctx, db.MovePatientIdentifiersParams{ToPatientID: survivorID, FromPatientID: duplicateID}); err != nil {
+		return mergeResult{}, err
+	}
+	if duplicate.MRN != "" {
+		_, err := q.AddPatientIdentifier(ctx, db.AddPatientIdentifierParams{
+			PatientID: survivorID,
+			System:    mrnIdentifierSystem,
+			Value:     duplicate.MRN,
+		})
+		if err != nil {
+			return mergeResult{}, err
+		}
+	}
+
+	firstNonEmpty := func(values ...string) string {
+		for _, value := range values {
+			if value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	params := db.UpdatePatientParams{
+		ID:          survivor.ID,
+		FirstName:   survivor.FirstName,
+		LastName:    survivor.LastName,
+		Address:     firstNonEmpty(survivor.Address, duplicate.Address),
+		Phone:       firstNonEmpty(survivor.Phone, duplicate.Phone),
+		Email:       firstNonEmpty(survivor.Email, duplicate.Email),
+		DateOfBirth: survivor.DateOfBirth,
+	}
+	if !params.DateOfBirth.Valid {
+		params.DateOfBirth = duplicate.DateOfBirth
+	}
+	if params.Address != survivor.Address || params.Phone != survivor.Phone || params.Email != survivor.Email ||
+		params.DateOfBirth != survivor.DateOfBirth {
+		if survivor, err = q.UpdatePatient(ctx, params); err != nil {
+			return mergeResult{}, err
+		}
+	}
+
+	if _, err := q.DeletePatient(ctx, duplicateID); err != nil {
+		return mergeResult{}, err
+	}
+
+	return mergeResult{Patient: survivor, MergedPatientID: duplicateID, MovedVisits: moved}, nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	"github.com/mihaitodor/ferrum/db/date"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Duplicates(t *testing.T) {
+	Convey("Duplicate patients test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+		}
+
+		queries := &mockQueries{
+			Patients: []db.Patient{
+				{ID: 1, FirstName: "John", LastName: "Smith", Address: "1 Bag End, Hobbiton", Phone: "+441234567890"},
+				{ID: 2, FirstName: "John", LastName: "Smith", Address: "Rivendell"},
+				{ID: 3, FirstName: "Jon", LastName: "Smith", Address: "1 bag end hobbiton", Phone: "+441234567890", Email: "jon@shire.example", DateOfBirth: date.New(1937, time.September, 21), MRN: "MRN00000003"},
+			},
+			Identifiers: []db.PatientIdentifier{
+				{ID: 1, PatientID: 3, System: "https://shire.example/ids", Value: "B-1290"},
+			},
+			Visits: []db.Visit{
+				{ID: 1, PatientID: 1, PhysicianID: 1},
+				{ID: 2, PatientID: 3, PhysicianID: 1},
+				{ID: 3, PatientID: 3, PhysicianID: 2},
+			},
+			NameSimilarity: 0.5,
+		}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+
+		serve := func(role Role, method, url string, body []byte) *httptest.ResponseRecorder {
+			token, err := s.issueToken("bilbo", role)
+			So(err, ShouldBeNil)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("duplicate candidates should be ranked by their contact data", func() {
+			resp := serve(RoleReceptionist, http.MethodGet, "http://example.com/api/v1/patients/1/duplicates", nil)
+			So(resp.Code, ShouldEqual, http.StatusOK)
+
+			var page struct {
+				Data []duplicateCandidate `json:"data"`
+			}
+			So(json.NewDecoder(resp.Body).Decode(&page), ShouldBeNil)
+			So(page.Data, ShouldHaveLength, 2)
+			So(page.Data[0].Patient.ID, ShouldEqual, 3)
+			So(page.Data[0].Signals, ShouldResemble, duplicateSignals{Name: 0.5, Phone: 1, Address: 1})
+			So(page.Data[0].Score, ShouldEqual, 0.5)
+			So(page.Data[1].Patient.ID, ShouldEqual, 2)
+			So(page.Data[1].Score, ShouldEqual, 0.2)
+		})
+
+		Convey("duplicate candidates should be matched by phone through a blind index when the contact data is encrypted", func() {
+			pc, err := newPatientCipher(bytes.Repeat([]byte{1}, 32))
+			So(err, ShouldBeNil)
+			encrypted := &mockQueries{NameSimilarity: 0.5}
+			s.database = newEncryptedStore(encrypted, pc)
+			for _, patient := range queries.Patients {
+				_, err := s.database.AddPatient(context.Background(), db.AddPatientParams{
+					FirstName: patient.FirstName,
+					LastName:  patient.LastName,
+					Address:   patient.Address,
+					Phone:     patient.Phone,
+					Email:     patient.Email,
+				})
+				So(err, ShouldBeNil)
+			}
+
+			// The ciphertexts differ, so only the blind indexes can be compared
+			So(encrypted.Patients[2].Phone, ShouldNotEqual, encrypted.Patients[0].Phone)
+			So(encrypted.PhoneIndexes[1], ShouldNotBeEmpty)
+			So(encrypted.PhoneIndexes[3], ShouldEqual, encrypted.PhoneIndexes[1])
+			So(encrypted.PhoneIndexes[2], ShouldBeEmpty)
+
+			resp := serve(RoleReceptionist, http.MethodGet, "http://example.com/api/v1/patients/1/duplicates", nil)
+			So(resp.Code, ShouldEqual, http.StatusOK)
+
+			var page struct {
+				Data []duplicateCandidate `json:"data"`
+			}
+			So(json.NewDecoder(resp.Body).Decode(&page), ShouldBeNil)
+			So(page.Data[0].Patient.ID, ShouldEqual, 3)
+			So(page.Data[0].Patient.Phone, ShouldEqual, "+441234567890")
+			So(page.Data[0].Signals.Phone, ShouldEqual, 1)
+		})
+
+		Convey("merging should", func() {
+			Convey("move the visits and identifiers, fill in the missing data and delete the duplicate", func() {
+				resp := serve(RoleAdmin, http.MethodPost, "http://example.com/api/v1/patients/1/merge", []byte(`{"duplicate_id":3}`))
+				So(resp.Code, ShouldEqual, http.StatusOK)
+
+				var result mergeResult
+				So(json.NewDecoder(resp.Body).Decode(&result), ShouldBeNil)
+				So(result.MergedPatientID, ShouldEqual, 3)
+				So(result.MovedVisits, ShouldEqual, 2)
+				So(result.Patient.Email, ShouldEqual, "jon@shire.example")
+				So(result.Patient.Address, ShouldEqual, "1 Bag End, Hobbiton")
+				So(result.Patient.DateOfBirth, ShouldResemble, date.New(1937, time.September, 21))
+				So(queries.Identifiers, ShouldResemble, []db.PatientIdentifier{
+					{ID: 1, PatientID: 1, System: "https://shire.example/ids", Value: "B-1290"},
+					{ID: 2, PatientID: 1, System: "urn:ferrum:mrn", Value: "MRN00000003"},
+				})
+
+				So(queries.Patients, ShouldHaveLength, 2)
+				for _, visit := range queries.Visits {
+					So(visit.PatientID, ShouldEqual, 1)
+				}
+
+				So(queries.AuditEntries, ShouldHaveLength, 2)
+				for i, resourceID := range []string{"3", "1"} {
+					So(queries.AuditEntries[i].Action, ShouldEqual, "merge")
+					So(queries.AuditEntries[i].ResourceType, ShouldEqual, "patient")
+					So(queries.AuditEntries[i].ResourceID, ShouldEqual, resourceID)
+					So(queries.AuditEntries[i].Outcome, ShouldEqual, auditSuccess)
+				}
+			})
+
+			Convey("reject merging a patient into itself", func() {
+				resp := serve(RoleAdmin, http.MethodPost, "http://example.com/api/v1/patients/1/merge", []byte(`{"duplicate_id":1}`))
+				So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+			})
+
+			Convey("return 404 for unknown duplicates", func() {
+				resp := serve(RoleAdmin, http.MethodPost, "http://example.com/api/v1/patients/1/merge", []byte(`{"duplicate_id":42}`))
+				So(resp.Code, ShouldEqual, http.StatusNotFound)
+				So(queries.Patients, ShouldHaveLength, 3)
+			})
+
+			Convey("only be allowed for admins", func() {
+				resp := serve(RoleReceptionist, http.MethodPost, "http://example.com/api/v1/patients/1/merge", []byte(`{"duplicate_id":3}`))
+				So(resp.Code, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("addresses should be compared ignoring case, punctuation and spacing", func() {
+			So(normaliseAddress("1 Bag End,  Hobbiton."), ShouldEqual, normaliseAddress("1 bag end hobbiton"))
+			So(normaliseAddress("1 Bag End"), ShouldNotEqual, normaliseAddress("2 Bag End"))
+		})
+	})
+}
@@ -0,0 +1,589 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// encryptedValuePrefix marks the column values which are encrypted. The
+	// rest are plaintext values written before encryption was enabled.
+	encryptedValuePrefix = "enc:v1:"
+	patientDataKeySize   = 32
+)
+
+// patientDataKey is a master key, which wraps the data keys of the encrypted
+// values and derives the keys of the email and phone blind indexes
+type patientDataKey struct {
+	id            string
+	aead          cipher.AEAD
+	emailIndexKey []byte
+	phoneIndexKey []byte
+}
+
+// patientCipher encrypts the patient address, phone and email with envelope
+// encryption. Each value is encrypted with a new AES-256-GCM data key, which is
+// wrapped by the current master key and stored next to the ciphertext together
+// with the master key ID:
+//
+//	enc:v1:<master key ID>:<wrapped data key>:<ciphertext>
+//
+// The other master keys are only used to decrypt the values which haven't been
+// re-encrypted since they were rotated.
+type patientCipher struct {
+	current *patientDataKey
+	keys    map[string]*patientDataKey
+	// ordered keeps the email blind indexes in the order of the config
+	ordered []*patientDataKey
+}
+
+// loadPatientCipher reads the master keys listed in the config. It returns nil
+// when there are none, in which case the patient data is stored as plaintext.
+func loadPatientCipher(c config.Config) (*patientCipher, error) {
+	if len(c.PatientDataKeyFiles) == 0 {
+		log.Warn("No patient data keys are configured, so the patient contact data is stored as plaintext")
+		return nil, nil
+	}
+
+	var keys [][]byte
+	for _, file := range c.PatientDataKeyFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 key in %q: %v", file, err)
+		}
+		keys = append(keys, key)
+	}
+
+	pc, err := newPatientCipher(keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Encrypting patient data with key %q", pc.current.id)
+
+	return pc, nil
+}
+
+// newPatientCipher creates a cipher which encrypts with the first key
+func newPatientCipher(keys ...[]byte) (*patientCipher, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one key is required")
+	}
+
+	pc := &patientCipher{keys: make(map[string]*patientDataKey)}
+	for _, key := range keys {
+		if len(key) != patientDataKeySize {
+			return nil, fmt.Errorf("patient data keys must be %d bytes long, not %d", patientDataKeySize, len(key))
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		// The key ID is derived from the key, so it can't be reused for a
+		// different key by mistake
+		sum := sha256.Sum256(key)
+		k := &patientDataKey{
+			id:            hex.EncodeToString(sum[:8]),
+			aead:          aead,
+			emailIndexKey: hmacSHA256(key, []byte("ferrum patient email index")),
+			phoneIndexKey: hmacSHA256(key, []byte("ferrum patient phone index")),
+		}
+		if _, ok := pc.keys[k.id]; ok {
+			continue
+		}
+
+		pc.keys[k.id] = k
+		pc.ordered = append(pc.ordered, k)
+	}
+	pc.current = pc.ordered[0]
+
+	return pc, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// seal encrypts plaintext with a random nonce, which is prepended to the
+// ciphertext
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// encrypt encrypts the value of the given column. The column name is
+// authenticated, so values can't be swapped between columns. Empty values are
+// left empty.
+func (pc *patientCipher) encrypt(column, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	dataKey := make([]byte, patientDataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %v", err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(dataAEAD, []byte(value), []byte(column))
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := seal(pc.current.aead, dataKey, []byte(pc.current.id))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedValuePrefix + strings.Join([]string{
+		pc.current.id,
+		base64.RawStdEncoding.EncodeToString(wrappedKey),
+		base64.RawStdEncoding.EncodeToString(ciphertext),
+	}, ":"), nil
+}
+
+// decrypt decrypts the value of the given column. Plaintext values are
+// returned as they are.
+func (pc *patientCipher) decrypt(column, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedValuePrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed %s ciphertext", column)
+	}
+
+	key, ok := pc.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown patient data key %q", parts[0])
+	}
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed %s data key: %v", column, err)
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed %s ciphertext: %v", column, err)
+	}
+
+	dataKey, err := open(key.aead, wrappedKey, []byte(key.id))
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap %s data key: %v", column, err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataAEAD, ciphertext, []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %v", column, err)
+	}
+
+	return string(plaintext), nil
+}
+
+// isCurrent checks if a value doesn't need to be re-encrypted, because it's
+// either empty or encrypted with the current master key
+func (pc *patientCipher) isCurrent(value string) bool {
+	return value == "" || strings.HasPrefix(value, encryptedValuePrefix+pc.current.id+":")
+}
+
+// emailIndex computes the blind index of an email with the given key. Emails
+// are matched ignoring case, like the plaintext lookups.
+func (k *patientDataKey) emailIndex(email string) string {
+	normalised := strings.ToLower(strings.TrimSpace(email))
+	return k.id + ":" + base64.RawStdEncoding.EncodeToString(hmacSHA256(k.emailIndexKey, []byte(normalised)))
+}
+
+// emailIndex computes the blind index which is stored for an email
+func (pc *patientCipher) emailIndex(email string) string {
+	if email == "" {
+		return ""
+	}
+
+	return pc.current.emailIndex(email)
+}
+
+// emailIndexes computes the blind indexes of an email with every master key,
+// so lookups also find the patients which haven't been re-encrypted yet
+func (pc *patientCipher) emailIndexes(email string) []string {
+	indexes := make([]string, 0, len(pc.ordered))
+	for _, key := range pc.ordered {
+		indexes = append(indexes, key.emailIndex(email))
+	}
+
+	return indexes
+}
+
+// phoneIndex computes the blind index which is stored for a phone number. The
+// numbers are validated into E.164 format, so they're matched as they are.
+func (pc *patientCipher) phoneIndex(phone string) string {
+	if phone == "" {
+		return ""
+	}
+
+	return pc.current.id + ":" + base64.RawStdEncoding.EncodeToString(hmacSHA256(pc.current.phoneIndexKey, []byte(phone)))
+}
+
+// contactFields returns the encrypted fields of a patient, by column name
+func contactFields(address, phone, email *string) []struct {
+	column string
+	value  *string
+} {
+	return []struct {
+		column string
+		value  *string
+	}{
+		{"address", address},
+		{"phone", phone},
+		{"email", email},
+	}
+}
+
+// encryptContact encrypts the contact data of a patient in place
+func (pc *patientCipher) encryptContact(address, phone, email *string) error {
+	for _, field := range contactFields(address, phone, email) {
+		encrypted, err := pc.encrypt(field.column, *field.value)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %v", field.column, err)
+		}
+		*field.value = encrypted
+	}
+
+	return nil
+}
+
+// decryptPatient decrypts the contact data of a patient record
+func (pc *patientCipher) decryptPatient(p db.Patient) (db.Patient, error) {
+	for _, field := range contactFields(&p.Address, &p.Phone, &p.Email) {
+		decrypted, err := pc.decrypt(field.column, *field.value)
+		if err != nil {
+			return db.Patient{}, fmt.Errorf("failed to decrypt patient %d: %v", p.ID, err)
+		}
+		*field.value = decrypted
+	}
+
+	return p, nil
+}
+
+// encryptedQueries encrypts the patient contact data before it's written to
+// the database and decrypts it after it's read
+type encryptedQueries struct {
+	queries
+	cipher *patientCipher
+}
+
+func (q encryptedQueries) AddPatient(ctx context.Context, arg db.AddPatientParams) (db.Patient, error) {
+	email, phone := arg.Email, arg.Phone
+	if err := q.cipher.encryptContact(&arg.Address, &arg.Phone, &arg.Email); err != nil {
+		return db.Patient{}, err
+	}
+
+	// The errors of the queries are returned as they are, since the callers
+	// check for constraint violations
+	patient, err := q.queries.AddPatient(ctx, arg)
+	if err != nil {
+		return patient, err
+	}
+	if err := q.setBlindIndexes(ctx, patient.ID, email, phone); err != nil {
+		return db.Patient{}, err
+	}
+
+	return q.cipher.decryptPatient(patient)
+}
+
+func (q encryptedQueries) GetPatient(ctx context.Context, id int32) (db.Patient, error) {
+	patient, err := q.queries.GetPatient(ctx, id)
+	if err != nil {
+		return patient, err
+	}
+
+	return q.cipher.decryptPatient(patient)
+}
+
+func (q encryptedQueries) GetPatientForUpdate(ctx context.Context, id int32) (db.Patient, error) {
+	patient, err := q.queries.GetPatientForUpdate(ctx, id)
+	if err != nil {
+		return patient, err
+	}
+
+	return q.cipher.decryptPatient(patient)
+}
+
+func (q encryptedQueries) ListPatients(ctx context.Context, arg db.ListPatientsParams) ([]db.Patient, error) {
+	if arg.Email != "" {
+		arg.EmailIndexes = q.cipher.emailIndexes(arg.Email)
+	}
+
+	patients, err := q.queries.ListPatients(ctx, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range patients {
+		if patients[i], err = q.cipher.decryptPatient(patients[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return patients, nil
+}
+
+// SearchPatients only matches emails exactly, through their blind indexes, and
+// doesn't match phone numbers
+func (q encryptedQueries) SearchPatients(ctx context.Context, arg db.SearchPatientsParams) ([]db.SearchPatientsRow, error) {
+	arg.ExcludeContact = true
+	if strings.Contains(arg.Query, "@") {
+		arg.EmailIndexes = q.cipher.emailIndexes(arg.Query)
+	}
+
+	rows, err := q.queries.SearchPatients(ctx, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rows {
+		if rows[i].Patient, err = q.cipher.decryptPatient(rows[i].Patient); err != nil {
+			return nil, err
+		}
+	}
+
+	return rows, nil
+}
+
+func (q encryptedQueries) ListDuplicateCandidates(ctx context.Context, arg db.ListDuplicateCandidatesParams) ([]db.ListDuplicateCandidatesRow, error) {
+	rows, err := q.queries.ListDuplicateCandidates(ctx, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, row := range rows {
+		for _, field := range contactFields(&rows[i].Address, &rows[i].Phone, &rows[i].Email) {
+			if *field.value, err = q.cipher.decrypt(field.column, *field.value); err != nil {
+				return nil, fmt.Errorf("failed to decrypt patient %d: %v", row.ID, err)
+			}
+		}
+	}
+
+	return rows, nil
+}
+
+func (q encryptedQueries) UpdatePatient(ctx context.Context, arg db.UpdatePatientParams) (db.Patient, error) {
+	email, phone := arg.Email, arg.Phone
+	if err := q.cipher.encryptContact(&arg.Address, &arg.Phone, &arg.Email); err != nil {
+		return db.Patient{}, err
+	}
+
+	patient, err := q.queries.UpdatePatient(ctx, arg)
+	if err != nil {
+		return patient, err
+	}
+	if err := q.setBlindIndexes(ctx, patient.ID, email, phone); err != nil {
+		return db.Patient{}, err
+	}
+
+	return q.cipher.decryptPatient(patient)
+}
+
+// setBlindIndexes stores the blind indexes of the plaintext email and phone
+func (q encryptedQueries) setBlindIndexes(ctx context.Context, patientID int32, email, phone string) error {
+	err := q.queries.SetPatientEmailIndex(ctx, db.SetPatientEmailIndexParams{
+		PatientID:  patientID,
+		EmailIndex: q.cipher.emailIndex(email),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update email index: %v", err)
+	}
+
+	err = q.queries.SetPatientPhoneIndex(ctx, db.SetPatientPhoneIndexParams{
+		PatientID:  patientID,
+		PhoneIndex: q.cipher.phoneIndex(phone),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update phone index: %v", err)
+	}
+
+	return nil
+}
+
+// encryptedStore runs encryptedQueries on their own or in a transaction
+type encryptedStore struct {
+	encryptedQueries
+	store store
+}
+
+func newEncryptedStore(s store, pc *patientCipher) encryptedStore {
+	return encryptedStore{
+		encryptedQueries: encryptedQueries{queries: s, cipher: pc},
+		store:            s,
+	}
+}
+
+func (s encryptedStore) ExecTx(ctx context.Context, fn func(queries) error) error {
+	return s.store.ExecTx(ctx, func(q queries) error {
+		return fn(encryptedQueries{queries: q, cipher: s.cipher})
+	})
+}
+
+func (s encryptedStore) ReadTx(ctx context.Context, fn func(queries) error) error {
+	return s.store.ReadTx(ctx, func(q queries) error {
+		return fn(encryptedQueries{queries: q, cipher: s.cipher})
+	})
+}
+
+// ReencryptPatients re-encrypts the patient contact data which is stored as
+// plaintext or with a retired master key and returns the number of patients
+// it updated. The blind indexes of the other patients are recomputed.
+// Patients which are modified concurrently are skipped, since their new data
+// is already encrypted with the current key, so it can run while the API is
+// serving requests.
+func (s Server) ReencryptPatients(ctx context.Context) (int, error) {
+	encrypted, ok := s.database.(encryptedStore)
+	if !ok {
+		return 0, errors.New("no patient data keys are configured")
+	}
+	raw, pc := encrypted.store, encrypted.cipher
+
+	updated := 0
+	for params := (db.ListPatientsParams{SortBy: db.PatientSortLastName, Limit: exportPageSize}); ; {
+		patients, err := raw.ListPatients(ctx, params)
+		if err != nil {
+			return updated, fmt.Errorf("failed to retrieve patients: %v", err)
+		}
+
+		for _, patient := range patients {
+			if pc.isCurrent(patient.Address) && pc.isCurrent(patient.Phone) && pc.isCurrent(patient.Email) {
+				// The patients encrypted before the phone index was added
+				// don't have one yet
+				if err := reindexPatient(ctx, raw, pc, patient.ID); err != nil {
+					return updated, fmt.Errorf("failed to index patient %d: %v", patient.ID, err)
+				}
+				continue
+			}
+
+			reencrypted, err := reencryptPatient(ctx, raw, pc, patient)
+			if err != nil {
+				return updated, fmt.Errorf("failed to re-encrypt patient %d: %v", patient.ID, err)
+			}
+			if reencrypted {
+				updated++
+			} else {
+				log.WithContext(ctx).Infof("Skipped patient %d, which was modified during re-encryption", patient.ID)
+			}
+		}
+
+		if len(patients) < exportPageSize {
+			break
+		}
+		last := patients[len(patients)-1]
+		params.AfterKey = db.PatientSortKey(last, params.SortBy)
+		params.AfterID = last.ID
+	}
+
+	return updated, nil
+}
+
+// reencryptPatient encrypts the contact data of a patient record with the
+// current key and updates its blind indexes, unless the record has changed
+func reencryptPatient(ctx context.Context, raw store, pc *patientCipher, patient db.Patient) (bool, error) {
+	decrypted, err := pc.decryptPatient(patient)
+	if err != nil {
+		return false, err
+	}
+
+	params := db.ReencryptPatientParams{
+		Address:    decrypted.Address,
+		Phone:      decrypted.Phone,
+		Email:      decrypted.Email,
+		ID:         patient.ID,
+		OldAddress: patient.Address,
+		OldPhone:   patient.Phone,
+		OldEmail:   patient.Email,
+	}
+	if err := pc.encryptContact(&params.Address, &params.Phone, &params.Email); err != nil {
+		return false, err
+	}
+
+	var rows int64
+	err = raw.ExecTx(ctx, func(q queries) error {
+		var err error
+		if rows, err = q.ReencryptPatient(ctx, params); err != nil || rows == 0 {
+			return err
+		}
+
+		return encryptedQueries{queries: q, cipher: pc}.setBlindIndexes(ctx, patient.ID, decrypted.Email, decrypted.Phone)
+	})
+
+	return rows > 0, err
+}
+
+// reindexPatient recomputes the blind indexes of a patient record which is
+// already encrypted with the current key. The record is locked, so the indexes
+// can't be overwritten with stale values.
+func reindexPatient(ctx context.Context, raw store, pc *patientCipher, id int32) error {
+	return raw.ExecTx(ctx, func(q queries) error {
+		patient, err := q.GetPatientForUpdate(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		decrypted, err := pc.decryptPatient(patient)
+		if err != nil {
+			return err
+		}
+
+		return encryptedQueries{queries: q, cipher: pc}.setBlindIndexes(ctx, id, decrypted.Email, decrypted.Phone)
+	})
+}
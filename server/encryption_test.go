@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Encryption(t *testing.T) {
+	Convey("Patient data encryption test", t, func() {
+		oldKey := bytes.Repeat([]byte{1}, 32)
+		newKey := bytes.Repeat([]byte{2}, 32)
+
+		oldCipher, err := newPatientCipher(oldKey)
+		So(err, ShouldBeNil)
+		rotatedCipher, err := newPatientCipher(newKey, oldKey)
+		So(err, ShouldBeNil)
+
+		Convey("the cipher should", func() {
+			Convey("encrypt values with a new data key each time", func() {
+				first, err := oldCipher.encrypt("email", "bilbo@shire.example")
+				So(err, ShouldBeNil)
+				second, err := oldCipher.encrypt("email", "bilbo@shire.example")
+				So(err, ShouldBeNil)
+
+				So(first, ShouldStartWith, "enc:v1:"+oldCipher.current.id+":")
+				So(first, ShouldNotContainSubstring, "bilbo")
+				So(first, ShouldNotEqual, second)
+
+				plaintext, err := oldCipher.decrypt("email", first)
+				So(err, ShouldBeNil)
+				So(plaintext, ShouldEqual, "bilbo@shire.example")
+			})
+
+			Convey("leave empty and plaintext values as they are", func() {
+				encrypted, err := oldCipher.encrypt("address", "")
+				So(err, ShouldBeNil)
+				So(encrypted, ShouldBeEmpty)
+
+				plaintext, err := oldCipher.decrypt("address", "Bag End")
+				So(err, ShouldBeNil)
+				So(plaintext, ShouldEqual, "Bag End")
+			})
+
+			Convey("reject values which were moved to a different column or tampered with", func() {
+				encrypted, err := oldCipher.encrypt("phone", "+441234567890")
+				So(err, ShouldBeNil)
+
+				_, err = oldCipher.decrypt("email", encrypted)
+				So(err, ShouldNotBeNil)
+
+				_, err = oldCipher.decrypt("phone", encrypted[:len(encrypted)-2]+"AA")
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("decrypt values encrypted with retired keys", func() {
+				encrypted, err := oldCipher.encrypt("address", "Bag End")
+				So(err, ShouldBeNil)
+				So(rotatedCipher.isCurrent(encrypted), ShouldBeFalse)
+
+				plaintext, err := rotatedCipher.decrypt("address", encrypted)
+				So(err, ShouldBeNil)
+				So(plaintext, ShouldEqual, "Bag End")
+			})
+
+			Convey("reject values encrypted with unknown keys", func() {
+				encrypted, err := rotatedCipher.encrypt("address", "Bag End")
+				So(err, ShouldBeNil)
+
+				_, err = oldCipher.decrypt("address", encrypted)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "unknown patient data key")
+			})
+
+			Convey("compute blind indexes which ignore case", func() {
+				So(oldCipher.emailIndex("Bilbo@Shire.example"), ShouldEqual, oldCipher.emailIndex("bilbo@shire.example"))
+				So(oldCipher.emailIndex("bilbo@shire.example"), ShouldNotEqual, oldCipher.emailIndex("frodo@shire.example"))
+				So(oldCipher.emailIndex(""), ShouldBeEmpty)
+				So(rotatedCipher.emailIndexes("bilbo@shire.example"), ShouldResemble, []string{
+					rotatedCipher.emailIndex("bilbo@shire.example"),
+					oldCipher.emailIndex("bilbo@shire.example"),
+				})
+				So(oldCipher.phoneIndex("+441234567890"), ShouldNotEqual, oldCipher.phoneIndex("+441234567891"))
+				So(oldCipher.phoneIndex("+441234567890"), ShouldNotEqual, rotatedCipher.phoneIndex("+441234567890"))
+				So(oldCipher.phoneIndex(""), ShouldBeEmpty)
+			})
+		})
+
+		Convey("keys should be loaded from base64 files", func() {
+			dir, err := ioutil.TempDir("", "ferrum-keys")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			writeKey := func(name string, key []byte) string {
+				file := filepath.Join(dir, name)
+				So(ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600), ShouldBeNil)
+				return file
+			}
+
+			pc, err := loadPatientCipher(config.Config{PatientDataKeyFiles: []string{
+				writeKey("new.key", newKey), writeKey("old.key", oldKey),
+			}})
+			So(err, ShouldBeNil)
+			So(pc.current.id, ShouldEqual, rotatedCipher.current.id)
+			So(pc.keys, ShouldContainKey, oldCipher.current.id)
+
+			pc, err = loadPatientCipher(config.Config{})
+			So(err, ShouldBeNil)
+			So(pc, ShouldBeNil)
+
+			_, err = loadPatientCipher(config.Config{PatientDataKeyFiles: []string{writeKey("short.key", newKey[:16])}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("the encrypted store should", func() {
+			mock := &mockQueries{}
+			database := newEncryptedStore(mock, oldCipher)
+			ctx := context.Background()
+
+			var added db.Patient
+			So(database.ExecTx(ctx, func(q queries) error {
+				added, err = q.AddPatient(ctx, db.AddPatientParams{
+					FirstName: "Bilbo",
+					LastName:  "Baggins",
+					Address:   "Bag End",
+					Phone:     "+441234567890",
+					Email:     "bilbo@shire.example",
+				})
+				return err
+			}), ShouldBeNil)
+
+			Convey("only store ciphertexts and blind indexes", func() {
+				So(added.Address, ShouldEqual, "Bag End")
+				So(added.Email, ShouldEqual, "bilbo@shire.example")
+
+				stored := mock.Patients[0]
+				So(stored.FirstName, ShouldEqual, "Bilbo")
+				for _, value := range []string{stored.Address, stored.Phone, stored.Email} {
+					So(value, ShouldStartWith, "enc:v1:")
+				}
+				So(mock.EmailIndexes[added.ID], ShouldEqual, oldCipher.emailIndex("bilbo@shire.example"))
+				So(mock.PhoneIndexes[added.ID], ShouldEqual, oldCipher.phoneIndex("+441234567890"))
+			})
+
+			Convey("decrypt the patients it reads", func() {
+				patient, err := database.GetPatient(ctx, added.ID)
+				So(err, ShouldBeNil)
+				So(patient, ShouldResemble, added)
+
+				patients, err := database.ListPatients(ctx, db.ListPatientsParams{Limit: 10})
+				So(err, ShouldBeNil)
+				So(patients, ShouldResemble, []db.Patient{added})
+			})
+
+			Convey("look emails up through their blind indexes and as plaintext", func() {
+				_, err := newEncryptedStore(mock, rotatedCipher).ListPatients(ctx, db.ListPatientsParams{
+					Email: "Bilbo@shire.example",
+					Limit: 10,
+				})
+				So(err, ShouldBeNil)
+				So(mock.ListPatientsArgs.Email, ShouldEqual, "Bilbo@shire.example")
+				So(mock.ListPatientsArgs.EmailIndexes, ShouldContain, mock.EmailIndexes[added.ID])
+			})
+
+			Convey("re-encrypt plaintext data and data encrypted with retired keys", func() {
+				mock.Patients = append(mock.Patients, db.Patient{
+					ID:        2,
+					FirstName: "Frodo",
+					LastName:  "Baggins",
+					Address:   "Bag End",
+					Email:     "frodo@shire.example",
+				})
+
+				s := Server{database: newEncryptedStore(mock, rotatedCipher)}
+				updated, err := s.ReencryptPatients(ctx)
+				So(err, ShouldBeNil)
+				So(updated, ShouldEqual, 2)
+
+				for _, stored := range mock.Patients {
+					So(rotatedCipher.isCurrent(stored.Address), ShouldBeTrue)
+					So(rotatedCipher.isCurrent(stored.Phone), ShouldBeTrue)
+					So(rotatedCipher.isCurrent(stored.Email), ShouldBeTrue)
+					So(strings.HasPrefix(mock.EmailIndexes[stored.ID], rotatedCipher.current.id+":"), ShouldBeTrue)
+				}
+				So(mock.PhoneIndexes[added.ID], ShouldEqual, rotatedCipher.phoneIndex("+441234567890"))
+
+				patient, err := s.database.GetPatient(ctx, added.ID)
+				So(err, ShouldBeNil)
+				So(patient, ShouldResemble, added)
+
+				updated, err = s.ReencryptPatients(ctx)
+				So(err, ShouldBeNil)
+				So(updated, ShouldEqual, 0)
+			})
+
+			Convey("index the phone numbers which were encrypted before the phone index existed", func() {
+				mock.PhoneIndexes = nil
+
+				s := Server{database: newEncryptedStore(mock, oldCipher)}
+				updated, err := s.ReencryptPatients(ctx)
+				So(err, ShouldBeNil)
+				So(updated, ShouldEqual, 0)
+				So(mock.PhoneIndexes[added.ID], ShouldEqual, oldCipher.phoneIndex("+441234567890"))
+			})
+
+			Convey("refuse to re-encrypt without keys", func() {
+				_, err := Server{database: mock}.ReencryptPatients(ctx)
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mihaitodor/ferrum/db"
+)
+
+// exportPageSize is the number of rows read at a time while exporting
+const exportPageSize = 500
+
+// Export contains all the physicians, patients, their identifiers and visits.
+// The identifiers and visits refer to the physicians and patients by the IDs
+// they have in the same export.
+type Export struct {
+	Physicians  []db.Physician         `json:"physicians"`
+	Patients    []db.Patient           `json:"patients"`
+	Identifiers []db.PatientIdentifier `json:"patient_identifiers"`
+	Visits      []db.Visit             `json:"visits"`
+}
+
+// Export reads all the physicians, patients, identifiers and visits from the
+// database. They're read in a single transaction, so the identifiers and
+// visits don't refer to patients which are deleted while it runs.
+func (s Server) Export(ctx context.Context) (Export, error) {
+	data := Export{
+		Physicians:  []db.Physician{},
+		Patients:    []db.Patient{},
+		Identifiers: []db.PatientIdentifier{},
+		Visits:      []db.Visit{},
+	}
+	err := s.database.ReadTx(ctx, func(q queries) error {
+		return exportPages(ctx, q, &data)
+	})
+	if err != nil {
+		return Export{}, err
+	}
+
+	return data, nil
+}
+
+// exportPages reads the tables of the export page by page
+func exportPages(ctx context.Context, q queries, data *Export) error {
+	for params := (db.ListPhysiciansParams{Limit: exportPageSize}); ; {
+		physicians, err := q.ListPhysicians(ctx, params)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve physicians: %v", err)
+		}
+		data.Physicians = append(data.Physicians, physicians...)
+		if len(physicians) < exportPageSize {
+			break
+		}
+		params.ID = physicians[len(physicians)-1].ID
+	}
+
+	for params := (db.ListPatientsParams{SortBy: db.PatientSortLastName, Limit: exportPageSize}); ; {
+		patients, err := q.ListPatients(ctx, params)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve patients: %v", err)
+		}
+		data.Patients = append(data.Patients, patients...)
+		if len(patients) < exportPageSize {
+			break
+		}
+		last := patients[len(patients)-1]
+		params.AfterKey = db.PatientSortKey(last, params.SortBy)
+		params.AfterID = last.ID
+	}
+
+	for params := (db.ListIdentifiersParams{Limit: exportPageSize}); ; {
+		identifiers, err := q.ListIdentifiers(ctx, params)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve patient identifiers: %v", err)
+		}
+		data.Identifiers = append(data.Identifiers, identifiers...)
+		if len(identifiers) < exportPageSize {
+			break
+		}
+		params.ID = identifiers[len(identifiers)-1].ID
+	}
+
+	for params := (db.ListVisitsParams{Limit: exportPageSize}); ; {
+		visits, err := q.ListVisits(ctx, params)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve visits: %v", err)
+		}
+		data.Visits = append(data.Visits, visits...)
+		if len(visits) < exportPageSize {
+			break
+		}
+		last := visits[len(visits)-1]
+		params.VisitedAt = last.VisitedAt
+		params.ID = last.ID
+	}
+
+	return nil
+}
+
+// Import adds the physicians, patients, identifiers and visits from an export
+// to the database in a single transaction. They get new IDs and creation
+// times, but the identifiers and visits keep pointing to the same physicians
+// and patients. The patients keep their MRNs and the ones without an MRN get
+// one from the allocator.
+func (s Server) Import(ctx context.Context, data Export) error {
+	return s.database.ExecTx(ctx, func(q queries) error {
+		physicianIDs := make(map[int32]int32, len(data.Physicians))
+		for _, physician := range data.Physicians {
+			added, err := q.AddPhysician(ctx, db.AddPhysicianParams{
+				FirstName: physician.FirstName,
+				LastName:  physician.LastName,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to import physician %d: %v", physician.ID, err)
+			}
+			physicianIDs[physician.ID] = added.ID
+		}
+
+		patientIDs := make(map[int32]int32, len(data.Patients))
+		for _, patient := range data.Patients {
+			mrn := patient.MRN
+			if mrn == "" {
+				var err error
+				if mrn, err = s.mrns.allocate(ctx, q, ""); err != nil {
+					return fmt.Errorf("failed to allocate MRN for patient %d: %v", patient.ID, err)
+				}
+			}
+
+			added, err := q.AddPatient(ctx, db.AddPatientParams{
+				FirstName:   patient.FirstName,
+				LastName:    patient.LastName,
+				Address:     patient.Address,
+				Phone:       patient.Phone,
+				Email:       patient.Email,
+				DateOfBirth: patient.DateOfBirth,
+				MRN:         mrn,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to import patient %d: %v", patient.ID, err)
+			}
+			patientIDs[patient.ID] = added.ID
+		}
+
+		for _, identifier := range data.Identifiers {
+			patientID, ok := patientIDs[identifier.PatientID]
+			if !ok {
+				return fmt.Errorf("identifier %d refers to unknown patient %d", identifier.ID, identifier.PatientID)
+			}
+
+			_, err := q.AddPatientIdentifier(ctx, db.AddPatientIdentifierParams{
+				PatientID: patientID,
+				System:    identifier.System,
+				Value:     identifier.Value,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to import identifier %d: %v", identifier.ID, err)
+			}
+		}
+
+		for _, visit := range data.Visits {
+			physicianID, ok := physicianIDs[visit.PhysicianID]
+			if !ok {
+				return fmt.Errorf("visit %d refers to unknown physician %d", visit.ID, visit.PhysicianID)
+			}
+			patientID, ok := patientIDs[visit.PatientID]
+			if !ok {
+				return fmt.Errorf("visit %d refers to unknown patient %d", visit.ID, visit.PatientID)
+			}
+
+			// Cancelled visits are imported as such, since they may overlap
+			// with other visits
+			_, err := q.ImportVisit(ctx, db.ImportVisitParams{
+				PatientID:       patientID,
+				PhysicianID:     physicianID,
+				VisitedAt:       visit.VisitedAt,
+				DurationMinutes: visit.DurationMinutes,
+				Location:        visit.Location,
+				Reason:          visit.Reason,
+				CancelledAt:     visit.CancelledAt,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to import visit %d: %v", visit.ID, err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Export(t *testing.T) {
+	Convey("Export and import test", t, func() {
+		c := config.Config{
+			HTTPJWTSigningKey: "deadbeef",
+		}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		ctx := context.Background()
+		queries := &mockQueries{}
+		s := newTestServer(c, queries)
+
+		Convey("Seed should", func() {
+			Convey("fill an empty database", func() {
+				seeded, err := s.Seed(ctx)
+				So(err, ShouldBeNil)
+				So(seeded, ShouldBeTrue)
+				So(queries.Physicians, ShouldHaveLength, 2)
+				So(queries.Patients, ShouldHaveLength, 3)
+				So(queries.Visits, ShouldHaveLength, 3)
+				So(queries.Visits[0].VisitedAt, ShouldEqual, time.Date(2020, 4, 18, 9, 0, 0, 0, time.UTC))
+				So(queries.Patients[2].MRN, ShouldEqual, "MRN00000003")
+				So(queries.Patients[2].DateOfBirth.String(), ShouldEqual, "1955-10-20")
+			})
+
+			Convey("leave other databases alone", func() {
+				queries.Physicians = []db.Physician{{ID: 1}}
+				seeded, err := s.Seed(ctx)
+				So(err, ShouldBeNil)
+				So(seeded, ShouldBeFalse)
+				So(queries.Patients, ShouldBeEmpty)
+			})
+		})
+
+		Convey("Import should", func() {
+			_, err := s.Seed(ctx)
+			So(err, ShouldBeNil)
+			queries.Visits[1].CancelledAt = sql.NullTime{Time: jwt.TimeFunc(), Valid: true}
+			queries.Identifiers = []db.PatientIdentifier{{ID: 1, PatientID: 2, System: "https://shire.example/ids", Value: "F-1368"}}
+
+			data, err := s.Export(ctx)
+			So(err, ShouldBeNil)
+			So(data.Visits, ShouldHaveLength, 3)
+			So(queries.ReadTxs, ShouldEqual, 1)
+
+			target := &mockQueries{
+				Physicians: []db.Physician{{ID: 1, FirstName: "Elrond", LastName: "Halfelven"}},
+			}
+
+			Convey("point the visits to the new IDs", func() {
+				So(newTestServer(c, target).Import(ctx, data), ShouldBeNil)
+				So(target.Physicians, ShouldHaveLength, 3)
+				So(target.Visits, ShouldHaveLength, 3)
+
+				So(target.Visits[2].PhysicianID, ShouldEqual, 3)
+				So(target.Visits[2].PatientID, ShouldEqual, 3)
+				So(target.Visits[2].Reason, ShouldEqual, "Vaccination")
+				So(target.Visits[1].CancelledAt.Valid, ShouldBeTrue)
+			})
+
+			Convey("keep the MRNs and point the identifiers to the new patient IDs", func() {
+				target.Patients = []db.Patient{{ID: 1, FirstName: "Arwen", LastName: "Undomiel", MRN: "MRN00000042"}}
+				So(newTestServer(c, target).Import(ctx, data), ShouldBeNil)
+				So(target.Patients, ShouldHaveLength, 4)
+				So(target.Patients[1].MRN, ShouldEqual, "MRN00000001")
+				So(target.Identifiers, ShouldResemble, []db.PatientIdentifier{{ID: 1, PatientID: 3, System: "https://shire.example/ids", Value: "F-1368"}})
+			})
+
+			Convey("reject visits of unknown physicians", func() {
+				data.Visits[0].PhysicianID = 42
+				So(newTestServer(c, target).Import(ctx, data), ShouldNotBeNil)
+			})
+		})
+	})
+}
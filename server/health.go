@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Health statuses
+const (
+	healthUp   = "up"
+	healthDown = "down"
+)
+
+// healthState tracks the lifecycle of the server, which decides if it can serve
+// requests regardless of the state of its dependencies
+type healthState struct {
+	connected    int32
+	shuttingDown int32
+	// latestMigration is the version of the newest migration known to this
+	// build, which the database needs to have been migrated to
+	latestMigration int64
+}
+
+func newHealthState(latestMigration int64) *healthState {
+	return &healthState{latestMigration: latestMigration}
+}
+
+// setConnected marks the end of the start-up, once ConnectDatabase returns
+func (h *healthState) setConnected() {
+	atomic.StoreInt32(&h.connected, 1)
+}
+
+// setShuttingDown marks the start of the shutdown, so load balancers stop
+// routing requests to the server during the drain delay, before it stops
+// accepting them
+func (h *healthState) setShuttingDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+func (h *healthState) isConnected() bool {
+	return atomic.LoadInt32(&h.connected) == 1
+}
+
+func (h *healthState) isShuttingDown() bool {
+	return atomic.LoadInt32(&h.shuttingDown) == 1
+}
+
+// componentHealth is the result of checking one dependency
+type componentHealth struct {
+	Status     string                 `json:"status"`
+	DurationMS float64                `json:"duration_ms"`
+	Error      string                 `json:"error,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+type probePayload struct {
+	Status     string                     `json:"status"`
+	Version    string                     `json:"version,omitempty"`
+	BuildDate  string                     `json:"build_date,omitempty"`
+	Message    string                     `json:"message,omitempty"`
+	Components map[string]componentHealth `json:"components,omitempty"`
+}
+
+// timeComponent runs a health check and records how long it took
+func timeComponent(check func() componentHealth) componentHealth {
+	start := time.Now()
+	result := check()
+	result.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+
+	return result
+}
+
+// The readiness probe isn't authenticated, so the health checks only report
+// generic errors and log the actual ones
+func (s Server) checkDatabase(ctx context.Context) componentHealth {
+	if err := s.pingDatabase(ctx); err != nil {
+		log.WithContext(ctx).Warnf("Failed to ping the database: %v", err)
+		return componentHealth{Status: healthDown, Error: "the database can't be reached"}
+	}
+
+	return componentHealth{Status: healthUp}
+}
+
+func (s Server) checkMigrations(ctx context.Context) componentHealth {
+	version, err := s.database.GetSchemaVersion(ctx)
+	if err != nil {
+		log.WithContext(ctx).Warnf("Failed to retrieve the schema version from the database: %v", err)
+		return componentHealth{Status: healthDown, Error: "the schema version can't be read"}
+	}
+
+	result := componentHealth{
+		Status: healthUp,
+		Details: map[string]interface{}{
+			"applied_version":  version,
+			"expected_version": s.health.latestMigration,
+		},
+	}
+	// Newer instances may have migrated the database already during a rolling
+	// deployment, so only a database which is behind is a problem
+	if version < s.health.latestMigration {
+		result.Status = healthDown
+		result.Error = "the database has pending migrations"
+	}
+
+	return result
+}
+
+func (s Server) checkPool() componentHealth {
+	stats := s.databaseConn.Stats()
+
+	result := componentHealth{
+		Status: healthUp,
+		Details: map[string]interface{}{
+			"open_connections":     stats.OpenConnections,
+			"in_use":               stats.InUse,
+			"idle":                 stats.Idle,
+			"max_open_connections": stats.MaxOpenConnections,
+			"wait_count":           stats.WaitCount,
+			"wait_duration_ms":     stats.WaitDuration.Milliseconds(),
+		},
+	}
+	// New queries have to wait for a connection to be released
+	if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections {
+		result.Status = healthDown
+		result.Error = "all the connections are in use"
+	}
+
+	return result
+}
+
+// livenessHandler reports that the process is running. It doesn't check any
+// dependencies, so the server doesn't get restarted when the database is down.
+func (s Server) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	payload := probePayload{
+		Status:    healthUp,
+		Version:   s.config.Version,
+		BuildDate: s.config.BuildDate,
+	}
+
+	jsonData, err := marshalJSON(r.Context(), payload)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise liveness payload to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+// readinessHandler reports if the server can serve requests, along with the
+// status of each dependency
+func (s Server) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	payload := probePayload{
+		Status:    healthUp,
+		Version:   s.config.Version,
+		BuildDate: s.config.BuildDate,
+	}
+
+	switch {
+	case s.health.isShuttingDown():
+		payload.Status = healthDown
+		payload.Message = "The server is shutting down"
+	case !s.health.isConnected():
+		payload.Status = healthDown
+		payload.Message = "The server is connecting to the database"
+	default:
+		ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+		defer done()
+
+		payload.Components = map[string]componentHealth{
+			"database":   timeComponent(func() componentHealth { return s.checkDatabase(ctx) }),
+			"migrations": timeComponent(func() componentHealth { return s.checkMigrations(ctx) }),
+			"pool":       timeComponent(s.checkPool),
+		}
+		for _, component := range payload.Components {
+			if component.Status != healthUp {
+				payload.Status = healthDown
+			}
+		}
+	}
+
+	jsonData, err := marshalJSON(r.Context(), payload)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise readiness payload to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	if payload.Status != healthUp {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, string(jsonData))
+}
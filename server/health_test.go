@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mihaitodor/ferrum/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Health(t *testing.T) {
+	Convey("Health probes test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+			Version:            "1.0.0",
+		}
+
+		dbConn := &mockDBConn{stats: sql.DBStats{MaxOpenConnections: 10, OpenConnections: 2, InUse: 1, Idle: 1}}
+		queries := &mockQueries{SchemaVersion: 1}
+
+		s := newTestServer(c, queries)
+		s.databaseConn = dbConn
+		s.health = newHealthState(1)
+		s.health.setConnected()
+
+		probe := func(url string) (*httptest.ResponseRecorder, probePayload) {
+			w := httptest.NewRecorder()
+			s.getHTTPRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+
+			var payload probePayload
+			So(json.NewDecoder(w.Body).Decode(&payload), ShouldBeNil)
+			return w, payload
+		}
+
+		Convey("the liveness probe should", func() {
+			Convey("not check the dependencies", func() {
+				dbConn.failPing = true
+				resp, payload := probe("http://example.com/health/live")
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(payload.Status, ShouldEqual, healthUp)
+				So(payload.Version, ShouldEqual, "1.0.0")
+				So(payload.Components, ShouldBeEmpty)
+			})
+		})
+
+		Convey("the readiness probe should", func() {
+			Convey("report each component", func() {
+				resp, payload := probe("http://example.com/health/ready")
+				So(resp.Code, ShouldEqual, http.StatusOK)
+				So(payload.Status, ShouldEqual, healthUp)
+				So(payload.Components, ShouldHaveLength, 3)
+				for _, name := range []string{"database", "migrations", "pool"} {
+					So(payload.Components[name].Status, ShouldEqual, healthUp)
+				}
+				So(payload.Components["migrations"].Details["applied_version"], ShouldEqual, 1)
+				So(payload.Components["pool"].Details["in_use"], ShouldEqual, 1)
+			})
+
+			Convey("fail when the database is down", func() {
+				dbConn.failPing = true
+				resp, payload := probe("http://example.com/health/ready")
+				So(resp.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(payload.Status, ShouldEqual, healthDown)
+				So(payload.Components["database"].Status, ShouldEqual, healthDown)
+				So(payload.Components["database"].Error, ShouldEqual, "the database can't be reached")
+			})
+
+			Convey("fail when there are pending migrations", func() {
+				queries.SchemaVersion = 0
+				resp, payload := probe("http://example.com/health/ready")
+				So(resp.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(payload.Components["migrations"].Status, ShouldEqual, healthDown)
+			})
+
+			Convey("tolerate migrations from newer builds", func() {
+				queries.SchemaVersion = 2
+				resp, _ := probe("http://example.com/health/ready")
+				So(resp.Code, ShouldEqual, http.StatusOK)
+			})
+
+			Convey("fail when the schema version can't be read", func() {
+				queries.Err = errors.New("relation \"schema_migrations\" does not exist")
+				resp, payload := probe("http://example.com/health/ready")
+				So(resp.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(payload.Components["migrations"].Error, ShouldEqual, "the schema version can't be read")
+			})
+
+			Convey("fail when the connection pool is saturated", func() {
+				dbConn.stats.InUse = 10
+				resp, payload := probe("http://example.com/health/ready")
+				So(resp.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(payload.Components["pool"].Status, ShouldEqual, healthDown)
+			})
+
+			Convey("fail while connecting to the database", func() {
+				s.health = newHealthState(1)
+				resp, payload := probe("http://example.com/health/ready")
+				So(resp.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(payload.Message, ShouldEqual, "The server is connecting to the database")
+				So(payload.Components, ShouldBeEmpty)
+			})
+
+			Convey("fail while shutting down", func() {
+				s.health.setShuttingDown()
+				resp, payload := probe("http://example.com/health/ready")
+				So(resp.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(payload.Message, ShouldEqual, "The server is shutting down")
+			})
+		})
+
+		Convey("only the health probes should answer before the database is connected", func() {
+			s.health = newHealthState(1)
+			resp, _ := probe("http://example.com/health/live")
+			So(resp.Code, ShouldEqual, http.StatusOK)
+
+			for url, method := range map[string]string{
+				"http://example.com/api/v1/patients/123": http.MethodGet,
+				"http://example.com/auth/login":          http.MethodPost,
+			} {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(method, url, nil)
+				req.Header.Set("Authorization", "Bearer "+dummyJWTToken)
+				s.getHTTPRouter().ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(w.Header().Get("Content-Type"), ShouldEqual, "application/problem+json")
+				So(w.Header().Get("Retry-After"), ShouldEqual, "1")
+			}
+			So(queries.AuditEntries, ShouldBeEmpty)
+		})
+
+		Convey("Shutdown should keep serving requests during the drain delay", func() {
+			s.config.HTTPShutdownDrainDelay = 500 * time.Millisecond
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			s.httpServer = &http.Server{Handler: s.getHTTPRouter()}
+			go s.httpServer.Serve(listener)
+			url := "http://" + listener.Addr().String() + "/health/ready"
+
+			shutdown := make(chan error)
+			go func() { shutdown <- s.Shutdown(context.Background()) }()
+			for !s.health.isShuttingDown() {
+				time.Sleep(time.Millisecond)
+			}
+
+			// Load balancers see that the server isn't ready, while it still
+			// accepts requests
+			resp, err := http.Get(url)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+
+			So(<-shutdown, ShouldBeNil)
+			_, err = http.Get(url)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -4,14 +4,22 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/mihaitodor/ferrum/db"
+	"github.com/mihaitodor/ferrum/db/date"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -21,28 +29,121 @@ type healthPayload struct {
 	Message   string `json:"message,omitempty"`
 }
 
+// patientPayload is the body of the requests which create or replace patients
+type patientPayload struct {
+	FirstName string `json:"first_name" validate:"required,max=100"`
+	LastName  string `json:"last_name" validate:"required,max=100"`
+	Address   string `json:"address" validate:"max=500"`
+	Phone     string `json:"phone" validate:"phone"`
+	Email     string `json:"email" validate:"email,max=254"`
+	// DateOfBirth is optional, since the patients registered before it was
+	// added don't have one. It's cleared with an empty string.
+	DateOfBirth string `json:"date_of_birth" validate:"date,past"`
+	// MRN is only read when patients are created, since it can't be changed.
+	// Updates which send a different one are rejected with errMRNChanged.
+	MRN string `json:"mrn" validate:"max=64"`
+}
+
+// errMRNChanged is reported for updates which try to change the MRN
+var errMRNChanged = &validationError{fields: []fieldError{{Field: "mrn", Message: "can't be changed"}}}
+
+// dateOfBirth parses DateOfBirth, which has already been validated
+func (p patientPayload) dateOfBirth() date.NullDate {
+	dateOfBirth, _ := date.Parse(p.DateOfBirth)
+	return dateOfBirth
+}
+
+func (p patientPayload) addParams(mrn string) db.AddPatientParams {
+	return db.AddPatientParams{
+		FirstName:   p.FirstName,
+		LastName:    p.LastName,
+		Address:     p.Address,
+		Phone:       p.Phone,
+		Email:       p.Email,
+		DateOfBirth: p.dateOfBirth(),
+		MRN:         mrn,
+	}
+}
+
+func (p patientPayload) updateParams(id int32) db.UpdatePatientParams {
+	return db.UpdatePatientParams{
+		ID:          id,
+		FirstName:   p.FirstName,
+		LastName:    p.LastName,
+		Address:     p.Address,
+		Phone:       p.Phone,
+		Email:       p.Email,
+		DateOfBirth: p.dateOfBirth(),
+	}
+}
+
 type tokenPayload struct {
-	Token string `json:"token,omitempty"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
-func (s Server) getHTTPRouter() *mux.Router {
+func (s Server) getHTTPRouter() http.Handler {
 	router := mux.NewRouter()
 	router.Use(commonMiddleware)
+	router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
 
 	router.HandleFunc("/health", s.healthHandler).Methods(http.MethodGet)
-	router.HandleFunc("/generate-token", s.generateToken).Methods("GET")
+	router.HandleFunc("/health/live", s.livenessHandler).Methods(http.MethodGet)
+	router.HandleFunc("/health/ready", s.readinessHandler).Methods(http.MethodGet)
+	router.Handle("/metrics", s.metrics.handler()).Methods(http.MethodGet)
+	// The keyring checks the signing method, since it depends on the key
+	validationKeyGetter, roles := jwt.Keyfunc(s.keys.validationKey), localRoles
+	// Only the health probes answer until the database is connected and migrated
+	authRouter := router.PathPrefix("/auth").Subrouter()
+	authRouter.Use(s.requireConnected)
+	if s.oidc != nil {
+		// Users log in with the identity provider, so Ferrum doesn't issue any
+		// tokens itself
+		validationKeyGetter, roles = s.oidc.validationKey, s.oidc.roles
+	} else {
+		authRouter.HandleFunc("/login", s.loginHandler).Methods(http.MethodPost)
+		authRouter.HandleFunc("/refresh", s.refreshHandler).Methods(http.MethodPost)
+		if s.config.DevMode {
+			// Hands out tokens to anyone who asks, so it's only meant for local testing
+			router.HandleFunc("/generate-token", s.generateToken).Methods("GET")
+		}
+
+		router.HandleFunc("/.well-known/jwks.json", s.jwksHandler).Methods(http.MethodGet)
+	}
 
 	authMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			return []byte(s.config.HTTPJWTSigningKey), nil
-		},
-		SigningMethod: jwt.SigningMethodHS256,
+		ValidationKeyGetter: validationKeyGetter,
+		ErrorHandler:        s.jwtErrorHandler,
 	})
-	apiRouter := router.PathPrefix("/api/v1").Subrouter()
-	apiRouter.HandleFunc("/patients", corsHandler(jwtHandlerWithNext(authMiddleware, s.patientsHandler))).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
-	apiRouter.HandleFunc("/patients/{id}", jwtHandlerWithNext(authMiddleware, s.patientHandler)).Methods(http.MethodGet)
+	authRouter.HandleFunc("/logout", jwtHandlerWithNext(authMiddleware, s.rejectRevoked(s.logoutHandler))).Methods(http.MethodPost)
 
-	return router
+	apiRouter := router.PathPrefix("/api/v1").Subrouter()
+	apiRouter.Use(s.requireConnected)
+	// Every API request is audited, including the ones which aren't authorised.
+	// The action is derived from the request method, unless one is given.
+	protect := func(resourceType, action string, p policy, next http.HandlerFunc) http.HandlerFunc {
+		return s.audit(resourceType, action, jwtHandlerWithNext(authMiddleware, s.rejectRevoked(authorize(roles, p, next))))
+	}
+	apiRouter.HandleFunc("/patients", corsHandler(protect("patient", "", patientsPolicy, s.patientsHandler))).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	// The search has to be registered before /patients/{id}, which matches it too
+	apiRouter.HandleFunc("/patients/search", protect("patient", "search", patientsPolicy, s.searchPatientsHandler)).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/patients/{id}", protect("patient", "", patientsPolicy, s.patientHandler)).Methods(http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	apiRouter.HandleFunc("/physicians", protect("physician", "", physiciansPolicy, s.physiciansHandler)).Methods(http.MethodGet, http.MethodPost)
+	apiRouter.HandleFunc("/physicians/{id}", protect("physician", "", physiciansPolicy, s.physicianHandler)).Methods(http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	apiRouter.HandleFunc("/visits", protect("visit", "", visitsPolicy, s.visitsHandler)).Methods(http.MethodGet, http.MethodPost)
+	apiRouter.HandleFunc("/visits/{id}", protect("visit", "", visitsPolicy, s.visitHandler)).Methods(http.MethodGet, http.MethodPatch)
+	apiRouter.HandleFunc("/visits/{id}/cancel", protect("visit", "cancel", visitsPolicy, s.cancelVisitHandler)).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/patients/{id}/duplicates", protect("patient_duplicates", "", patientsPolicy, s.patientDuplicatesHandler)).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/patients/{id}/merge", protect("patient", "merge", mergePolicy, s.mergePatientHandler)).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/patients/{id}/identifiers", protect("patient_identifier", "", patientsPolicy, s.patientIdentifiersHandler)).Methods(http.MethodGet, http.MethodPost)
+	apiRouter.HandleFunc("/patients/{id}/identifiers/{identifier_id}", protect("patient_identifier", "", patientsPolicy, s.patientIdentifierHandler)).Methods(http.MethodDelete)
+	apiRouter.HandleFunc("/patients/{id}/visits", protect("patient_visits", "", visitsPolicy, s.patientVisitsHandler)).Methods(http.MethodGet, http.MethodPost)
+	apiRouter.HandleFunc("/physicians/{id}/visits", protect("physician_visits", "", visitsPolicy, s.physicianVisitsHandler)).Methods(http.MethodGet, http.MethodPost)
+	apiRouter.HandleFunc("/audit", protect("audit", "", auditPolicy, s.auditHandler)).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/audit/verify", protect("audit", "verify", auditPolicy, s.auditVerifyHandler)).Methods(http.MethodGet)
+
+	return traceHTTP(router, s.logRequests(router, s.metrics.instrumentHTTP(router)))
 }
 
 // SetupHTTPHandlers sets up the server HTTP handlers
@@ -50,6 +151,38 @@ func (s Server) SetupHTTPHandlers() {
 	http.Handle("/", s.getHTTPRouter())
 }
 
+// unmatchedRoute stands for the route of requests which don't match any, so
+// scanners probing random paths don't create new metrics or span names
+const unmatchedRoute = "unmatched"
+
+// routeTemplate returns the path template of the route which matches r, such as
+// /api/v1/patients/{id}. Paths can't be used to group requests, since they
+// contain IDs.
+func routeTemplate(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if router.Match(r, &match) && match.Route != nil {
+		if template, err := match.Route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+
+	return unmatchedRoute
+}
+
+// requireConnected answers 503 until ConnectDatabase returns, so requests
+// aren't served against an unreachable or outdated schema during the start-up
+func (s Server) requireConnected(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.health.isConnected() {
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, r, problemUnavailable, "The server is connecting to the database")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func commonMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "application/json")
@@ -80,47 +213,53 @@ func corsHandler(next http.HandlerFunc) http.HandlerFunc {
 
 func jwtHandlerWithNext(authMiddleware *jwtmiddleware.JWTMiddleware, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authMiddleware.HandlerWithNext(w, r, next)
+		authMiddleware.HandlerWithNext(w, r, func(w http.ResponseWriter, r *http.Request) {
+			if token, ok := r.Context().Value("user").(*jwt.Token); ok {
+				subject := principalFromToken(token).Subject
+				setRequestSubject(r.Context(), subject)
+				setAuditSubject(r.Context(), subject)
+			}
+			next(w, r)
+		})
 	}
 }
 
-func (s Server) generateToken(w http.ResponseWriter, _ *http.Request) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"admin": true,
+func (s Server) generateToken(w http.ResponseWriter, r *http.Request) {
+	// Dev tokens don't have a `jti` claim, so they can't be revoked
+	signedToken, err := s.keys.sign(jwt.MapClaims{
+		"roles": []Role{RoleAdmin},
 		"name":  s.config.HTTPJWTVClaimName,
 		"exp":   s.currentTimeFn().Add(s.config.HTTPJWTExpiration).Unix(),
 	})
-
-	signedToken, err := token.SignedString([]byte(s.config.HTTPJWTSigningKey))
 	if err != nil {
-		log.Warnf("Failed to sign the JWT token: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.WithContext(r.Context()).Warnf("Failed to sign the JWT token: %v", err)
+		writeProblem(w, r, problemInternal, "")
 		return
 	}
 
-	jsonData, err := json.Marshal(tokenPayload{Token: signedToken})
+	jsonData, err := marshalJSON(r.Context(), tokenPayload{Token: signedToken})
 	if err != nil {
-		log.Warnf("Failed to serialise JWT token payload to JSON: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.WithContext(r.Context()).Warnf("Failed to serialise JWT token payload to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
 		return
 	}
 
 	fmt.Fprint(w, string(jsonData))
 }
 
-func (s Server) healthHandler(w http.ResponseWriter, _ *http.Request) {
+func (s Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	payload := healthPayload{
 		Version:   s.config.Version,
 		BuildDate: s.config.BuildDate,
 	}
 
-	if err := s.databaseConn.Ping(); err != nil {
+	if err := s.pingDatabase(r.Context()); err != nil {
 		payload.Message = "Error"
 
-		jsonData, err := json.Marshal(payload)
+		jsonData, err := marshalJSON(r.Context(), payload)
 		if err != nil {
-			log.Warnf("Failed to serialise health payload to JSON: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.WithContext(r.Context()).Warnf("Failed to serialise health payload to JSON: %v", err)
+			writeProblem(w, r, problemInternal, "")
 			return
 		}
 
@@ -130,10 +269,10 @@ func (s Server) healthHandler(w http.ResponseWriter, _ *http.Request) {
 	}
 
 	payload.Message = "OK"
-	jsonData, err := json.Marshal(payload)
+	jsonData, err := marshalJSON(r.Context(), payload)
 	if err != nil {
-		log.Warnf("Failed to serialise health payload to JSON: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.WithContext(r.Context()).Warnf("Failed to serialise health payload to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
 		return
 	}
 
@@ -145,33 +284,48 @@ func (s Server) patientsHandler(w http.ResponseWriter, r *http.Request) {
 	defer done()
 
 	if r.Method == http.MethodPost {
-		if r.ContentLength > s.config.HTTPMaxPOSTSize {
-			log.Debugf("Request entity too large: %d bytes", r.ContentLength)
-			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		body, ok := s.readRequestBody(w, r)
+		if !ok {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-
-		var patient db.AddPatientParams
-		if err := decoder.Decode(&patient); err != nil {
-			log.Warnf("Failed to decode new patient data: %v", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		var patient patientPayload
+		if err := decodePayload(body, &patient); err != nil {
+			log.WithContext(r.Context()).Debugf("Rejecting new patient data: %v", err)
+			writeRequestProblem(w, r, err)
 			return
 		}
 
-		patientRecord, err := s.database.AddPatient(ctx, patient)
+		var patientRecord db.Patient
+		err := s.mutate(ctx, func(q queries) (string, int32, error) {
+			mrn, err := s.mrns.allocate(ctx, q, patient.MRN)
+			if err != nil {
+				return "patient", 0, err
+			}
+			patientRecord, err = q.AddPatient(ctx, patient.addParams(mrn))
+			return "patient", patientRecord.ID, err
+		})
 		if err != nil {
-			log.Warnf("Failed to insert patient data into database: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			var validationErr *validationError
+			switch {
+			case errors.As(err, &validationErr):
+				log.WithContext(r.Context()).Debugf("Rejecting new patient MRN: %v", err)
+				writeRequestProblem(w, r, err)
+			case db.IsConstraintViolation(err, db.UniqueViolation, "unique_patient_mrn"):
+				log.WithContext(r.Context()).Warnf("Failed to insert patient data into database: %v", err)
+				writeProblem(w, r, problemDuplicateID, "A patient with the same MRN already exists")
+			default:
+				log.WithContext(r.Context()).Warnf("Failed to insert patient data into database: %v", err)
+				writeProblem(w, r, problemInternal, "")
+			}
 			return
 		}
 
 		// TODO: Write a custom marshaller for sql.NullTime
-		jsonData, err := json.Marshal(patientRecord)
+		jsonData, err := marshalJSON(r.Context(), patientRecord)
 		if err != nil {
-			log.Warnf("Failed to serialise patient data to JSON: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.WithContext(r.Context()).Warnf("Failed to serialise patient data to JSON: %v", err)
+			writeProblem(w, r, problemInternal, "")
 			return
 		}
 
@@ -182,62 +336,365 @@ func (s Server) patientsHandler(w http.ResponseWriter, r *http.Request) {
 
 		fmt.Fprint(w, string(jsonData))
 	} else if r.Method == http.MethodGet {
-		patients, err := s.database.GetPatients(ctx)
+		params, err := parseListPatientsParams(r.URL.Query())
+		if err != nil {
+			log.WithContext(r.Context()).Debugf("Invalid patients query %q: %v", r.URL.RawQuery, err)
+			writeRequestProblem(w, r, err)
+			return
+		}
+
+		// Fetch one extra row to find out if there is a next page
+		pageSize := params.Limit
+		params.Limit++
+
+		patients, err := s.database.ListPatients(ctx, params)
 		if err != nil {
-			log.Warnf("Failed to retrieve patients from the database: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.WithContext(r.Context()).Warnf("Failed to retrieve patients from the database: %v", err)
+			writeProblem(w, r, problemInternal, "")
 			return
 		}
 
-		if patients == nil {
-			patients = []db.Patient{}
+		payload := pagePayload{Data: patients}
+		if int32(len(patients)) > pageSize {
+			patients = patients[:pageSize]
+			payload.Data = patients
+
+			last := patients[len(patients)-1]
+			setNextPage(w, r, &payload, pageCursor{
+				Sort: r.URL.Query().Get("sort"),
+				Key:  db.PatientSortKey(last, params.SortBy),
+				ID:   int64(last.ID),
+			})
+		} else if patients == nil {
+			payload.Data = []db.Patient{}
 		}
 
-		jsonData, err := json.Marshal(patients)
+		jsonData, err := marshalJSON(r.Context(), payload)
 		if err != nil {
-			log.Warnf("Failed to serialise patients to JSON: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.WithContext(r.Context()).Warnf("Failed to serialise patients to JSON: %v", err)
+			writeProblem(w, r, problemInternal, "")
 			return
 		}
 
 		fmt.Fprint(w, string(jsonData))
 	} else {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		methodNotAllowedHandler(w, r)
 	}
 }
 
-func (s Server) patientHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	idString, ok := vars["id"]
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-	}
+// parseListPatientsParams reads the pagination, sorting and filtering query
+// parameters of the patients collection
+func parseListPatientsParams(query url.Values) (db.ListPatientsParams, error) {
+	var params db.ListPatientsParams
 
-	id, err := strconv.ParseInt(idString, 10, 32)
+	limit, err := parsePageLimit(query)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return db.ListPatientsParams{}, err
+	}
+	params.Limit = limit
+
+	sort := query.Get("sort")
+	field := strings.TrimPrefix(sort, "-")
+	switch db.PatientSortField(field) {
+	case "", db.PatientSortLastName:
+		params.SortBy = db.PatientSortLastName
+	case db.PatientSortCreatedAt:
+		params.SortBy = db.PatientSortCreatedAt
+	default:
+		return db.ListPatientsParams{}, badRequest("unsupported sort field %q", field)
+	}
+	params.Descending = strings.HasPrefix(sort, "-")
+
+	if cursorString := query.Get("cursor"); cursorString != "" {
+		cursor, err := decodePageCursor(cursorString)
+		if err != nil {
+			return db.ListPatientsParams{}, err
+		}
+		// Cursors are only meaningful for the sort order they were issued for
+		if cursor.Sort != sort {
+			return db.ListPatientsParams{}, badRequest("cursor doesn't match the requested sort order")
+		}
+		params.AfterKey = cursor.Key
+		params.AfterID = int32(cursor.ID)
+	}
+
+	params.Name = query.Get("name")
+	params.Email = query.Get("email")
+	params.MRN = query.Get("mrn")
+	// Identifiers are written as system|value, like FHIR tokens. The system
+	// is a URI, so it can't contain the separator.
+	if identifier := query.Get("identifier"); identifier != "" {
+		i := strings.Index(identifier, "|")
+		if i <= 0 || i == len(identifier)-1 {
+			return db.ListPatientsParams{}, badRequest("identifier must be formatted as system|value")
+		}
+		params.IdentifierSystem, params.IdentifierValue = identifier[:i], identifier[i+1:]
+	}
+
+	for param, value := range map[string]*sql.NullTime{
+		"created_after":  &params.CreatedAfter,
+		"created_before": &params.CreatedBefore,
+	} {
+		if timeString := query.Get(param); timeString != "" {
+			t, err := time.Parse(time.RFC3339, timeString)
+			if err != nil {
+				return db.ListPatientsParams{}, &requestError{detail: param + " must be an RFC 3339 timestamp", cause: err}
+			}
+			*value = sql.NullTime{Time: t, Valid: true}
+		}
+	}
+
+	return params, nil
+}
+
+func (s Server) patientHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r)
+	if !ok {
+		return
 	}
 
 	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
 	defer done()
 
-	patient, err := s.database.GetPatient(ctx, int32(id))
+	switch r.Method {
+	case http.MethodGet:
+		s.getPatient(ctx, w, r, id)
+	case http.MethodPut:
+		s.replacePatient(ctx, w, r, id)
+	case http.MethodPatch:
+		s.patchPatient(ctx, w, r, id)
+	case http.MethodDelete:
+		s.deletePatient(ctx, w, r, id)
+	default:
+		methodNotAllowedHandler(w, r)
+	}
+}
+
+func (s Server) getPatient(ctx context.Context, w http.ResponseWriter, r *http.Request, id int32) {
+	patient, err := s.database.GetPatient(ctx, id)
 	if err != nil {
-		log.Warnf("Failed to retrieve patient %d data from the database: %v", id, err)
+		log.WithContext(r.Context()).Warnf("Failed to retrieve patient %d data from the database: %v", id, err)
 		if err == sql.ErrNoRows {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			writeProblem(w, r, problemNotFound, "")
 		} else {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			writeProblem(w, r, problemInternal, "")
 		}
 		return
 	}
 
-	jsonData, err := json.Marshal(patient)
+	jsonData, err := marshalJSON(r.Context(), patient)
 	if err != nil {
-		log.Warnf("Failed to serialise patient data to JSON: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.WithContext(r.Context()).Warnf("Failed to serialise patient data to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
 		return
 	}
 
 	fmt.Fprint(w, string(jsonData))
 }
+
+// replacePatient implements PUT semantics: the request body must contain the
+// full patient record, which replaces the stored one
+func (s Server) replacePatient(ctx context.Context, w http.ResponseWriter, r *http.Request, id int32) {
+	body, ok := s.readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	var patient patientPayload
+	if err := decodePayload(body, &patient); err != nil {
+		log.WithContext(r.Context()).Debugf("Rejecting patient %d data: %v", id, err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	// The ID from the URL always wins over whatever the body contains.
+	// Records can be sent back as they were read, but their MRN can't change.
+	s.updatePatient(ctx, w, r, id, func(current db.Patient) (db.UpdatePatientParams, error) {
+		if patient.MRN != "" && patient.MRN != current.MRN {
+			return db.UpdatePatientParams{}, errMRNChanged
+		}
+		return patient.updateParams(current.ID), nil
+	})
+}
+
+// patchPatient implements JSON Merge Patch (RFC 7396) semantics on top of the
+// stored patient record
+func (s Server) patchPatient(ctx context.Context, w http.ResponseWriter, r *http.Request, id int32) {
+	body, ok := s.readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	if err := checkMergePatch(body); err != nil {
+		log.WithContext(r.Context()).Debugf("Rejecting merge patch for patient %d: %v", id, err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	s.updatePatient(ctx, w, r, id, func(current db.Patient) (db.UpdatePatientParams, error) {
+		patient := patientPayload{
+			FirstName:   current.FirstName,
+			LastName:    current.LastName,
+			Address:     current.Address,
+			Phone:       current.Phone,
+			Email:       current.Email,
+			DateOfBirth: current.DateOfBirth.String(),
+			MRN:         current.MRN,
+		}
+		if err := decodePatch(body, &patient); err != nil {
+			return db.UpdatePatientParams{}, err
+		}
+		if patient.MRN != current.MRN {
+			return db.UpdatePatientParams{}, errMRNChanged
+		}
+
+		return patient.updateParams(current.ID), nil
+	})
+}
+
+// updatePatient locks the stored patient record, so concurrent updates can't
+// overwrite each other, and replaces it with the record which update builds
+// from it, in the same transaction. Errors of update are request problems.
+func (s Server) updatePatient(ctx context.Context, w http.ResponseWriter, r *http.Request, id int32, update func(current db.Patient) (db.UpdatePatientParams, error)) {
+	var (
+		patientRecord db.Patient
+		requestErr    error
+	)
+	err := s.mutate(ctx, func(q queries) (string, int32, error) {
+		current, err := q.GetPatientForUpdate(ctx, id)
+		if err != nil {
+			return "patient", id, err
+		}
+
+		params, err := update(current)
+		if err != nil {
+			requestErr = err
+			return "patient", id, err
+		}
+
+		patientRecord, err = q.UpdatePatient(ctx, params)
+		return "patient", id, err
+	})
+	if requestErr != nil {
+		log.WithContext(r.Context()).Debugf("Rejecting patient %d data: %v", id, requestErr)
+		writeRequestProblem(w, r, requestErr)
+		return
+	}
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to update patient %d data in the database: %v", id, err)
+		switch {
+		case err == sql.ErrNoRows:
+			writeProblem(w, r, problemNotFound, "")
+		default:
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	jsonData, err := marshalJSON(r.Context(), patientRecord)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise patient data to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+func (s Server) deletePatient(ctx context.Context, w http.ResponseWriter, r *http.Request, id int32) {
+	err := s.mutate(ctx, func(q queries) (string, int32, error) {
+		_, err := q.DeletePatient(ctx, id)
+		return "patient", id, err
+	})
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to delete patient %d from the database: %v", id, err)
+		switch {
+		case err == sql.ErrNoRows:
+			writeProblem(w, r, problemNotFound, "")
+		case db.IsConstraintViolation(err, db.ForeignKeyViolation, ""):
+			writeProblem(w, r, problemResourceInUse, "The patient still has visits")
+		default:
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseIDVar reads the numeric resource ID from the request URL
+func parseIDVar(w http.ResponseWriter, r *http.Request) (int32, bool) {
+	return parseNumericVar(w, r, "id", "resource ID")
+}
+
+// parseNumericVar reads a numeric ID from the request URL, such as the ID of a
+// nested resource. description names it in the error responses.
+func parseNumericVar(w http.ResponseWriter, r *http.Request, name, description string) (int32, bool) {
+	vars := mux.Vars(r)
+	idString, ok := vars[name]
+	if !ok {
+		writeProblem(w, r, problemBadRequest, fmt.Sprintf("The %s is missing", description))
+		return 0, false
+	}
+
+	id, err := strconv.ParseInt(idString, 10, 32)
+	if err != nil {
+		writeProblem(w, r, problemBadRequest, fmt.Sprintf("The %s must be an integer", description))
+		return 0, false
+	}
+
+	return int32(id), true
+}
+
+// checkMergePatch makes sure that a JSON Merge Patch (RFC 7396) body is an
+// object which can be applied on top of a stored record. Since all the columns
+// are NOT NULL, fields can't be removed and the server-managed ones can't be
+// changed at all.
+func checkMergePatch(body []byte) error {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return err
+	}
+
+	var fields []fieldError
+	for field, value := range patch {
+		switch {
+		case readOnlyFields[field]:
+			fields = append(fields, fieldError{Field: field, Message: "is read-only"})
+		case string(value) == "null":
+			fields = append(fields, fieldError{Field: field, Message: "can't be removed"})
+		}
+	}
+	if len(fields) > 0 {
+		sort.Slice(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+		return &validationError{fields: fields}
+	}
+
+	return nil
+}
+
+// readRequestBody reads the whole request body, rejecting it if it's larger
+// than HTTPMaxPOSTSize
+func (s Server) readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.ContentLength > s.config.HTTPMaxPOSTSize {
+		log.WithContext(r.Context()).Debugf("Request entity too large: %d bytes", r.ContentLength)
+		writeProblem(w, r, problemTooLarge, fmt.Sprintf("The request body must not be larger than %d bytes", s.config.HTTPMaxPOSTSize))
+		return nil, false
+	}
+
+	// Chunked requests don't set the Content-Length, so enforce the limit
+	// while reading as well
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.config.HTTPMaxPOSTSize+1))
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to read request body: %v", err)
+		writeProblem(w, r, problemBadRequest, "Failed to read the request body")
+		return nil, false
+	}
+	if int64(len(body)) > s.config.HTTPMaxPOSTSize {
+		log.WithContext(r.Context()).Debugf("Request entity too large: more than %d bytes", s.config.HTTPMaxPOSTSize)
+		writeProblem(w, r, problemTooLarge, fmt.Sprintf("The request body must not be larger than %d bytes", s.config.HTTPMaxPOSTSize))
+		return nil, false
+	}
+
+	return body, true
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// identifierPayload is the body of the requests which add external identifiers
+// to patients
+type identifierPayload struct {
+	// System is a URI which tells who issued the value, such as the national
+	// health service
+	System string `json:"system" validate:"required,uri,max=255"`
+	Value  string `json:"value" validate:"required,max=255"`
+}
+
+// patientIdentifiersHandler lists and adds the external identifiers of the
+// patient in the URL
+func (s Server) patientIdentifiersHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	if r.Method == http.MethodPost {
+		s.addPatientIdentifier(ctx, w, r, id)
+		return
+	}
+
+	// Patients without identifiers have to be told apart from missing ones
+	if _, err := s.database.GetPatient(ctx, id); err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to retrieve patient %d data from the database: %v", id, err)
+		if err == sql.ErrNoRows {
+			writeProblem(w, r, problemNotFound, "")
+		} else {
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	identifiers, err := s.database.ListPatientIdentifiers(ctx, id)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to retrieve identifiers of patient %d from the database: %v", id, err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+	if identifiers == nil {
+		identifiers = []db.PatientIdentifier{}
+	}
+
+	jsonData, err := marshalJSON(r.Context(), pagePayload{Data: identifiers})
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise patient identifiers to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+func (s Server) addPatientIdentifier(ctx context.Context, w http.ResponseWriter, r *http.Request, patientID int32) {
+	body, ok := s.readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	var payload identifierPayload
+	if err := decodePayload(body, &payload); err != nil {
+		log.WithContext(r.Context()).Debugf("Rejecting new identifier of patient %d: %v", patientID, err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	var identifier db.PatientIdentifier
+	err := s.mutate(ctx, func(q queries) (string, int32, error) {
+		var err error
+		identifier, err = q.AddPatientIdentifier(ctx, db.AddPatientIdentifierParams{
+			PatientID: patientID,
+			System:    payload.System,
+			Value:     payload.Value,
+		})
+		return "patient_identifier", identifier.ID, err
+	})
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to insert identifier of patient %d into database: %v", patientID, err)
+		switch {
+		case db.IsConstraintViolation(err, db.ForeignKeyViolation, ""):
+			writeProblem(w, r, problemNotFound, "")
+		case db.IsConstraintViolation(err, db.UniqueViolation, "unique_patient_identifier"):
+			writeProblem(w, r, problemDuplicateID, "A patient with the same identifier already exists")
+		default:
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	jsonData, err := marshalJSON(r.Context(), identifier)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise patient identifier to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, string(jsonData))
+}
+
+// patientIdentifierHandler removes an external identifier from the patient in
+// the URL
+func (s Server) patientIdentifierHandler(w http.ResponseWriter, r *http.Request) {
+	patientID, ok := parseIDVar(w, r)
+	if !ok {
+		return
+	}
+	id, ok := parseNumericVar(w, r, "identifier_id", "identifier ID")
+	if !ok {
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	err := s.mutate(ctx, func(q queries) (string, int32, error) {
+		_, err := q.DeletePatientIdentifier(ctx, db.DeletePatientIdentifierParams{ID: id, PatientID: patientID})
+		return "patient_identifier", id, err
+	})
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to delete identifier %d of patient %d from the database: %v", id, patientID, err)
+		if err == sql.ErrNoRows {
+			writeProblem(w, r, problemNotFound, "")
+		} else {
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_PatientIdentifiers(t *testing.T) {
+	Convey("Patient identifiers test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+		}
+
+		queries := &mockQueries{
+			Patients: []db.Patient{{ID: 1, FirstName: "Bilbo", LastName: "Baggins", MRN: "MRN00000001"}},
+			Identifiers: []db.PatientIdentifier{
+				{ID: 1, PatientID: 1, System: "https://shire.example/ids", Value: "B-1290"},
+			},
+		}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+
+		serve := func(role Role, method, url string, body []byte) *httptest.ResponseRecorder {
+			token, err := s.issueToken("bilbo", role)
+			So(err, ShouldBeNil)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("the identifiers of a patient should be listed", func() {
+			resp := serve(RoleAuditor, http.MethodGet, "http://example.com/api/v1/patients/1/identifiers", nil)
+			So(resp.Code, ShouldEqual, http.StatusOK)
+
+			var page struct {
+				Data []db.PatientIdentifier `json:"data"`
+			}
+			So(json.NewDecoder(resp.Body).Decode(&page), ShouldBeNil)
+			So(page.Data, ShouldResemble, queries.Identifiers)
+		})
+
+		Convey("adding identifiers should", func() {
+			Convey("return the new identifier", func() {
+				resp := serve(RoleReceptionist, http.MethodPost, "http://example.com/api/v1/patients/1/identifiers",
+					[]byte(`{"system":"urn:oid:2.16.840.1.113883.4.1","value":"123-45-6789"}`))
+				So(resp.Code, ShouldEqual, http.StatusCreated)
+				So(queries.Identifiers, ShouldHaveLength, 2)
+				So(queries.Identifiers[1].PatientID, ShouldEqual, 1)
+				So(queries.AuditEntries, ShouldHaveLength, 1)
+				So(queries.AuditEntries[0].ResourceType, ShouldEqual, "patient_identifier")
+				So(queries.AuditEntries[0].ResourceID, ShouldEqual, "2")
+			})
+
+			Convey("reject systems which aren't URIs", func() {
+				resp := serve(RoleReceptionist, http.MethodPost, "http://example.com/api/v1/patients/1/identifiers",
+					[]byte(`{"system":"NHS","value":"943 476 5919"}`))
+				So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+				So(resp.Body.String(), ShouldContainSubstring, "must be an absolute URI")
+			})
+
+			Convey("return conflict if another patient has the identifier", func() {
+				queries.Err = &pq.Error{Code: db.UniqueViolation, Constraint: "unique_patient_identifier"}
+				resp := serve(RoleReceptionist, http.MethodPost, "http://example.com/api/v1/patients/1/identifiers",
+					[]byte(`{"system":"https://shire.example/ids","value":"B-1290"}`))
+				So(resp.Code, ShouldEqual, http.StatusConflict)
+				So(resp.Body.String(), ShouldContainSubstring, "urn:ferrum:problem:duplicate-identifier")
+			})
+
+			Convey("return not found for unknown patients", func() {
+				queries.Err = &pq.Error{Code: db.ForeignKeyViolation, Constraint: "patient_identifier_patient_id_fkey"}
+				resp := serve(RoleReceptionist, http.MethodPost, "http://example.com/api/v1/patients/42/identifiers",
+					[]byte(`{"system":"https://shire.example/ids","value":"F-1368"}`))
+				So(resp.Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey("deleting identifiers should", func() {
+			Convey("only be allowed for admins", func() {
+				resp := serve(RoleReceptionist, http.MethodDelete, "http://example.com/api/v1/patients/1/identifiers/1", nil)
+				So(resp.Code, ShouldEqual, http.StatusForbidden)
+			})
+
+			Convey("remove the identifier", func() {
+				resp := serve(RoleAdmin, http.MethodDelete, "http://example.com/api/v1/patients/1/identifiers/1", nil)
+				So(resp.Code, ShouldEqual, http.StatusNoContent)
+				So(queries.Identifiers, ShouldBeEmpty)
+			})
+
+			Convey("return not found for identifiers of other patients", func() {
+				resp := serve(RoleAdmin, http.MethodDelete, "http://example.com/api/v1/patients/2/identifiers/1", nil)
+				So(resp.Code, ShouldEqual, http.StatusNotFound)
+				So(queries.Identifiers, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("patients should be looked up by their identifiers and MRNs", func() {
+			resp := serve(RoleReceptionist, http.MethodGet, "http://example.com/api/v1/patients?identifier="+url.QueryEscape("https://shire.example/ids|B-1290"), nil)
+			So(resp.Code, ShouldEqual, http.StatusOK)
+			So(queries.ListPatientsArgs.IdentifierSystem, ShouldEqual, "https://shire.example/ids")
+			So(queries.ListPatientsArgs.IdentifierValue, ShouldEqual, "B-1290")
+
+			resp = serve(RoleReceptionist, http.MethodGet, "http://example.com/api/v1/patients?mrn=MRN00000001", nil)
+			So(resp.Code, ShouldEqual, http.StatusOK)
+			So(queries.ListPatientsArgs.MRN, ShouldEqual, "MRN00000001")
+
+			for _, identifier := range []string{"B-1290", "|B-1290", "https://shire.example/ids|"} {
+				resp := serve(RoleReceptionist, http.MethodGet, "http://example.com/api/v1/patients?identifier="+url.QueryEscape(identifier), nil)
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+			}
+		})
+	})
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const minRSAKeyBits = 2048
+
+// jwk is the JSON Web Key (RFC 7517) representation of a public key
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// verificationKey is a public key which tokens can be signed with
+type verificationKey struct {
+	method jwt.SigningMethod
+	public crypto.PublicKey
+	jwk    jwk
+}
+
+// keyring holds the keys used to sign and verify JWT tokens. It either uses a
+// single HS256 shared secret or a set of RSA / ECDSA keys identified by their
+// `kid`, in which case only the first private key is used for signing.
+type keyring struct {
+	hmacSecret []byte
+
+	signingKeyID string
+	signingKey   crypto.PrivateKey
+	verification map[string]verificationKey
+	// published keeps the JWKS order stable
+	published []jwk
+}
+
+func newHMACKeyring(secret string) *keyring {
+	return &keyring{hmacSecret: []byte(secret)}
+}
+
+// loadKeyring reads the PEM-encoded keys listed in the config. Without any
+// private keys it falls back to HS256 with HTTPJWTSigningKey.
+func loadKeyring(c config.Config) (*keyring, error) {
+	if len(c.HTTPJWTPrivateKeyFiles) == 0 {
+		if len(c.HTTPJWTPublicKeyFiles) > 0 {
+			return nil, errors.New("public keys can't be used without at least one private key")
+		}
+		return newHMACKeyring(c.HTTPJWTSigningKey), nil
+	}
+
+	k, err := loadPrivateKeyring(c.HTTPJWTPrivateKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range c.HTTPJWTPublicKeyFiles {
+		public, err := readPublicKey(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := k.add(public); err != nil {
+			return nil, fmt.Errorf("invalid public key in %q: %v", file, err)
+		}
+	}
+
+	log.Infof("Signing JWT tokens with key %q", k.signingKeyID)
+
+	return k, nil
+}
+
+// loadPrivateKeyring reads a set of PEM-encoded RSA / ECDSA private keys. The
+// first one signs and all of them are used for verification.
+func loadPrivateKeyring(files []string) (*keyring, error) {
+	k := &keyring{verification: make(map[string]verificationKey)}
+	for i, file := range files {
+		private, err := readPrivateKey(file)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type in %q", file)
+		}
+		keyID, err := k.add(signer.Public())
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key in %q: %v", file, err)
+		}
+
+		if i == 0 {
+			k.signingKeyID = keyID
+			k.signingKey = private
+		}
+	}
+
+	return k, nil
+}
+
+// add registers a verification key and returns its `kid`
+func (k *keyring) add(public crypto.PublicKey) (string, error) {
+	key, err := newVerificationKey(public)
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := k.verification[key.jwk.KeyID]; !ok {
+		k.verification[key.jwk.KeyID] = key
+		k.published = append(k.published, key.jwk)
+	}
+
+	return key.jwk.KeyID, nil
+}
+
+// sign signs the claims with the current signing key
+func (k *keyring) sign(claims jwt.Claims) (string, error) {
+	if k.signingKey == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.hmacSecret)
+	}
+
+	token := jwt.NewWithClaims(k.verification[k.signingKeyID].method, claims)
+	token.Header["kid"] = k.signingKeyID
+
+	return token.SignedString(k.signingKey)
+}
+
+// validationKey resolves the key which the token was signed with. It is meant
+// to be used as a jwt.Keyfunc.
+func (k *keyring) validationKey(token *jwt.Token) (interface{}, error) {
+	if k.signingKey == nil {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %q", token.Header["alg"])
+		}
+		return k.hmacSecret, nil
+	}
+
+	keyID, _ := token.Header["kid"].(string)
+	key, ok := k.verification[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", keyID)
+	}
+	// Never let the token pick a different algorithm than the key's
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q for key %q", token.Header["alg"], keyID)
+	}
+
+	return key.public, nil
+}
+
+// jwks returns the public keys which other services can use to verify tokens.
+// It's empty when using HS256, since the shared secret can't be published.
+func (k *keyring) jwks() jwkSet {
+	return jwkSet{Keys: append([]jwk{}, k.published...)}
+}
+
+func (s Server) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	jsonData, err := marshalJSON(r.Context(), s.keys.jwks())
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise JWKS to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+func newVerificationKey(public crypto.PublicKey) (verificationKey, error) {
+	var key verificationKey
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSAKeyBits {
+			return verificationKey{}, fmt.Errorf("RSA keys must have at least %d bits", minRSAKeyBits)
+		}
+		key.method = jwt.SigningMethodRS256
+		key.jwk = jwk{
+			KeyType: "RSA",
+			N:       base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		switch public.Curve {
+		case elliptic.P256():
+			key.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			key.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			key.method = jwt.SigningMethodES512
+		default:
+			return verificationKey{}, errors.New("unsupported elliptic curve")
+		}
+		size := (public.Curve.Params().BitSize + 7) / 8
+		key.jwk = jwk{
+			KeyType: "EC",
+			Curve:   public.Curve.Params().Name,
+			X:       base64.RawURLEncoding.EncodeToString(padLeft(public.X.Bytes(), size)),
+			Y:       base64.RawURLEncoding.EncodeToString(padLeft(public.Y.Bytes(), size)),
+		}
+	default:
+		return verificationKey{}, fmt.Errorf("unsupported public key type %T", public)
+	}
+
+	key.public = public
+	key.jwk.Use = "sig"
+	key.jwk.Algorithm = key.method.Alg()
+	key.jwk.KeyID = jwkThumbprint(key.jwk)
+
+	return key, nil
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint of a JWK, which makes a good
+// `kid` because it's derived from the key itself
+func jwkThumbprint(key jwk) string {
+	// The required members must be in lexicographic order, without whitespace
+	var canonical string
+	if key.KeyType == "RSA" {
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, key.E, key.N)
+	} else {
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, key.Curve, key.X, key.Y)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func padLeft(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+func readPEMBlock(file string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %q", file)
+	}
+
+	return block, nil
+}
+
+// readPrivateKey reads a PKCS #8, PKCS #1 (RSA) or SEC 1 (ECDSA) private key
+func readPrivateKey(file string) (crypto.PrivateKey, error) {
+	block, err := readPEMBlock(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("failed to parse private key in %q", file)
+}
+
+// readPublicKey reads a PKIX or PKCS #1 (RSA) public key
+func readPublicKey(file string) (crypto.PublicKey, error) {
+	block, err := readPEMBlock(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("failed to parse public key in %q", file)
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writePEM stores a DER-encoded key in a PEM file under dir
+func writePEM(dir, name, blockType string, der []byte) string {
+	file := filepath.Join(dir, name)
+	So(ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600), ShouldBeNil)
+	return file
+}
+
+func Test_Keys(t *testing.T) {
+	Convey("Keys test", t, func() {
+		dir, err := ioutil.TempDir("", "ferrum-keys")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		So(err, ShouldBeNil)
+		rsaDER, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+		So(err, ShouldBeNil)
+		rsaFile := writePEM(dir, "rsa.pem", "PRIVATE KEY", rsaDER)
+
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		ecDER, err := x509.MarshalECPrivateKey(ecKey)
+		So(err, ShouldBeNil)
+		ecFile := writePEM(dir, "ec.pem", "EC PRIVATE KEY", ecDER)
+		ecPublicDER, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+		So(err, ShouldBeNil)
+		ecPublicFile := writePEM(dir, "ec.pub.pem", "PUBLIC KEY", ecPublicDER)
+
+		c := config.Config{
+			HTTPJWTVClaimName: "test",
+			HTTPJWTSigningKey: "deadbeef",
+			HTTPJWTExpiration: 1 * time.Hour,
+		}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		newServer := func(keys *keyring) Server {
+			s := newTestServer(c, &mockQueries{})
+			s.keys = keys
+			return s
+		}
+
+		getPatients := func(s Server, token string) int {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/patients", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w.Result().StatusCode
+		}
+
+		Convey("loadKeyring should", func() {
+			Convey("fall back to HS256 without private keys", func() {
+				keys, err := loadKeyring(c)
+				So(err, ShouldBeNil)
+
+				s := newServer(keys)
+				token, err := s.issueToken("gandalf", RoleAdmin)
+				So(err, ShouldBeNil)
+				So(getPatients(s, token), ShouldEqual, http.StatusOK)
+				So(keys.jwks().Keys, ShouldBeEmpty)
+			})
+
+			Convey("reject public keys without a private key", func() {
+				c.HTTPJWTPublicKeyFiles = []string{ecPublicFile}
+				_, err := loadKeyring(c)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("reject RSA keys which are too small", func() {
+				smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+				So(err, ShouldBeNil)
+				c.HTTPJWTPrivateKeyFiles = []string{
+					writePEM(dir, "small.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(smallKey)),
+				}
+				_, err = loadKeyring(c)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("reject files without PEM data", func() {
+				file := filepath.Join(dir, "garbage.pem")
+				So(ioutil.WriteFile(file, []byte("garbage"), 0600), ShouldBeNil)
+				c.HTTPJWTPrivateKeyFiles = []string{file}
+				_, err := loadKeyring(c)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("an RSA keyring should", func() {
+			c.HTTPJWTPrivateKeyFiles = []string{rsaFile}
+			keys, err := loadKeyring(c)
+			So(err, ShouldBeNil)
+			s := newServer(keys)
+
+			Convey("sign RS256 tokens with a key ID", func() {
+				token, err := s.issueToken("gandalf", RoleAdmin)
+				So(err, ShouldBeNil)
+
+				parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+					return &rsaKey.PublicKey, nil
+				})
+				So(err, ShouldBeNil)
+				So(parsed.Method, ShouldEqual, jwt.SigningMethodRS256)
+				So(parsed.Header["kid"], ShouldEqual, keys.signingKeyID)
+				So(getPatients(s, token), ShouldEqual, http.StatusOK)
+			})
+
+			Convey("reject HS256 tokens", func() {
+				So(getPatients(s, dummyJWTToken), ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("reject tokens with an unknown key ID", func() {
+				otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+				So(err, ShouldBeNil)
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"roles": []Role{RoleAdmin}})
+				token.Header["kid"] = "unknown"
+				signedToken, err := token.SignedString(otherKey)
+				So(err, ShouldBeNil)
+
+				So(getPatients(s, signedToken), ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("publish the public key as a JWKS", func() {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/.well-known/jwks.json", nil)
+				s.getHTTPRouter().ServeHTTP(w, req)
+				So(w.Result().StatusCode, ShouldEqual, http.StatusOK)
+
+				var set jwkSet
+				So(json.NewDecoder(w.Result().Body).Decode(&set), ShouldBeNil)
+				So(set.Keys, ShouldHaveLength, 1)
+				So(set.Keys[0].KeyType, ShouldEqual, "RSA")
+				So(set.Keys[0].Algorithm, ShouldEqual, "RS256")
+				So(set.Keys[0].KeyID, ShouldEqual, keys.signingKeyID)
+				So(set.Keys[0].E, ShouldEqual, "AQAB")
+			})
+		})
+
+		Convey("a rotated keyring should", func() {
+			// The EC key used to sign tokens, but now it's only kept around
+			// until they expire
+			c.HTTPJWTPrivateKeyFiles = []string{ecFile}
+			oldKeys, err := loadKeyring(c)
+			So(err, ShouldBeNil)
+			oldToken, err := newServer(oldKeys).issueToken("gandalf", RoleAdmin)
+			So(err, ShouldBeNil)
+
+			c.HTTPJWTPrivateKeyFiles = []string{rsaFile}
+			c.HTTPJWTPublicKeyFiles = []string{ecPublicFile}
+			keys, err := loadKeyring(c)
+			So(err, ShouldBeNil)
+			s := newServer(keys)
+
+			Convey("accept tokens signed with the retired key", func() {
+				parsed, _ := jwt.Parse(oldToken, nil)
+				So(parsed.Method, ShouldEqual, jwt.SigningMethodES256)
+				So(getPatients(s, oldToken), ShouldEqual, http.StatusOK)
+			})
+
+			Convey("sign new tokens with the current key", func() {
+				token, err := s.issueToken("gandalf", RoleAdmin)
+				So(err, ShouldBeNil)
+				parsed, _ := jwt.Parse(token, nil)
+				So(parsed.Method, ShouldEqual, jwt.SigningMethodRS256)
+			})
+
+			Convey("publish both keys", func() {
+				set := keys.jwks()
+				So(set.Keys, ShouldHaveLength, 2)
+				So(set.Keys[1].KeyType, ShouldEqual, "EC")
+				So(set.Keys[1].Curve, ShouldEqual, "P-256")
+				So(set.Keys[1].KeyID, ShouldEqual, oldKeys.signingKeyID)
+			})
+		})
+	})
+}
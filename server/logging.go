@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIDHeader carries the ID which correlates a request with its logs, its
+// audit entries and its error responses
+const requestIDHeader = "X-Request-ID"
+
+// requestIDRegexp matches the request IDs which are accepted from clients. They
+// end up in logs, so anything else is replaced by a new ID.
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestInfo describes the request which is being served. The handlers fill in
+// the subject once the caller is authenticated.
+type requestInfo struct {
+	id      string
+	subject string
+}
+
+type requestInfoContextKey struct{}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey{}).(*requestInfo)
+	return info
+}
+
+// requestIDFromContext returns the ID of the request being served, if any
+func requestIDFromContext(ctx context.Context) string {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return info.id
+	}
+
+	return ""
+}
+
+// setRequestSubject records the authenticated caller for the access log
+func setRequestSubject(ctx context.Context, subject string) {
+	if info := requestInfoFromContext(ctx); info != nil {
+		info.subject = subject
+	}
+}
+
+// SetupLogging adds the ID of the request and the IDs of the current span to the
+// log entries which are created with log.WithContext and masks the PHI in all
+// the log entries
+func SetupLogging() {
+	log.AddHook(contextLogHook{})
+	log.AddHook(redactionHook{})
+}
+
+// contextLogHook adds the request and trace IDs stored in the context of a log
+// entry to its fields
+type contextLogHook struct{}
+
+func (contextLogHook) Levels() []log.Level { return log.AllLevels }
+
+func (contextLogHook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+
+	if requestID := requestIDFromContext(entry.Context); requestID != "" {
+		entry.Data["request_id"] = requestID
+	}
+	if spanContext := trace.SpanContextFromContext(entry.Context); spanContext.IsValid() {
+		entry.Data["trace_id"] = spanContext.TraceID().String()
+		entry.Data["span_id"] = spanContext.SpanID().String()
+	}
+
+	return nil
+}
+
+// newAccessLogger creates the logger of the access log, which writes one JSON
+// object per line
+func newAccessLogger(out io.Writer) *log.Logger {
+	logger := log.New()
+	logger.SetOutput(out)
+	logger.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	logger.AddHook(contextLogHook{})
+	logger.AddHook(redactionHook{})
+
+	return logger
+}
+
+// logRequests assigns an ID to each request served by router, unless the client
+// sent a valid one, and writes an access log entry once it has been served. The
+// entries only contain the route template and no bodies, since the URLs and the
+// bodies can contain patient data.
+func (s Server) logRequests(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		info := &requestInfo{id: r.Header.Get(requestIDHeader)}
+		if !requestIDRegexp.MatchString(info.id) {
+			var err error
+			if info.id, err = randomToken(16); err != nil {
+				log.WithContext(r.Context()).Warnf("Failed to generate request ID: %v", err)
+			}
+		}
+		w.Header().Set(requestIDHeader, info.id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request_id", info.id))
+
+		ctx := context.WithValue(r.Context(), requestInfoContextKey{}, info)
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		if s.accessLog == nil {
+			return
+		}
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.accessLog.WithContext(ctx).WithFields(log.Fields{
+			"method":      r.Method,
+			"route":       routeTemplate(router, r),
+			"status":      status,
+			"bytes":       recorder.bytes,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"subject":     info.subject,
+		}).Info("HTTP request")
+	})
+}
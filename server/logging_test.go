@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Logging(t *testing.T) {
+	Convey("Request logging test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+		}
+
+		queries := &mockQueries{
+			Patients: []db.Patient{{ID: 123, FirstName: "Bilbo", LastName: "Baggins", Email: "bilbo@shire.example"}},
+		}
+
+		var accessLog bytes.Buffer
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+		s.accessLog = newAccessLogger(&accessLog)
+
+		token, err := s.issueToken("bilbo", RoleAdmin)
+		So(err, ShouldBeNil)
+
+		serve := func(url, requestID string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, url, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			if requestID != "" {
+				req.Header.Set("X-Request-ID", requestID)
+			}
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("request IDs should be", func() {
+			Convey("returned as they were sent", func() {
+				resp := serve("http://example.com/api/v1/patients/123", "req-1")
+				So(resp.Header().Get("X-Request-ID"), ShouldEqual, "req-1")
+			})
+
+			Convey("generated when missing", func() {
+				resp := serve("http://example.com/api/v1/patients/123", "")
+				So(resp.Header().Get("X-Request-ID"), ShouldNotBeEmpty)
+			})
+
+			Convey("replaced when they could forge log lines", func() {
+				for _, requestID := range []string{"req-1\nlevel=error", strings.Repeat("a", 129)} {
+					resp := serve("http://example.com/api/v1/patients/123", requestID)
+					So(resp.Header().Get("X-Request-ID"), ShouldNotBeEmpty)
+					So(resp.Header().Get("X-Request-ID"), ShouldNotEqual, requestID)
+				}
+			})
+
+			Convey("added to the problem details", func() {
+				resp := serve("http://example.com/api/v1/visits/8", "")
+				var p problem
+				So(json.NewDecoder(resp.Body).Decode(&p), ShouldBeNil)
+				So(p.RequestID, ShouldEqual, resp.Header().Get("X-Request-ID"))
+			})
+		})
+
+		Convey("the access log should", func() {
+			Convey("have one JSON line per request without patient data", func() {
+				resp := serve("http://example.com/api/v1/patients/123?name=Bilbo", "req-1")
+				So(resp.Code, ShouldEqual, http.StatusOK)
+
+				So(strings.Count(accessLog.String(), "\n"), ShouldEqual, 1)
+				So(accessLog.String(), ShouldNotContainSubstring, "Bilbo")
+				So(accessLog.String(), ShouldNotContainSubstring, "bilbo@shire.example")
+
+				var entry map[string]interface{}
+				So(json.Unmarshal(accessLog.Bytes(), &entry), ShouldBeNil)
+				So(entry["method"], ShouldEqual, http.MethodGet)
+				So(entry["route"], ShouldEqual, "/api/v1/patients/{id}")
+				So(entry["status"], ShouldEqual, http.StatusOK)
+				So(entry["bytes"], ShouldEqual, resp.Body.Len())
+				So(entry["subject"], ShouldEqual, "bilbo")
+				So(entry["request_id"], ShouldEqual, "req-1")
+				So(entry, ShouldContainKey, "duration_ms")
+			})
+
+			Convey("log unauthenticated requests without a subject", func() {
+				w := httptest.NewRecorder()
+				s.getHTTPRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/patients/123", nil))
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+				var entry map[string]interface{}
+				So(json.Unmarshal(accessLog.Bytes(), &entry), ShouldBeNil)
+				So(entry["status"], ShouldEqual, http.StatusUnauthorized)
+				So(entry["subject"], ShouldEqual, "")
+			})
+		})
+
+		Convey("log entries should contain the request ID", func() {
+			var buf bytes.Buffer
+			logger := log.New()
+			logger.SetOutput(&buf)
+			logger.AddHook(contextLogHook{})
+
+			ctx := context.WithValue(context.Background(), requestInfoContextKey{}, &requestInfo{id: "req-1"})
+			logger.WithContext(ctx).Warn("Failed to insert patient data")
+			So(buf.String(), ShouldContainSubstring, "request_id=req-1")
+		})
+	})
+}
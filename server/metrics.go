@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "ferrum"
+
+// metrics holds the Prometheus collectors of a Server. They're registered in
+// their own registry instead of the global one, so several servers can run in
+// the same process. A nil *metrics doesn't record anything, so Servers which
+// aren't built with New still work.
+type metrics struct {
+	registry            *prometheus.Registry
+	httpRequests        *prometheus.CounterVec
+	httpRequestDuration *prometheus.HistogramVec
+	queryDuration       *prometheus.HistogramVec
+	jwtFailures         *prometheus.CounterVec
+}
+
+func newMetrics(c config.Config, conn dbConn) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Number of HTTP requests by route template, method and status code.",
+		}, []string{"route", "method", "status"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of HTTP requests by route template, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "db",
+			Name:      "query_duration_seconds",
+			Help:      "Duration of database queries by query name.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"query"}),
+		jwtFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "jwt",
+			Name:      "validation_failures_total",
+			Help:      "Number of requests rejected because of their JWT token, by reason.",
+		}, []string{"reason"}),
+	}
+
+	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_info",
+		Help:      "Always 1, labelled by the version and the build date of the binary.",
+	}, []string{"version", "build_date", "go_version"})
+	buildInfo.WithLabelValues(c.Version, c.BuildDate, runtime.Version()).Set(1)
+
+	m.registry.MustRegister(
+		m.httpRequests,
+		m.httpRequestDuration,
+		m.queryDuration,
+		m.jwtFailures,
+		buildInfo,
+		newDBStatsCollector(conn),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// handler serves the metrics in the Prometheus exposition format
+func (m *metrics) handler() http.Handler {
+	if m == nil {
+		return http.HandlerFunc(notFoundHandler)
+	}
+
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrumentHTTP counts and times the requests served by router. They're
+// labelled by route template instead of path, since paths contain IDs.
+func (m *metrics) instrumentHTTP(router *mux.Router) http.Handler {
+	if m == nil {
+		return router
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		router.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := prometheus.Labels{
+			"route":  routeTemplate(router, r),
+			"method": metricsMethod(r.Method),
+			"status": strconv.Itoa(status),
+		}
+		m.httpRequests.With(labels).Inc()
+		m.httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsMethod limits the method label to the standard HTTP methods, since
+// clients can send anything
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+// JWT validation failure reasons
+const (
+	jwtFailureMissing          = "missing"
+	jwtFailureMalformed        = "malformed"
+	jwtFailureExpired          = "expired"
+	jwtFailureNotYetValid      = "not_yet_valid"
+	jwtFailureInvalidSignature = "invalid_signature"
+	jwtFailureRevoked          = "revoked"
+	jwtFailureInvalid          = "invalid"
+)
+
+// jwtFailureReason classifies the errors of the JWT middleware, which are only
+// passed to its error handler as messages
+func jwtFailureReason(err string) string {
+	switch {
+	case err == "Required authorization token not found":
+		return jwtFailureMissing
+	case strings.Contains(err, "Authorization header format"),
+		strings.Contains(err, "segments"),
+		strings.HasPrefix(err, "illegal base64"),
+		strings.HasPrefix(err, "invalid character"):
+		return jwtFailureMalformed
+	case strings.Contains(err, "expired"):
+		return jwtFailureExpired
+	case strings.Contains(err, "not valid yet"), strings.Contains(err, "used before issued"):
+		return jwtFailureNotYetValid
+	case strings.Contains(err, "signature is invalid"), strings.Contains(err, "verification error"):
+		return jwtFailureInvalidSignature
+	default:
+		return jwtFailureInvalid
+	}
+}
+
+func (m *metrics) jwtFailure(reason string) {
+	if m == nil {
+		return
+	}
+
+	m.jwtFailures.WithLabelValues(reason).Inc()
+}
+
+// instrument times the queries which run on conn
+func (m *metrics) instrument(conn db.DBTX) db.DBTX {
+	if m == nil {
+		return conn
+	}
+
+	return instrumentedDB{DBTX: conn, metrics: m}
+}
+
+// instrumentedDB records the duration of each query, named after its sqlc
+// `-- name:` comment. Rows are read after the query methods return, so the
+// durations only cover running the queries.
+type instrumentedDB struct {
+	db.DBTX
+	metrics *metrics
+}
+
+func (d instrumentedDB) observe(query string, start time.Time) {
+	d.metrics.queryDuration.WithLabelValues(queryName(query)).Observe(time.Since(start).Seconds())
+}
+
+func (d instrumentedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	defer d.observe(query, time.Now())
+	return d.DBTX.ExecContext(ctx, query, args...)
+}
+
+func (d instrumentedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	defer d.observe(query, time.Now())
+	return d.DBTX.QueryContext(ctx, query, args...)
+}
+
+func (d instrumentedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	defer d.observe(query, time.Now())
+	return d.DBTX.QueryRowContext(ctx, query, args...)
+}
+
+// queryName extracts the name of a sqlc query
+func queryName(query string) string {
+	const prefix = "-- name: "
+	if !strings.HasPrefix(query, prefix) {
+		return "unknown"
+	}
+
+	fields := strings.Fields(query[len(prefix):])
+	if len(fields) == 0 {
+		return "unknown"
+	}
+
+	return fields[0]
+}
+
+// dbStatsCollector reports the statistics of the database connection pool when
+// the metrics are scraped
+type dbStatsCollector struct {
+	conn         dbConn
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	maxOpen      *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+}
+
+func newDBStatsCollector(conn dbConn) *dbStatsCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "db", name), help, nil, nil)
+	}
+
+	return &dbStatsCollector{
+		conn:         conn,
+		open:         desc("open_connections", "Number of open connections, both in use and idle."),
+		inUse:        desc("in_use_connections", "Number of connections which are in use."),
+		idle:         desc("idle_connections", "Number of idle connections."),
+		maxOpen:      desc("max_open_connections", "Maximum number of open connections, or 0 if unlimited."),
+		waitCount:    desc("wait_count_total", "Number of queries which waited for a connection."),
+		waitDuration: desc("wait_duration_seconds_total", "Time spent waiting for a connection."),
+	}
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{c.open, c.inUse, c.idle, c.maxOpen, c.waitCount, c.waitDuration} {
+		ch <- desc
+	}
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.conn.Stats()
+
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Metrics(t *testing.T) {
+	Convey("Metrics test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+			Version:            "1.0.0",
+			BuildDate:          "2020-04-17",
+		}
+
+		dbConn := &mockDBConn{stats: sql.DBStats{MaxOpenConnections: 10, OpenConnections: 3, InUse: 2, Idle: 1, WaitCount: 4}}
+		queries := &mockQueries{Patients: []db.Patient{{ID: 123}}}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+		s.databaseConn = dbConn
+		s.metrics = newMetrics(c, dbConn)
+		router := s.getHTTPRouter()
+
+		serve := func(method, url, token string) int {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			router.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		scrape := func() string {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			body, err := ioutil.ReadAll(w.Body)
+			So(err, ShouldBeNil)
+			return string(body)
+		}
+
+		token, err := s.issueToken("bilbo", RoleAdmin)
+		So(err, ShouldBeNil)
+
+		Convey("HTTP requests should be labelled by route template", func() {
+			So(serve(http.MethodGet, "http://example.com/api/v1/patients/123", token), ShouldEqual, http.StatusOK)
+			So(serve(http.MethodGet, "http://example.com/api/v1/patients/123", token), ShouldEqual, http.StatusOK)
+			So(serve(http.MethodGet, "http://example.com/api/v1/hobbits/123", token), ShouldEqual, http.StatusNotFound)
+			So(serve("BREW", "http://example.com/api/v1/patients/123", token), ShouldEqual, http.StatusMethodNotAllowed)
+
+			body := scrape()
+			So(body, ShouldContainSubstring, `ferrum_http_requests_total{method="GET",route="/api/v1/patients/{id}",status="200"} 2`)
+			So(body, ShouldContainSubstring, `ferrum_http_request_duration_seconds_count{method="GET",route="/api/v1/patients/{id}",status="200"} 2`)
+			So(body, ShouldContainSubstring, `ferrum_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+			So(body, ShouldContainSubstring, `ferrum_http_requests_total{method="OTHER",route="unmatched",status="405"} 1`)
+			So(body, ShouldNotContainSubstring, "/api/v1/patients/123")
+		})
+
+		Convey("JWT validation failures should be counted by reason", func() {
+			So(serve(http.MethodGet, "http://example.com/api/v1/patients/123", ""), ShouldEqual, http.StatusUnauthorized)
+			So(serve(http.MethodGet, "http://example.com/api/v1/patients/123", "foobar"), ShouldEqual, http.StatusUnauthorized)
+
+			jwt.TimeFunc = func() time.Time {
+				return time.Date(
+					2020, 4, 18, 0, 0, 0, 0, time.UTC)
+			}
+			So(serve(http.MethodGet, "http://example.com/api/v1/patients/123", token), ShouldEqual, http.StatusUnauthorized)
+
+			body := scrape()
+			So(body, ShouldContainSubstring, `ferrum_jwt_validation_failures_total{reason="missing"} 1`)
+			So(body, ShouldContainSubstring, `ferrum_jwt_validation_failures_total{reason="malformed"} 1`)
+			So(body, ShouldContainSubstring, `ferrum_jwt_validation_failures_total{reason="expired"} 1`)
+		})
+
+		Convey("the connection pool stats and the build info should be reported", func() {
+			body := scrape()
+			So(body, ShouldContainSubstring, "ferrum_db_open_connections 3")
+			So(body, ShouldContainSubstring, "ferrum_db_in_use_connections 2")
+			So(body, ShouldContainSubstring, "ferrum_db_wait_count_total 4")
+			So(body, ShouldContainSubstring, `ferrum_build_info{build_date="2020-04-17",`)
+			So(body, ShouldContainSubstring, `version="1.0.0"} 1`)
+		})
+
+		Convey("queries should be timed by name", func() {
+			conn := s.metrics.instrument(dbConn)
+			_, err := conn.ExecContext(context.Background(), "-- name: DeletePatient :one\nDELETE FROM patient")
+			So(err, ShouldBeNil)
+			_, err = conn.QueryContext(context.Background(), "SELECT 1")
+			So(err, ShouldBeNil)
+
+			body := scrape()
+			So(body, ShouldContainSubstring, `ferrum_db_query_duration_seconds_count{query="DeletePatient"} 1`)
+			So(body, ShouldContainSubstring, `ferrum_db_query_duration_seconds_count{query="unknown"} 1`)
+		})
+	})
+}
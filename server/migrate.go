@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// MigrateUp applies the pending schema migrations. Concurrent instances wait
+// for each other, so only one of them applies each migration.
+func (s Server) MigrateUp(ctx context.Context) error {
+	migrations, err := s.migrator.Up(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(migrations) == 0 {
+		log.Info("The database schema is up to date")
+	}
+	for _, m := range migrations {
+		log.Infof("Applied migration %d_%s", m.Version, m.Name)
+	}
+
+	return nil
+}
+
+// MigrateDown reverts the given number of schema migrations, newest first
+func (s Server) MigrateDown(ctx context.Context, steps int) error {
+	migrations, err := s.migrator.Down(ctx, steps)
+	if err != nil {
+		return err
+	}
+
+	if len(migrations) == 0 {
+		log.Info("There are no migrations to revert")
+	}
+	for _, m := range migrations {
+		log.Infof("Reverted migration %d_%s", m.Version, m.Name)
+	}
+
+	return nil
+}
+
+// MigrationStatus lists the schema migrations and when they were applied
+func (s Server) MigrationStatus(ctx context.Context) ([]db.MigrationStatus, error) {
+	return s.migrator.Status(ctx)
+}
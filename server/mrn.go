@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/mihaitodor/ferrum/config"
+)
+
+// Supported config.PatientMRNAllocator values
+const (
+	mrnAllocatorSequence = "sequence"
+	mrnAllocatorClient   = "client"
+)
+
+// mrnIdentifierSystem is the identifier system of the MRNs which patients keep
+// after they're merged into other patients
+const mrnIdentifierSystem = "urn:ferrum:mrn"
+
+// maxMRNDigits keeps the sequence numbers within the range of int64
+const maxMRNDigits = 18
+
+// mrnAllocator assigns the medical record numbers (MRNs) of new patients
+type mrnAllocator interface {
+	// allocate returns the MRN of a new patient, given the one which the
+	// client sent, if any. It returns a *validationError if the client MRN
+	// isn't acceptable.
+	allocate(ctx context.Context, q queries, requested string) (string, error)
+}
+
+// newMRNAllocator creates the allocator selected by PatientMRNAllocator
+func newMRNAllocator(c config.Config) (mrnAllocator, error) {
+	switch c.PatientMRNAllocator {
+	case mrnAllocatorSequence:
+		if c.PatientMRNDigits < 1 || c.PatientMRNDigits > maxMRNDigits {
+			return nil, fmt.Errorf("MRNs must have between 1 and %d digits, not %d", maxMRNDigits, c.PatientMRNDigits)
+		}
+		return sequenceMRNAllocator{
+			prefix:     c.PatientMRNPrefix,
+			digits:     c.PatientMRNDigits,
+			checkDigit: c.PatientMRNCheckDigit,
+		}, nil
+	case mrnAllocatorClient:
+		return clientMRNAllocator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown MRN allocator %q", c.PatientMRNAllocator)
+	}
+}
+
+// sequenceMRNAllocator numbers the patients with a database sequence, so the
+// MRNs are never reused, even after patients are deleted
+type sequenceMRNAllocator struct {
+	prefix     string
+	digits     int
+	checkDigit bool
+}
+
+func (a sequenceMRNAllocator) allocate(ctx context.Context, q queries, requested string) (string, error) {
+	if requested != "" {
+		return "", &validationError{fields: []fieldError{{Field: "mrn", Message: "is assigned by the server"}}}
+	}
+
+	// Imported patients keep their MRNs, which can be ahead of the sequence,
+	// so the numbers which are already taken are skipped
+	for {
+		n, err := q.NextPatientMRN(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to allocate MRN: %v", err)
+		}
+
+		mrn := a.format(n)
+		taken, err := q.PatientMRNExists(ctx, mrn)
+		if err != nil {
+			return "", fmt.Errorf("failed to check MRN: %v", err)
+		}
+		if !taken {
+			return mrn, nil
+		}
+	}
+}
+
+// format pads n with zeros and adds the prefix and the check digit
+func (a sequenceMRNAllocator) format(n int64) string {
+	digits := fmt.Sprintf("%0*d", a.digits, n)
+	if a.checkDigit {
+		digits += strconv.Itoa(luhnCheckDigit(digits))
+	}
+	return a.prefix + digits
+}
+
+// luhnCheckDigit computes the digit which makes digits pass the Luhn check,
+// when it's appended to them
+func luhnCheckDigit(digits string) int {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		// The check digit will be the rightmost one, so the doubling starts
+		// with the last digit here
+		if (len(digits)-i)%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return (10 - sum%10) % 10
+}
+
+// clientMRNAllocator uses the MRNs sent by the clients, for when they're
+// assigned by another system, such as a hospital's patient index
+type clientMRNAllocator struct{}
+
+func (clientMRNAllocator) allocate(_ context.Context, _ queries, requested string) (string, error) {
+	if requested == "" {
+		return "", &validationError{fields: []fieldError{{Field: "mrn", Message: "is required"}}}
+	}
+	return requested, nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MRNAllocator(t *testing.T) {
+	Convey("MRN allocator test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+		}
+
+		queries := &mockQueries{}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+
+		token, err := s.issueToken("bilbo", RoleReceptionist)
+		So(err, ShouldBeNil)
+
+		addPatient := func(body string) (*httptest.ResponseRecorder, db.Patient) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/api/v1/patients", bytes.NewReader([]byte(body)))
+			req.Header.Set("Authorization", "Bearer "+token)
+			s.getHTTPRouter().ServeHTTP(w, req)
+
+			var patient db.Patient
+			if w.Code == http.StatusCreated {
+				So(json.Unmarshal(w.Body.Bytes(), &patient), ShouldBeNil)
+			}
+			return w, patient
+		}
+
+		Convey("the sequence allocator should", func() {
+			Convey("number the new patients", func() {
+				resp, patient := addPatient(`{"first_name":"Bilbo","last_name":"Baggins"}`)
+				So(resp.Code, ShouldEqual, http.StatusCreated)
+				So(patient.MRN, ShouldEqual, "MRN00000001")
+
+				// Patients with the same name are different people
+				resp, patient = addPatient(`{"first_name":"Bilbo","last_name":"Baggins"}`)
+				So(resp.Code, ShouldEqual, http.StatusCreated)
+				So(patient.MRN, ShouldEqual, "MRN00000002")
+			})
+
+			Convey("skip the MRNs which are taken", func() {
+				queries.Patients = []db.Patient{{ID: 1, MRN: "MRN00000001"}, {ID: 2, MRN: "MRN00000002"}}
+				mrn, err := s.mrns.allocate(context.Background(), queries, "")
+				So(err, ShouldBeNil)
+				So(mrn, ShouldEqual, "MRN00000003")
+			})
+
+			Convey("reject MRNs sent by the clients", func() {
+				resp, _ := addPatient(`{"first_name":"Bilbo","last_name":"Baggins","mrn":"MRN12345678"}`)
+				So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+				So(resp.Body.String(), ShouldContainSubstring, "is assigned by the server")
+				So(queries.Patients, ShouldBeEmpty)
+			})
+
+			Convey("append Luhn check digits if they're enabled", func() {
+				So(luhnCheckDigit("7992739871"), ShouldEqual, 3)
+				So(sequenceMRNAllocator{prefix: "P-", digits: 6, checkDigit: true}.format(42), ShouldEqual, "P-0000422")
+			})
+		})
+
+		Convey("the client allocator should require the clients to send MRNs", func() {
+			s.mrns = clientMRNAllocator{}
+
+			resp, _ := addPatient(`{"first_name":"Bilbo","last_name":"Baggins"}`)
+			So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+
+			resp, patient := addPatient(`{"first_name":"Bilbo","last_name":"Baggins","mrn":" H-1290 "}`)
+			So(resp.Code, ShouldEqual, http.StatusCreated)
+			So(patient.MRN, ShouldEqual, "H-1290")
+		})
+
+		Convey("newMRNAllocator should reject invalid configurations", func() {
+			for _, c := range []config.Config{
+				{PatientMRNAllocator: "random", PatientMRNDigits: 8},
+				{PatientMRNAllocator: mrnAllocatorSequence, PatientMRNDigits: 0},
+				{PatientMRNAllocator: mrnAllocatorSequence, PatientMRNDigits: maxMRNDigits + 1},
+			} {
+				_, err := newMRNAllocator(c)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
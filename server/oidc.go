@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// minJWKSRefreshInterval stops tokens with made up key IDs from hammering the
+// identity provider
+const minJWKSRefreshInterval = 1 * time.Minute
+
+// oidcMetadata is the subset of the OpenID Connect discovery document which
+// Ferrum needs
+type oidcMetadata struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// oidcProvider validates the tokens issued by an external OpenID Connect
+// identity provider. The provider metadata and keys are fetched lazily, so
+// Ferrum can start while the provider is unavailable, and the keys are fetched
+// again when a token is signed with an unknown key.
+type oidcProvider struct {
+	issuer     string
+	audience   string
+	roles      roleMapper
+	httpClient *http.Client
+	timeFn     func() time.Time
+
+	mu          sync.RWMutex
+	jwksURI     string
+	keys        map[string]verificationKey
+	lastRefresh time.Time
+}
+
+// newOIDCProvider returns nil when no issuer is configured
+func newOIDCProvider(c config.Config) (*oidcProvider, error) {
+	if c.OIDCIssuerURL == "" {
+		return nil, nil
+	}
+	if c.OIDCAudience == "" {
+		return nil, errors.New("the OIDC audience must be set together with the issuer")
+	}
+
+	var mapping map[string]Role
+	if len(c.OIDCRoleMapping) > 0 {
+		mapping = make(map[string]Role, len(c.OIDCRoleMapping))
+		for external, name := range c.OIDCRoleMapping {
+			role, err := ParseRole(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid OIDC role mapping for %q: %v", external, err)
+			}
+			mapping[external] = role
+		}
+	}
+
+	return &oidcProvider{
+		issuer:     strings.TrimSuffix(c.OIDCIssuerURL, "/"),
+		audience:   c.OIDCAudience,
+		roles:      roleMapper{claim: c.OIDCRolesClaim, mapping: mapping},
+		httpClient: &http.Client{Timeout: c.HTTPRequestTimeout},
+		timeFn:     time.Now,
+		keys:       make(map[string]verificationKey),
+	}, nil
+}
+
+// validationKey checks the issuer and audience of the token and resolves the
+// provider key which it was signed with. It is meant to be used as a
+// jwt.Keyfunc.
+func (p *oidcProvider) validationKey(token *jwt.Token) (interface{}, error) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("unexpected claims type")
+	}
+	if !claims.VerifyIssuer(p.issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer %q", claims["iss"])
+	}
+	if !hasAudience(claims, p.audience) {
+		return nil, fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+
+	keyID, _ := token.Header["kid"].(string)
+	key, ok := p.key(keyID)
+	if !ok {
+		if err := p.refresh(); err != nil {
+			return nil, err
+		}
+		if key, ok = p.key(keyID); !ok {
+			return nil, fmt.Errorf("unknown key ID %q", keyID)
+		}
+	}
+	// Never let the token pick a different algorithm than the key's
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q for key %q", token.Header["alg"], keyID)
+	}
+
+	return key.public, nil
+}
+
+// hasAudience checks the `aud` claim, which can either be a string or an array
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// key looks up a key by ID. Tokens without a `kid` header can only be used
+// when the provider has a single key.
+func (p *oidcProvider) key(keyID string) (verificationKey, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if keyID == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+
+	key, ok := p.keys[keyID]
+	return key, ok
+}
+
+// refresh fetches the provider keys, running the discovery first if needed
+func (p *oidcProvider) refresh() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.timeFn()
+	if !p.lastRefresh.IsZero() && now.Sub(p.lastRefresh) < minJWKSRefreshInterval {
+		return nil
+	}
+	p.lastRefresh = now
+
+	ctx, done := context.WithTimeout(context.Background(), p.httpClient.Timeout)
+	defer done()
+
+	if p.jwksURI == "" {
+		var metadata oidcMetadata
+		if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+			return fmt.Errorf("OIDC discovery failed: %v", err)
+		}
+		if strings.TrimSuffix(metadata.Issuer, "/") != p.issuer {
+			return fmt.Errorf("OIDC discovery returned issuer %q instead of %q", metadata.Issuer, p.issuer)
+		}
+		if metadata.JWKSURI == "" {
+			return errors.New("OIDC discovery didn't return a jwks_uri")
+		}
+		p.jwksURI = metadata.JWKSURI
+	}
+
+	var set jwkSet
+	if err := p.getJSON(ctx, p.jwksURI, &set); err != nil {
+		return fmt.Errorf("failed to fetch OIDC keys: %v", err)
+	}
+
+	keys := make(map[string]verificationKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := verificationKeyFromJWK(k)
+		if err != nil {
+			log.WithContext(ctx).Warnf("Ignoring OIDC key %q: %v", k.KeyID, err)
+			continue
+		}
+		keys[k.KeyID] = key
+	}
+	p.keys = keys
+
+	log.WithContext(ctx).Infof("Loaded %d keys from %q", len(keys), p.jwksURI)
+
+	return nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %q returned status %d", url, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// verificationKeyFromJWK converts a JWK published by an identity provider. The
+// key keeps the provider's `kid` and `alg`, when the latter is set.
+func verificationKeyFromJWK(k jwk) (verificationKey, error) {
+	var public crypto.PublicKey
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return verificationKey{}, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return verificationKey{}, fmt.Errorf("invalid exponent: %v", err)
+		}
+		public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return verificationKey{}, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return verificationKey{}, fmt.Errorf("invalid x coordinate: %v", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return verificationKey{}, fmt.Errorf("invalid y coordinate: %v", err)
+		}
+		public = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	default:
+		return verificationKey{}, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+
+	key, err := newVerificationKey(public)
+	if err != nil {
+		return verificationKey{}, err
+	}
+	key.jwk.KeyID = k.KeyID
+
+	// RSA keys can be used with any of the RS* algorithms
+	if k.Algorithm != "" && k.Algorithm != key.method.Alg() {
+		method, ok := jwt.GetSigningMethod(k.Algorithm).(*jwt.SigningMethodRSA)
+		if !ok || k.KeyType != "RSA" {
+			return verificationKey{}, fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+		}
+		key.method = method
+	}
+
+	return key, nil
+}
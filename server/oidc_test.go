@@ -0,0 +1,204 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// stubIssuer is a minimal OpenID Connect provider which publishes its keys
+type stubIssuer struct {
+	*httptest.Server
+	keys        map[string]*rsa.PrivateKey
+	jwksCalls   int
+	wrongIssuer bool
+}
+
+func newStubIssuer() *stubIssuer {
+	issuer := &stubIssuer{keys: make(map[string]*rsa.PrivateKey)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		metadata := oidcMetadata{Issuer: issuer.URL, JWKSURI: issuer.URL + "/keys"}
+		if issuer.wrongIssuer {
+			metadata.Issuer = "https://evil.example.com"
+		}
+		_ = json.NewEncoder(w).Encode(metadata)
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, _ *http.Request) {
+		issuer.jwksCalls++
+
+		set := jwkSet{Keys: []jwk{}}
+		for keyID, key := range issuer.keys {
+			verificationKey, err := newVerificationKey(&key.PublicKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			verificationKey.jwk.KeyID = keyID
+			set.Keys = append(set.Keys, verificationKey.jwk)
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	})
+	issuer.Server = httptest.NewServer(mux)
+
+	return issuer
+}
+
+func (i *stubIssuer) addKey(keyID string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	So(err, ShouldBeNil)
+	i.keys[keyID] = key
+}
+
+func (i *stubIssuer) sign(keyID string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	signedToken, err := token.SignedString(i.keys[keyID])
+	So(err, ShouldBeNil)
+	return signedToken
+}
+
+func Test_OIDC(t *testing.T) {
+	Convey("OIDC test", t, func() {
+		issuer := newStubIssuer()
+		defer issuer.Close()
+		issuer.addKey("key-1")
+
+		c := config.Config{
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTSigningKey:  "deadbeef",
+			OIDCIssuerURL:      issuer.URL,
+			OIDCAudience:       "ferrum",
+			OIDCRolesClaim:     "realm_access.roles",
+			OIDCRoleMapping:    map[string]string{"clinic-admins": "admin", "front-desk": "receptionist"},
+		}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		provider, err := newOIDCProvider(c)
+		So(err, ShouldBeNil)
+		now := jwt.TimeFunc()
+		provider.timeFn = func() time.Time { return now }
+
+		s := newTestServer(c, &mockQueries{})
+		s.oidc = provider
+
+		claims := func(roles ...string) jwt.MapClaims {
+			return jwt.MapClaims{
+				"iss":          issuer.URL,
+				"aud":          []string{"ferrum", "account"},
+				"sub":          "gandalf",
+				"exp":          jwt.TimeFunc().Add(time.Hour).Unix(),
+				"realm_access": map[string]interface{}{"roles": roles},
+			}
+		}
+
+		request := func(method, token string) int {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "http://example.com/api/v1/physicians/1", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w.Result().StatusCode
+		}
+
+		Convey("the API should", func() {
+			Convey("accept tokens issued by the provider", func() {
+				So(request(http.MethodGet, issuer.sign("key-1", claims("front-desk"))), ShouldEqual, http.StatusNotFound)
+			})
+
+			Convey("map the provider roles to Ferrum roles", func() {
+				So(request(http.MethodDelete, issuer.sign("key-1", claims("front-desk"))), ShouldEqual, http.StatusForbidden)
+				So(request(http.MethodDelete, issuer.sign("key-1", claims("clinic-admins"))), ShouldEqual, http.StatusNotFound)
+				So(request(http.MethodGet, issuer.sign("key-1", claims("admin"))), ShouldEqual, http.StatusForbidden)
+			})
+
+			Convey("reject tokens from other issuers", func() {
+				token := claims("clinic-admins")
+				token["iss"] = "https://evil.example.com"
+				So(request(http.MethodGet, issuer.sign("key-1", token)), ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("reject tokens for other audiences", func() {
+				token := claims("clinic-admins")
+				token["aud"] = "another-app"
+				So(request(http.MethodGet, issuer.sign("key-1", token)), ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("reject tokens signed by Ferrum", func() {
+				So(request(http.MethodGet, dummyJWTToken), ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("not issue any tokens", func() {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, "http://example.com/auth/login", nil)
+				s.getHTTPRouter().ServeHTTP(w, req)
+				So(w.Result().StatusCode, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey("the provider should", func() {
+			So(request(http.MethodGet, issuer.sign("key-1", claims("front-desk"))), ShouldEqual, http.StatusNotFound)
+			So(issuer.jwksCalls, ShouldEqual, 1)
+
+			Convey("cache the keys", func() {
+				So(request(http.MethodGet, issuer.sign("key-1", claims("front-desk"))), ShouldEqual, http.StatusNotFound)
+				So(issuer.jwksCalls, ShouldEqual, 1)
+			})
+
+			Convey("fetch the keys again after a rotation", func() {
+				issuer.addKey("key-2")
+				now = now.Add(minJWKSRefreshInterval)
+				So(request(http.MethodGet, issuer.sign("key-2", claims("front-desk"))), ShouldEqual, http.StatusNotFound)
+				So(issuer.jwksCalls, ShouldEqual, 2)
+			})
+
+			Convey("not fetch the keys too often", func() {
+				So(request(http.MethodGet, issuer.sign("key-1", jwt.MapClaims{
+					"iss": issuer.URL, "aud": "ferrum", "exp": jwt.TimeFunc().Add(time.Hour).Unix(),
+				})), ShouldEqual, http.StatusForbidden)
+
+				issuer.addKey("key-3")
+				So(request(http.MethodGet, issuer.sign("key-3", claims("front-desk"))), ShouldEqual, http.StatusUnauthorized)
+				So(issuer.jwksCalls, ShouldEqual, 1)
+			})
+		})
+
+		Convey("discovery should reject metadata for another issuer", func() {
+			issuer.wrongIssuer = true
+			So(request(http.MethodGet, issuer.sign("key-1", claims("front-desk"))), ShouldEqual, http.StatusUnauthorized)
+			So(issuer.jwksCalls, ShouldEqual, 0)
+		})
+
+		Convey("newOIDCProvider should", func() {
+			Convey("require an audience", func() {
+				c.OIDCAudience = ""
+				_, err := newOIDCProvider(c)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("reject mappings to unknown roles", func() {
+				c.OIDCRoleMapping = map[string]string{"wizards": "wizard"}
+				_, err := newOIDCProvider(c)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("be disabled without an issuer", func() {
+				c.OIDCIssuerURL = ""
+				provider, err := newOIDCProvider(c)
+				So(err, ShouldBeNil)
+				So(provider, ShouldBeNil)
+			})
+		})
+	})
+}
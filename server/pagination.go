@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// pagePayload is the envelope for paginated collections
+type pagePayload struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Next       string      `json:"next,omitempty"`
+}
+
+// pageCursor identifies the last item of a page. It is handed to clients as an
+// opaque string.
+type pageCursor struct {
+	Sort string `json:"s,omitempty"`
+	Key  string `json:"k,omitempty"`
+	// Query is the hash of the search query which the cursor was issued for
+	Query string `json:"q,omitempty"`
+	ID    int64  `json:"i"`
+}
+
+func (c pageCursor) encode() string {
+	// Marshalling a struct of strings and ints can't fail
+	jsonData, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(jsonData)
+}
+
+func decodePageCursor(cursor string) (pageCursor, error) {
+	jsonData, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return pageCursor{}, &requestError{detail: "cursor is invalid", cause: err}
+	}
+
+	var c pageCursor
+	if err := json.Unmarshal(jsonData, &c); err != nil {
+		return pageCursor{}, &requestError{detail: "cursor is invalid", cause: err}
+	}
+	if c.ID == 0 {
+		return pageCursor{}, badRequest("cursor is missing the ID")
+	}
+
+	return c, nil
+}
+
+// parsePageLimit reads the `limit` query parameter
+func parsePageLimit(query url.Values) (int32, error) {
+	limitString := query.Get("limit")
+	if limitString == "" {
+		return defaultPageSize, nil
+	}
+
+	limit, err := strconv.ParseInt(limitString, 10, 32)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		return 0, badRequest("limit must be an integer between 1 and %d", maxPageSize)
+	}
+
+	return int32(limit), nil
+}
+
+// setNextPage fills in the links to the next page, both in the payload and in
+// the Link header, keeping all the query parameters of the current request
+func setNextPage(w http.ResponseWriter, r *http.Request, payload *pagePayload, next pageCursor) {
+	payload.NextCursor = next.encode()
+
+	query := r.URL.Query()
+	query.Set("cursor", payload.NextCursor)
+	// TODO: Try to determine the scheme from the Origin header, since r.URL
+	// does not attempt to populate it
+	payload.Next = fmt.Sprintf("http://%s%s?%s", r.Host, r.URL.Path, query.Encode())
+
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, payload.Next))
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Pagination(t *testing.T) {
+	Convey("Pagination test", t, func() {
+		Convey("page cursors should survive a round trip", func() {
+			cursor := pageCursor{Sort: "-created_at", Key: "2020-04-17T00:00:00Z", ID: 42}
+
+			decoded, err := decodePageCursor(cursor.encode())
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, cursor)
+		})
+
+		Convey("decodePageCursor should reject garbage", func() {
+			_, err := decodePageCursor("not a cursor")
+			So(err, ShouldNotBeNil)
+
+			_, err = decodePageCursor(pageCursor{}.encode())
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("parseListPatientsParams should", func() {
+			Convey("use sensible defaults", func() {
+				params, err := parseListPatientsParams(url.Values{})
+				So(err, ShouldBeNil)
+				So(params.Limit, ShouldEqual, defaultPageSize)
+				So(params.SortBy, ShouldEqual, db.PatientSortLastName)
+				So(params.Descending, ShouldBeFalse)
+			})
+
+			Convey("parse all the supported parameters", func() {
+				cursor := pageCursor{Sort: "-created_at", Key: "2020-04-17T00:00:00Z", ID: 42}
+				params, err := parseListPatientsParams(url.Values{
+					"limit":          {"10"},
+					"sort":           {"-created_at"},
+					"cursor":         {cursor.encode()},
+					"email":          {"bilbo@shire.me"},
+					"created_after":  {"2020-04-01T00:00:00Z"},
+					"created_before": {"2020-05-01T00:00:00+02:00"},
+				})
+				So(err, ShouldBeNil)
+				So(params.Limit, ShouldEqual, 10)
+				So(params.SortBy, ShouldEqual, db.PatientSortCreatedAt)
+				So(params.Descending, ShouldBeTrue)
+				So(params.AfterKey, ShouldEqual, cursor.Key)
+				So(params.AfterID, ShouldEqual, cursor.ID)
+				So(params.Email, ShouldEqual, "bilbo@shire.me")
+				So(params.CreatedAfter.Valid, ShouldBeTrue)
+				So(params.CreatedBefore.Valid, ShouldBeTrue)
+			})
+
+			Convey("reject invalid parameters", func() {
+				for _, query := range []url.Values{
+					{"limit": {"0"}},
+					{"limit": {"100000"}},
+					{"sort": {"email"}},
+					{"cursor": {pageCursor{Sort: "last_name", ID: 1}.encode()}, "sort": {"created_at"}},
+					{"created_after": {"yesterday"}},
+				} {
+					_, err := parseListPatientsParams(query)
+					So(err, ShouldNotBeNil)
+				}
+			})
+		})
+	})
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// physicianPayload is the body of the requests which create or replace
+// physicians
+type physicianPayload struct {
+	FirstName string `json:"first_name" validate:"required,max=100"`
+	LastName  string `json:"last_name" validate:"required,max=100"`
+}
+
+func (p physicianPayload) updateParams(id int32) db.UpdatePhysicianParams {
+	return db.UpdatePhysicianParams{ID: id, FirstName: p.FirstName, LastName: p.LastName}
+}
+
+func (s Server) physiciansHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	if r.Method == http.MethodPost {
+		body, ok := s.readRequestBody(w, r)
+		if !ok {
+			return
+		}
+
+		var physician physicianPayload
+		if err := decodePayload(body, &physician); err != nil {
+			log.WithContext(r.Context()).Debugf("Rejecting new physician data: %v", err)
+			writeRequestProblem(w, r, err)
+			return
+		}
+
+		var physicianRecord db.Physician
+		err := s.mutate(ctx, func(q queries) (string, int32, error) {
+			var err error
+			physicianRecord, err = q.AddPhysician(ctx, db.AddPhysicianParams(physician))
+			return "physician", physicianRecord.ID, err
+		})
+		if err != nil {
+			log.WithContext(r.Context()).Warnf("Failed to insert physician data into database: %v", err)
+			if db.IsConstraintViolation(err, db.UniqueViolation, "unique_physician_name") {
+				writeProblem(w, r, problemDuplicateName, "A physician with the same first and last name already exists")
+			} else {
+				writeProblem(w, r, problemInternal, "")
+			}
+			return
+		}
+
+		jsonData, err := marshalJSON(r.Context(), physicianRecord)
+		if err != nil {
+			log.WithContext(r.Context()).Warnf("Failed to serialise physician data to JSON: %v", err)
+			writeProblem(w, r, problemInternal, "")
+			return
+		}
+
+		// TODO: Try to determine the scheme from the Origin header, since r.URL
+		// does not attempt to populate it
+		w.Header().Set("Location", fmt.Sprintf("http://%s%s/%s", r.Host, r.URL.Path, strconv.Itoa(int(physicianRecord.ID))))
+		w.WriteHeader(http.StatusCreated)
+
+		fmt.Fprint(w, string(jsonData))
+	} else if r.Method == http.MethodGet {
+		params, err := parseListPhysiciansParams(r.URL.Query())
+		if err != nil {
+			log.WithContext(r.Context()).Debugf("Invalid physicians query %q: %v", r.URL.RawQuery, err)
+			writeRequestProblem(w, r, err)
+			return
+		}
+
+		// Fetch one extra row to find out if there is a next page
+		pageSize := params.Limit
+		params.Limit++
+
+		physicians, err := s.database.ListPhysicians(ctx, params)
+		if err != nil {
+			log.WithContext(r.Context()).Warnf("Failed to retrieve physicians from the database: %v", err)
+			writeProblem(w, r, problemInternal, "")
+			return
+		}
+
+		payload := pagePayload{Data: physicians}
+		if int32(len(physicians)) > pageSize {
+			physicians = physicians[:pageSize]
+			payload.Data = physicians
+
+			setNextPage(w, r, &payload, pageCursor{ID: int64(physicians[len(physicians)-1].ID)})
+		} else if physicians == nil {
+			payload.Data = []db.Physician{}
+		}
+
+		jsonData, err := marshalJSON(r.Context(), payload)
+		if err != nil {
+			log.WithContext(r.Context()).Warnf("Failed to serialise physicians to JSON: %v", err)
+			writeProblem(w, r, problemInternal, "")
+			return
+		}
+
+		fmt.Fprint(w, string(jsonData))
+	} else {
+		methodNotAllowedHandler(w, r)
+	}
+}
+
+// parseListPhysiciansParams reads the pagination query parameters of the
+// physicians collection, which is always sorted by ID
+func parseListPhysiciansParams(query url.Values) (db.ListPhysiciansParams, error) {
+	var params db.ListPhysiciansParams
+
+	limit, err := parsePageLimit(query)
+	if err != nil {
+		return db.ListPhysiciansParams{}, err
+	}
+	params.Limit = limit
+
+	if cursorString := query.Get("cursor"); cursorString != "" {
+		cursor, err := decodePageCursor(cursorString)
+		if err != nil {
+			return db.ListPhysiciansParams{}, err
+		}
+		params.ID = int32(cursor.ID)
+	}
+
+	return params, nil
+}
+
+func (s Server) physicianHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getPhysician(ctx, w, r, id)
+	case http.MethodPut:
+		s.replacePhysician(ctx, w, r, id)
+	case http.MethodPatch:
+		s.patchPhysician(ctx, w, r, id)
+	case http.MethodDelete:
+		s.deletePhysician(ctx, w, r, id)
+	default:
+		methodNotAllowedHandler(w, r)
+	}
+}
+
+func (s Server) getPhysician(ctx context.Context, w http.ResponseWriter, r *http.Request, id int32) {
+	physician, err := s.database.GetPhysician(ctx, id)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to retrieve physician %d data from the database: %v", id, err)
+		if err == sql.ErrNoRows {
+			writeProblem(w, r, problemNotFound, "")
+		} else {
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	jsonData, err := marshalJSON(r.Context(), physician)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise physician data to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+// replacePhysician implements PUT semantics: the request body must contain the
+// full physician record, which replaces the stored one
+func (s Server) replacePhysician(ctx context.Context, w http.ResponseWriter, r *http.Request, id int32) {
+	body, ok := s.readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	var physician physicianPayload
+	if err := decodePayload(body, &physician); err != nil {
+		log.WithContext(r.Context()).Debugf("Rejecting physician %d data: %v", id, err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	// The ID from the URL always wins over whatever the body contains
+	s.updatePhysician(ctx, w, r, physician.updateParams(id))
+}
+
+// patchPhysician implements JSON Merge Patch (RFC 7396) semantics on top of
+// the stored physician record
+func (s Server) patchPhysician(ctx context.Context, w http.ResponseWriter, r *http.Request, id int32) {
+	body, ok := s.readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	if err := checkMergePatch(body); err != nil {
+		log.WithContext(r.Context()).Debugf("Rejecting merge patch for physician %d: %v", id, err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	current, err := s.database.GetPhysician(ctx, id)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to retrieve physician %d data from the database: %v", id, err)
+		if err == sql.ErrNoRows {
+			writeProblem(w, r, problemNotFound, "")
+		} else {
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	physician := physicianPayload{
+		FirstName: current.FirstName,
+		LastName:  current.LastName,
+	}
+	if err := decodePatch(body, &physician); err != nil {
+		log.WithContext(r.Context()).Debugf("Rejecting merge patch for physician %d: %v", id, err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	s.updatePhysician(ctx, w, r, physician.updateParams(current.ID))
+}
+
+func (s Server) updatePhysician(ctx context.Context, w http.ResponseWriter, r *http.Request, physician db.UpdatePhysicianParams) {
+	var physicianRecord db.Physician
+	err := s.mutate(ctx, func(q queries) (string, int32, error) {
+		var err error
+		physicianRecord, err = q.UpdatePhysician(ctx, physician)
+		return "physician", physician.ID, err
+	})
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to update physician %d data in the database: %v", physician.ID, err)
+		switch {
+		case err == sql.ErrNoRows:
+			writeProblem(w, r, problemNotFound, "")
+		case db.IsConstraintViolation(err, db.UniqueViolation, "unique_physician_name"):
+			writeProblem(w, r, problemDuplicateName, "A physician with the same first and last name already exists")
+		default:
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	jsonData, err := marshalJSON(r.Context(), physicianRecord)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise physician data to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+func (s Server) deletePhysician(ctx context.Context, w http.ResponseWriter, r *http.Request, id int32) {
+	err := s.mutate(ctx, func(q queries) (string, int32, error) {
+		_, err := q.DeletePhysician(ctx, id)
+		return "physician", id, err
+	})
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to delete physician %d from the database: %v", id, err)
+		switch {
+		case err == sql.ErrNoRows:
+			writeProblem(w, r, problemNotFound, "")
+		case db.IsConstraintViolation(err, db.ForeignKeyViolation, ""):
+			writeProblem(w, r, problemResourceInUse, "The physician still has visits")
+		default:
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
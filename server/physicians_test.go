@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_PhysicianHandlers(t *testing.T) {
+	Convey("Physician handlers test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:   102400,
+			HTTPJWTVClaimName: "test",
+			HTTPJWTSigningKey: "deadbeef",
+			HTTPJWTExpiration: 1 * time.Second,
+		}
+
+		queries := &mockQueries{}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+
+		router := s.getHTTPRouter()
+		w := httptest.NewRecorder()
+
+		serve := func(method, url string, body []byte) *http.Response {
+			req := httptest.NewRequest(method, url, bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+dummyJWTToken)
+			router.ServeHTTP(w, req)
+			return w.Result()
+		}
+
+		Convey("physiciansHandler should", func() {
+			Convey("list physicians one page at a time", func() {
+				queries.Physicians = []db.Physician{{ID: 1}, {ID: 2}, {ID: 3}}
+
+				resp := serve(http.MethodGet, "http://example.com/api/v1/physicians?limit=2", nil)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+				var payload struct {
+					Data       []db.Physician `json:"data"`
+					NextCursor string         `json:"next_cursor"`
+				}
+				So(json.NewDecoder(resp.Body).Decode(&payload), ShouldBeNil)
+				So(payload.Data, ShouldHaveLength, 2)
+
+				w = httptest.NewRecorder()
+				resp = serve(http.MethodGet, "http://example.com/api/v1/physicians?limit=2&cursor="+payload.NextCursor, nil)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+				payload.NextCursor = ""
+				So(json.NewDecoder(resp.Body).Decode(&payload), ShouldBeNil)
+				So(payload.Data, ShouldResemble, []db.Physician{{ID: 3}})
+				So(payload.NextCursor, ShouldBeEmpty)
+			})
+
+			Convey("add a physician", func() {
+				resp := serve(http.MethodPost, "http://example.com/api/v1/physicians", []byte(`{"first_name":"Elrond","last_name":"Halfelven"}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusCreated)
+				So(resp.Header.Get("Location"), ShouldEqual, "http://example.com/api/v1/physicians/1")
+			})
+
+			Convey("return conflict when adding a physician with a duplicate name", func() {
+				queries.Err = &pq.Error{Code: db.UniqueViolation, Constraint: "unique_physician_name"}
+
+				resp := serve(http.MethodPost, "http://example.com/api/v1/physicians", []byte(`{"first_name":"Elrond","last_name":"Half-elven"}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+			})
+		})
+
+		Convey("physicianHandler should", func() {
+			queries.Physicians = []db.Physician{{ID: 7, FirstName: "Elrond", LastName: "Halfelven"}}
+
+			Convey("get a physician", func() {
+				resp := serve(http.MethodGet, "http://example.com/api/v1/physicians/7", nil)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+				var physician db.Physician
+				So(json.NewDecoder(resp.Body).Decode(&physician), ShouldBeNil)
+				So(physician.FirstName, ShouldEqual, "Elrond")
+			})
+
+			Convey("replace a physician", func() {
+				resp := serve(http.MethodPut, "http://example.com/api/v1/physicians/7", []byte(`{"first_name":"Arwen","last_name":"Undomiel"}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(queries.Physicians[0], ShouldResemble, db.Physician{ID: 7, FirstName: "Arwen", LastName: "Undomiel"})
+			})
+
+			Convey("patch a physician", func() {
+				resp := serve(http.MethodPatch, "http://example.com/api/v1/physicians/7", []byte(`{"first_name":"Elros"}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(queries.Physicians[0], ShouldResemble, db.Physician{ID: 7, FirstName: "Elros", LastName: "Halfelven"})
+			})
+
+			Convey("delete a physician", func() {
+				resp := serve(http.MethodDelete, "http://example.com/api/v1/physicians/7", nil)
+				So(resp.StatusCode, ShouldEqual, http.StatusNoContent)
+				So(queries.Physicians, ShouldBeEmpty)
+			})
+
+			Convey("return conflict when deleting a physician with visits", func() {
+				queries.Err = &pq.Error{Code: db.ForeignKeyViolation, Constraint: "visit_physician_id_fkey"}
+
+				resp := serve(http.MethodDelete, "http://example.com/api/v1/physicians/7", nil)
+				So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+			})
+
+			Convey("return not found for missing physicians", func() {
+				resp := serve(http.MethodGet, "http://example.com/api/v1/physicians/8", nil)
+				So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+			})
+		})
+	})
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// problemContentType is the media type of RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+// problemTypePrefix namespaces the problem type URIs, which tell clients what
+// went wrong regardless of the status code
+const problemTypePrefix = "urn:ferrum:problem:"
+
+// problemType is a kind of error which the API can return
+type problemType struct {
+	name   string
+	title  string
+	status int
+}
+
+var (
+	problemBadRequest       = problemType{"bad-request", "The request is malformed", http.StatusBadRequest}
+	problemValidation       = problemType{"validation-error", "The request contains invalid fields", http.StatusUnprocessableEntity}
+	problemUnauthorized     = problemType{"unauthorized", "The request isn't authenticated", http.StatusUnauthorized}
+	problemForbidden        = problemType{"forbidden", "The caller isn't allowed to make this request", http.StatusForbidden}
+	problemNotFound         = problemType{"not-found", "The resource doesn't exist", http.StatusNotFound}
+	problemMethodNotAllowed = problemType{"method-not-allowed", "The resource doesn't support this method", http.StatusMethodNotAllowed}
+	problemDuplicateName    = problemType{"duplicate-name", "A resource with the same name already exists", http.StatusConflict}
+	problemDuplicateID      = problemType{"duplicate-identifier", "A resource with the same identifier already exists", http.StatusConflict}
+	problemResourceInUse    = problemType{"resource-in-use", "The resource is still referenced by other resources", http.StatusConflict}
+	problemBookingConflict  = problemType{"booking-conflict", "The physician or the patient is already booked at that time", http.StatusConflict}
+	problemVisitCancelled   = problemType{"visit-cancelled", "The visit has been cancelled", http.StatusConflict}
+	problemInvalidReference = problemType{"invalid-reference", "The request refers to resources which don't exist or are invalid", http.StatusUnprocessableEntity}
+	problemTooLarge         = problemType{"request-too-large", "The request body is too large", http.StatusRequestEntityTooLarge}
+	problemInternal         = problemType{"internal-error", "The server failed to process the request", http.StatusInternalServerError}
+	problemUnavailable      = problemType{"service-unavailable", "The server isn't ready to serve requests", http.StatusServiceUnavailable}
+)
+
+// problem is the body of an error response, as described in RFC 7807
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Errors lists the invalid fields of validation errors
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// fieldError describes why a field of the request is invalid
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError is returned for requests with invalid fields
+type validationError struct {
+	fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	messages := make([]string, 0, len(e.fields))
+	for _, f := range e.fields {
+		messages = append(messages, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+
+	return "invalid fields: " + strings.Join(messages, "; ")
+}
+
+// requestError is returned for requests which the client can fix, such as the
+// ones with invalid query parameters. Its detail is sent to the client, while
+// the cause is only logged.
+type requestError struct {
+	detail string
+	cause  error
+}
+
+func (e *requestError) Error() string {
+	if e.cause == nil {
+		return e.detail
+	}
+
+	return fmt.Sprintf("%s: %v", e.detail, e.cause)
+}
+
+// badRequest creates a requestError with a detail for the client
+func badRequest(format string, args ...interface{}) *requestError {
+	return &requestError{detail: fmt.Sprintf(format, args...)}
+}
+
+// invalidField creates a validationError for a single field
+func invalidField(field, message string) *validationError {
+	return &validationError{fields: []fieldError{{Field: field, Message: message}}}
+}
+
+// writeProblem sends an error response. The detail should help the client fix
+// the request, so it must not contain any internal error messages.
+func writeProblem(w http.ResponseWriter, r *http.Request, t problemType, detail string, fields ...fieldError) {
+	p := problem{
+		Type:   problemTypePrefix + t.name,
+		Title:  t.title,
+		Status: t.status,
+		Detail: detail,
+		Errors: fields,
+	}
+	if r != nil {
+		// The query is left out, since it can contain patient data
+		p.Instance = r.URL.Path
+		p.RequestID = requestIDFromContext(r.Context())
+	}
+
+	// Marshalling a struct of strings and ints can't fail
+	jsonData, _ := json.Marshal(p)
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(t.status)
+	fmt.Fprint(w, string(jsonData))
+}
+
+// writeRequestProblem sends the error response for a request which couldn't be
+// decoded or which has invalid fields
+func writeRequestProblem(w http.ResponseWriter, r *http.Request, err error) {
+	var (
+		validationErr *validationError
+		requestErr    *requestError
+		typeErr       *json.UnmarshalTypeError
+		syntaxErr     *json.SyntaxError
+	)
+	switch {
+	case errors.As(err, &validationErr):
+		writeProblem(w, r, problemValidation, "", validationErr.fields...)
+	case errors.As(err, &requestErr):
+		writeProblem(w, r, problemBadRequest, requestErr.detail)
+	case errors.As(err, &typeErr) && typeErr.Field == "":
+		writeProblem(w, r, problemBadRequest, "The request body must be a JSON object")
+	case errors.As(err, &typeErr):
+		writeProblem(w, r, problemValidation, "", typeFieldError(typeErr.Field, typeErr))
+	case errors.As(err, &syntaxErr):
+		writeProblem(w, r, problemBadRequest, "The request body isn't valid JSON")
+	default:
+		writeProblem(w, r, problemBadRequest, "The request can't be processed")
+	}
+}
+
+// typeFieldError reports a field which holds the wrong JSON type
+func typeFieldError(field string, err *json.UnmarshalTypeError) fieldError {
+	return fieldError{Field: field, Message: fmt.Sprintf("must be a JSON %s", jsonTypeName(err.Type))}
+}
+
+// jsonTypeName returns the name of the JSON type which decodes into t
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jwtFailureDetails describe the reasons why the JWT middleware rejects tokens.
+// The messages of the middleware are only logged, since they come from the
+// parsers of the token.
+var jwtFailureDetails = map[string]string{
+	jwtFailureMissing:          "The request doesn't have a bearer token",
+	jwtFailureMalformed:        "The bearer token is malformed",
+	jwtFailureExpired:          "The bearer token has expired",
+	jwtFailureNotYetValid:      "The bearer token isn't valid yet",
+	jwtFailureInvalidSignature: "The signature of the bearer token is invalid",
+	jwtFailureInvalid:          "The bearer token is invalid",
+}
+
+// jwtErrorHandler replaces the plain text errors of the JWT middleware
+func (s Server) jwtErrorHandler(w http.ResponseWriter, r *http.Request, err string) {
+	log.WithContext(r.Context()).Debugf("Rejecting request with invalid JWT token: %s", err)
+	reason := jwtFailureReason(err)
+	s.metrics.jwtFailure(reason)
+	writeProblem(w, r, problemUnauthorized, jwtFailureDetails[reason])
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, problemNotFound, "")
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, problemMethodNotAllowed, fmt.Sprintf("%s isn't supported", r.Method))
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Problem(t *testing.T) {
+	Convey("Problem details test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+		}
+
+		queries := &mockQueries{
+			Patients: []db.Patient{{ID: 123}},
+		}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+
+		serve := func(method, url, token string, body []byte) (*httptest.ResponseRecorder, problem) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, bytes.NewReader(body))
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			req.Header.Set("X-Request-ID", "req-1")
+			s.getHTTPRouter().ServeHTTP(w, req)
+
+			var p problem
+			So(w.Header().Get("Content-Type"), ShouldEqual, problemContentType)
+			So(json.NewDecoder(w.Body).Decode(&p), ShouldBeNil)
+			So(p.Status, ShouldEqual, w.Code)
+			return w, p
+		}
+
+		token, err := s.issueToken("bilbo", RoleAdmin)
+		So(err, ShouldBeNil)
+
+		Convey("problems should identify the request", func() {
+			_, p := serve(http.MethodGet, "http://example.com/api/v1/visits/8?location=Shire", token, nil)
+			So(p, ShouldResemble, problem{
+				Type:      "urn:ferrum:problem:not-found",
+				Title:     "The resource doesn't exist",
+				Status:    http.StatusNotFound,
+				Instance:  "/api/v1/visits/8",
+				RequestID: "req-1",
+			})
+		})
+
+		Convey("the JWT middleware should report invalid tokens", func() {
+			resp, p := serve(http.MethodGet, "http://example.com/api/v1/patients/123", "", nil)
+			So(resp.Code, ShouldEqual, http.StatusUnauthorized)
+			So(p.Type, ShouldEqual, "urn:ferrum:problem:unauthorized")
+			So(p.Detail, ShouldEqual, "The request doesn't have a bearer token")
+
+			resp, p = serve(http.MethodGet, "http://example.com/api/v1/patients/123", "not.a.token", nil)
+			So(resp.Code, ShouldEqual, http.StatusUnauthorized)
+			So(p.Detail, ShouldEqual, "The bearer token is malformed")
+		})
+
+		Convey("the router should report", func() {
+			Convey("unknown routes", func() {
+				resp, p := serve(http.MethodGet, "http://example.com/api/v1/hobbits", token, nil)
+				So(resp.Code, ShouldEqual, http.StatusNotFound)
+				So(p.Type, ShouldEqual, "urn:ferrum:problem:not-found")
+			})
+
+			Convey("unsupported methods", func() {
+				resp, p := serve(http.MethodDelete, "http://example.com/api/v1/visits", token, nil)
+				So(resp.Code, ShouldEqual, http.StatusMethodNotAllowed)
+				So(p.Type, ShouldEqual, "urn:ferrum:problem:method-not-allowed")
+			})
+		})
+
+		Convey("handlers should report", func() {
+			Convey("fields with the wrong type together with the other invalid fields", func() {
+				resp, p := serve(http.MethodPost, "http://example.com/api/v1/patients", token, []byte(`{"first_name":42}`))
+				So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+				So(p.Type, ShouldEqual, "urn:ferrum:problem:validation-error")
+				So(p.Errors, ShouldResemble, []fieldError{
+					{Field: "first_name", Message: "must be a JSON string"},
+					{Field: "last_name", Message: "is required"},
+				})
+
+				resp, p = serve(http.MethodPost, "http://example.com/api/v1/visits", token, []byte(`{"patient_id":"1","location":"Bree","nickname":"Strider"}`))
+				So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+				So(p.Errors, ShouldResemble, []fieldError{
+					{Field: "nickname", Message: "isn't allowed"},
+					{Field: "patient_id", Message: "must be a JSON number"},
+					{Field: "physician_id", Message: "is required"},
+					{Field: "visited_at", Message: "is required"},
+				})
+			})
+
+			Convey("malformed JSON", func() {
+				resp, p := serve(http.MethodPost, "http://example.com/api/v1/patients", token, []byte(`{"first_name":`))
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				So(p.Type, ShouldEqual, "urn:ferrum:problem:bad-request")
+				So(p.Errors, ShouldBeEmpty)
+			})
+
+			Convey("invalid query parameters without the internal error", func() {
+				resp, p := serve(http.MethodGet, "http://example.com/api/v1/patients?created_after=yesterday", token, nil)
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				So(p.Detail, ShouldEqual, "created_after must be an RFC 3339 timestamp")
+
+				resp, p = serve(http.MethodGet, "http://example.com/api/v1/patients?cursor=%21", token, nil)
+				So(resp.Code, ShouldEqual, http.StatusBadRequest)
+				So(p.Detail, ShouldEqual, "cursor is invalid")
+			})
+
+			Convey("missing fields", func() {
+				resp, p := serve(http.MethodPost, "http://example.com/api/v1/visits", token, []byte(`{"patient_id":1,"physician_id":2}`))
+				So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+				So(p.Errors, ShouldResemble, []fieldError{{Field: "visited_at", Message: "is required"}})
+			})
+
+			Convey("duplicate identifiers apart from other conflicts", func() {
+				queries.Err = &pq.Error{Code: db.UniqueViolation, Constraint: "unique_patient_mrn"}
+				resp, p := serve(http.MethodPost, "http://example.com/api/v1/patients", token, []byte(`{"first_name":"Bilbo","last_name":"Baggins"}`))
+				So(resp.Code, ShouldEqual, http.StatusConflict)
+				So(p.Type, ShouldEqual, "urn:ferrum:problem:duplicate-identifier")
+
+				queries.Err = &pq.Error{Code: db.ForeignKeyViolation, Constraint: "visit_patient_id_fkey"}
+				resp, p = serve(http.MethodDelete, "http://example.com/api/v1/patients/123", token, nil)
+				So(resp.Code, ShouldEqual, http.StatusConflict)
+				So(p.Type, ShouldEqual, "urn:ferrum:problem:resource-in-use")
+			})
+
+			Convey("internal errors without their details", func() {
+				queries.Err = errors.New("connection refused by 10.0.0.1")
+				resp, p := serve(http.MethodPut, "http://example.com/api/v1/patients/123", token, []byte(`{"first_name":"Bilbo","last_name":"Baggins"}`))
+				So(resp.Code, ShouldEqual, http.StatusInternalServerError)
+				So(p.Type, ShouldEqual, "urn:ferrum:problem:internal-error")
+				So(p.Detail, ShouldBeEmpty)
+			})
+		})
+
+		Convey("refreshing without a refresh token should report the missing field", func() {
+			resp, p := serve(http.MethodPost, "http://example.com/auth/refresh", "", []byte(`{}`))
+			So(resp.Code, ShouldEqual, http.StatusUnprocessableEntity)
+			So(p.Errors, ShouldResemble, []fieldError{{Field: "refresh_token", Message: "is required"}})
+		})
+	})
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Role is a set of API permissions granted to a user
+type Role string
+
+// Supported Role values
+const (
+	RoleAdmin        Role = "admin"
+	RolePhysician    Role = "physician"
+	RoleReceptionist Role = "receptionist"
+	RoleAuditor      Role = "auditor"
+)
+
+// ParseRole validates a role name
+func ParseRole(name string) (Role, error) {
+	switch role := Role(name); role {
+	case RoleAdmin, RolePhysician, RoleReceptionist, RoleAuditor:
+		return role, nil
+	default:
+		return "", fmt.Errorf("unknown role %q", name)
+	}
+}
+
+// policy maps HTTP methods to the roles which are allowed to use them
+type policy map[string][]Role
+
+var (
+	allRoles   = []Role{RoleAdmin, RolePhysician, RoleReceptionist, RoleAuditor}
+	staffRoles = []Role{RoleAdmin, RolePhysician, RoleReceptionist}
+
+	// Auditors can read everything, the clinic staff can manage patients and
+	// visits, but only admins can delete patients and manage physicians
+	patientsPolicy = policy{
+		http.MethodGet:    allRoles,
+		http.MethodPost:   staffRoles,
+		http.MethodPut:    staffRoles,
+		http.MethodPatch:  staffRoles,
+		http.MethodDelete: {RoleAdmin},
+	}
+	// Merging deletes the duplicate, so it's restricted like deletions
+	mergePolicy = policy{
+		http.MethodPost: {RoleAdmin},
+	}
+	physiciansPolicy = policy{
+		http.MethodGet:    allRoles,
+		http.MethodPost:   {RoleAdmin},
+		http.MethodPut:    {RoleAdmin},
+		http.MethodPatch:  {RoleAdmin},
+		http.MethodDelete: {RoleAdmin},
+	}
+	visitsPolicy = policy{
+		http.MethodGet:   allRoles,
+		http.MethodPost:  staffRoles,
+		http.MethodPatch: staffRoles,
+	}
+	// Only auditors can read the audit log, not even admins
+	auditPolicy = policy{
+		http.MethodGet: {RoleAuditor},
+	}
+)
+
+// principal is the authenticated caller of an API request
+type principal struct {
+	Subject string
+	Roles   []Role
+}
+
+func (p principal) hasAnyRole(roles []Role) bool {
+	for _, allowed := range roles {
+		for _, role := range p.Roles {
+			if role == allowed {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type principalContextKey struct{}
+
+// principalFromContext returns the principal stored by authorize
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(principal)
+	return p, ok
+}
+
+// roleMapper extracts the caller identity from the claims of a validated JWT
+// token. The roles are read from the claim, which can be a dotted path to a
+// nested claim, such as `realm_access.roles`. Without a mapping, the claim
+// values must be Ferrum role names. Unknown roles are ignored.
+type roleMapper struct {
+	claim   string
+	mapping map[string]Role
+}
+
+// localRoles reads the tokens issued by Ferrum itself
+var localRoles = roleMapper{claim: "roles"}
+
+func (m roleMapper) principal(token *jwt.Token) principal {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return principal{}
+	}
+
+	var p principal
+	p.Subject, _ = claims["sub"].(string)
+
+	var value interface{} = map[string]interface{}(claims)
+	for _, key := range strings.Split(m.claim, ".") {
+		nested, _ := value.(map[string]interface{})
+		value = nested[key]
+	}
+
+	// Some providers use a single string for a single role
+	rawRoles, ok := value.([]interface{})
+	if !ok {
+		rawRoles = []interface{}{value}
+	}
+	for _, rawRole := range rawRoles {
+		name, _ := rawRole.(string)
+		if m.mapping != nil {
+			if role, ok := m.mapping[name]; ok {
+				p.Roles = append(p.Roles, role)
+			}
+		} else if role, err := ParseRole(name); err == nil {
+			p.Roles = append(p.Roles, role)
+		}
+	}
+
+	return p
+}
+
+// principalFromToken extracts the caller identity from a validated JWT token
+// issued by Ferrum
+func principalFromToken(token *jwt.Token) principal {
+	return localRoles.principal(token)
+}
+
+// authorize only lets the request through if the authenticated principal has
+// one of the roles allowed by the policy for the request method. It must run
+// after the JWT middleware, which stores the validated token in the context.
+func authorize(roles roleMapper, p policy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := r.Context().Value("user").(*jwt.Token)
+		if !ok {
+			writeProblem(w, r, problemUnauthorized, "")
+			return
+		}
+
+		caller := roles.principal(token)
+		if !caller.hasAnyRole(p[r.Method]) {
+			log.WithContext(r.Context()).Infof("Denied %s %s to %q with roles %v", r.Method, r.URL.Path, caller.Subject, caller.Roles)
+
+			allowed := make([]string, 0, len(p[r.Method]))
+			for _, role := range p[r.Method] {
+				allowed = append(allowed, string(role))
+			}
+			writeProblem(w, r, problemForbidden,
+				fmt.Sprintf("%s %s requires one of the roles: %s", r.Method, r.URL.Path, strings.Join(allowed, ", ")),
+			)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, caller)))
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_RBAC(t *testing.T) {
+	Convey("RBAC test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:   102400,
+			HTTPJWTVClaimName: "test",
+			HTTPJWTSigningKey: "deadbeef",
+			HTTPJWTExpiration: 1 * time.Second,
+		}
+
+		queries := &mockQueries{Patients: []db.Patient{{ID: 123}}}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+
+		router := s.getHTTPRouter()
+		w := httptest.NewRecorder()
+
+		serveAs := func(method, url string, body []byte, roles ...Role) *http.Response {
+			token, err := s.issueToken("bilbo", roles...)
+			So(err, ShouldBeNil)
+
+			req := httptest.NewRequest(method, url, bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			router.ServeHTTP(w, req)
+			return w.Result()
+		}
+
+		Convey("receptionists should be able to create patients", func() {
+			resp := serveAs(http.MethodPost, "http://example.com/api/v1/patients", []byte(`{"first_name":"Bilbo","last_name":"Baggins"}`), RoleReceptionist)
+			So(resp.StatusCode, ShouldEqual, http.StatusCreated)
+		})
+
+		Convey("receptionists should not be able to delete patients", func() {
+			resp := serveAs(http.MethodDelete, "http://example.com/api/v1/patients/123", nil, RoleReceptionist)
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+
+			So(resp.Header.Get("Content-Type"), ShouldEqual, problemContentType)
+			var payload problem
+			So(json.NewDecoder(resp.Body).Decode(&payload), ShouldBeNil)
+			So(payload.Type, ShouldEqual, "urn:ferrum:problem:forbidden")
+			So(payload.Status, ShouldEqual, http.StatusForbidden)
+			So(payload.Detail, ShouldContainSubstring, "admin")
+			So(payload.Instance, ShouldEqual, "/api/v1/patients/123")
+			So(queries.Patients, ShouldHaveLength, 1)
+		})
+
+		Convey("admins should be able to delete patients", func() {
+			resp := serveAs(http.MethodDelete, "http://example.com/api/v1/patients/123", nil, RoleAdmin)
+			So(resp.StatusCode, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("auditors should only be able to read", func() {
+			So(serveAs(http.MethodGet, "http://example.com/api/v1/patients/123", nil, RoleAuditor).StatusCode, ShouldEqual, http.StatusOK)
+
+			w = httptest.NewRecorder()
+			resp := serveAs(http.MethodPatch, "http://example.com/api/v1/patients/123", []byte(`{"first_name":"Frodo","last_name":"Baggins"}`), RoleAuditor)
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("physicians should not be able to manage physicians", func() {
+			resp := serveAs(http.MethodPost, "http://example.com/api/v1/physicians", []byte(`{"first_name":"Elrond"}`), RolePhysician)
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("tokens without roles should be rejected", func() {
+			resp := serveAs(http.MethodGet, "http://example.com/api/v1/patients/123", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// redacted replaces the PHI in log entries
+const redacted = "[REDACTED]"
+
+// redactionRule masks one kind of PHI in log messages
+type redactionRule struct {
+	name        string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// redactionRules catch the PHI which can end up in errors. Phone numbers are
+// stored in E.164 format, so only numbers which start with + are masked, which
+// keeps dates and IP addresses readable.
+var redactionRules = []redactionRule{
+	{
+		name:        "email",
+		pattern:     regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+		replacement: redacted,
+	},
+	{
+		name:        "phone",
+		pattern:     regexp.MustCompile(`\+[1-9](?:[ ().-]?[0-9]){6,14}`),
+		replacement: redacted,
+	},
+	{
+		// Postgres reports the values which break unique and exclusion
+		// constraints, such as `Key (first_name, last_name)=(Bilbo, Baggins)`
+		name:        "constraint values",
+		pattern:     regexp.MustCompile(`(\([^()]*\))=\((?:[^()]|\([^()]*\))*\)`),
+		replacement: "$1=(" + redacted + ")",
+	},
+	{
+		// Postgres reports the whole row which breaks check and not-null
+		// constraints
+		name:        "failing row",
+		pattern:     regexp.MustCompile(`Failing row contains \(.*\)`),
+		replacement: "Failing row contains (" + redacted + ")",
+	},
+	{
+		name:        "input value",
+		pattern:     regexp.MustCompile(`(invalid input (?:syntax|value) for [^:]*: )"[^"]*"`),
+		replacement: `$1"` + redacted + `"`,
+	},
+}
+
+// phiFields are the log fields which always contain PHI
+var phiFields = map[string]bool{
+	"first_name": true,
+	"last_name":  true,
+	"name":       true,
+	"address":    true,
+	"phone":      true,
+	"email":      true,
+}
+
+// redact masks the PHI in s and returns the names of the rules which matched
+func redact(s string) (string, []string) {
+	var matched []string
+	for _, rule := range redactionRules {
+		if rule.pattern.MatchString(s) {
+			s = rule.pattern.ReplaceAllString(s, rule.replacement)
+			matched = append(matched, rule.name)
+		}
+	}
+
+	return s, matched
+}
+
+// redactionHook masks the PHI in log entries before they're written. In strict
+// mode it panics instead, so tests fail when any code path logs PHI.
+type redactionHook struct {
+	strict bool
+}
+
+func (redactionHook) Levels() []log.Level { return log.AllLevels }
+
+func (h redactionHook) Fire(entry *log.Entry) error {
+	var matched []string
+	entry.Message, matched = redact(entry.Message)
+
+	for key, value := range entry.Data {
+		if phiFields[key] {
+			entry.Data[key] = redacted
+			matched = append(matched, key+" field")
+			continue
+		}
+
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case error:
+			s = v.Error()
+		case fmt.Stringer:
+			s = v.String()
+		default:
+			continue
+		}
+		if masked, fieldMatched := redact(s); len(fieldMatched) > 0 {
+			entry.Data[key] = masked
+			matched = append(matched, fieldMatched...)
+		}
+	}
+
+	if h.strict && len(matched) > 0 {
+		// The map iteration order is random
+		sort.Strings(matched)
+		panic(fmt.Sprintf("log entry contains PHI (%s): %s", strings.Join(matched, ", "), entry.Message))
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// TestMain makes every test in the package fail if the server logs any PHI
+func TestMain(m *testing.M) {
+	log.AddHook(contextLogHook{})
+	log.AddHook(redactionHook{strict: true})
+
+	os.Exit(m.Run())
+}
+
+func Test_Redaction(t *testing.T) {
+	Convey("PHI redaction test", t, func() {
+		var buf bytes.Buffer
+		logger := log.New()
+		logger.SetOutput(&buf)
+		logger.AddHook(redactionHook{})
+
+		Convey("the hook should mask", func() {
+			Convey("emails and phone numbers", func() {
+				logger.Warnf("Failed to notify bilbo.baggins@shire.example at +44 1234 567890 or +441234567891")
+				So(buf.String(), ShouldNotContainSubstring, "bilbo.baggins")
+				So(buf.String(), ShouldNotContainSubstring, "567890")
+				So(buf.String(), ShouldNotContainSubstring, "567891")
+			})
+
+			Convey("the values of constraint violations", func() {
+				err := &pq.Error{
+					Code:    db.UniqueViolation,
+					Message: "duplicate key value violates unique constraint \"unique_patient_name\"",
+					Detail:  "Key (first_name, last_name)=(Bilbo, Baggins) already exists.",
+				}
+				logger.Warnf("Failed to insert patient data into database: %v: %s", err, err.Detail)
+				So(buf.String(), ShouldContainSubstring, "unique_patient_name")
+				So(buf.String(), ShouldContainSubstring, "Key (first_name, last_name)=([REDACTED]) already exists.")
+				So(buf.String(), ShouldNotContainSubstring, "Bilbo")
+			})
+
+			Convey("failing rows and invalid input values", func() {
+				logger.Warn(`Failing row contains (7, Bilbo, Baggins, Bag End, null).`)
+				logger.Warn(`pq: invalid input syntax for type date: "Bilbo Baggins"`)
+				So(buf.String(), ShouldNotContainSubstring, "Bilbo")
+				So(buf.String(), ShouldNotContainSubstring, "Bag End")
+			})
+
+			Convey("PHI in fields and errors", func() {
+				logger.WithFields(log.Fields{
+					"first_name": "Bilbo",
+					"address":    "Bag End",
+				}).WithError(errors.New("no mail server for bilbo@shire.example")).Warn("Failed to notify patient")
+				So(buf.String(), ShouldNotContainSubstring, "Bilbo")
+				So(buf.String(), ShouldNotContainSubstring, "Bag End")
+				So(buf.String(), ShouldNotContainSubstring, "bilbo@shire.example")
+				So(buf.String(), ShouldContainSubstring, "Failed to notify patient")
+			})
+		})
+
+		Convey("the hook should keep", func() {
+			logger.Warnf("Failed to write audit entry {OccurredAt:2020-04-17 10:00:00 +0000 UTC ResourceID:123} for 10.0.0.1: pq: deadlock detected")
+			So(buf.String(), ShouldContainSubstring, "2020-04-17 10:00:00 +0000 UTC ResourceID:123} for 10.0.0.1")
+		})
+
+		Convey("strict mode should reject PHI", func() {
+			logger.ReplaceHooks(log.LevelHooks{})
+			logger.AddHook(redactionHook{strict: true})
+
+			So(func() { logger.Info("Patient 123 updated") }, ShouldNotPanic)
+			So(func() { logger.Infof("Patient bilbo@shire.example updated") }, ShouldPanicWith,
+				"log entry contains PHI (email): Patient [REDACTED] updated")
+			So(func() { logger.WithField("phone", "+441234567890").Info("Patient updated") }, ShouldPanic)
+		})
+	})
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// revocationList is the in-process cache of the `jti` claims of the access
+// tokens which were revoked before they expired. Tokens are added to it as soon
+// as they are revoked and the list is periodically reloaded from the database
+// to pick up the revocations made by other instances.
+type revocationList struct {
+	mu     sync.RWMutex
+	tokens map[string]time.Time
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{tokens: make(map[string]time.Time)}
+}
+
+func (l *revocationList) add(jti string, expiresAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens[jti] = expiresAt
+}
+
+// merge adds the tokens loaded from the database and drops the expired ones
+func (l *revocationList) merge(tokens []db.RevokedToken, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, token := range tokens {
+		l.tokens[token.Jti] = token.ExpiresAt
+	}
+	for jti, expiresAt := range l.tokens {
+		if !expiresAt.After(now) {
+			delete(l.tokens, jti)
+		}
+	}
+}
+
+func (l *revocationList) contains(jti string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	_, ok := l.tokens[jti]
+	return ok
+}
+
+// revokeToken adds the token to the denylist until it expires. Tokens without
+// a `jti` claim can't be revoked.
+func (s Server) revokeToken(ctx context.Context, token *jwt.Token) error {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil
+	}
+
+	expiresAt := s.currentTimeFn().Add(s.config.HTTPJWTExpiration)
+	if exp, ok := claims["exp"].(float64); ok {
+		expiresAt = time.Unix(int64(exp), 0)
+	}
+
+	if err := s.database.AddRevokedToken(ctx, db.AddRevokedTokenParams{Jti: jti, ExpiresAt: expiresAt}); err != nil {
+		return err
+	}
+	s.revokedTokens.add(jti, expiresAt)
+
+	return nil
+}
+
+// rejectRevoked turns away the tokens which were revoked via /auth/logout. It
+// must run after the JWT middleware, which stores the validated token in the
+// context.
+func (s Server) rejectRevoked(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := r.Context().Value("user").(*jwt.Token); ok {
+			if claims, ok := token.Claims.(jwt.MapClaims); ok {
+				if jti, _ := claims["jti"].(string); jti != "" && s.revokedTokens.contains(jti) {
+					log.WithContext(r.Context()).Infof("Rejecting revoked token %q", jti)
+					s.metrics.jwtFailure(jwtFailureRevoked)
+					writeProblem(w, r, problemUnauthorized, "The token has been revoked")
+					return
+				}
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// SyncRevokedTokens reloads the revoked tokens from the database every
+// HTTPJWTRevocationSyncInterval and deletes the expired tokens. It blocks until
+// the context is cancelled.
+func (s Server) SyncRevokedTokens(ctx context.Context) {
+	ticker := time.NewTicker(s.config.HTTPJWTRevocationSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		s.syncRevokedTokens(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s Server) syncRevokedTokens(ctx context.Context) {
+	ctx, done := context.WithTimeout(ctx, s.config.HTTPRequestTimeout)
+	defer done()
+
+	if err := s.database.DeleteExpiredRevokedTokens(ctx); err != nil {
+		log.WithContext(ctx).Warnf("Failed to delete expired revoked tokens: %v", err)
+	}
+	if err := s.database.DeleteExpiredRefreshTokens(ctx); err != nil {
+		log.WithContext(ctx).Warnf("Failed to delete expired refresh tokens: %v", err)
+	}
+
+	tokens, err := s.database.ListRevokedTokens(ctx)
+	if err != nil {
+		log.WithContext(ctx).Warnf("Failed to load revoked tokens from the database: %v", err)
+		return
+	}
+	s.revokedTokens.merge(tokens, s.currentTimeFn())
+}
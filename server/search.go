@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSearchQueryLength limits the number of characters in search queries, which
+// bounds the cost of the trigram matching
+const maxSearchQueryLength = 200
+
+// searchPatientsHandler finds the patients whose names, emails or phone numbers
+// are similar to the `q` query parameter, with the best matches first
+func (s Server) searchPatientsHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := parseSearchPatientsParams(r.URL.Query())
+	if err != nil {
+		// The query isn't logged, since it contains patient data
+		log.WithContext(r.Context()).Debugf("Invalid patient search: %v", err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	// Fetch one extra row to find out if there is a next page
+	pageSize := params.Limit
+	params.Limit++
+
+	patients, err := s.database.SearchPatients(ctx, params)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to search patients in the database: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	payload := pagePayload{Data: patients}
+	if int32(len(patients)) > pageSize {
+		patients = patients[:pageSize]
+		payload.Data = patients
+
+		last := patients[len(patients)-1]
+		setNextPage(w, r, &payload, pageCursor{
+			Key:   strconv.FormatFloat(float64(last.Score), 'g', -1, 32),
+			Query: searchQueryHash(params.Query),
+			ID:    int64(last.ID),
+		})
+	} else if patients == nil {
+		payload.Data = []db.SearchPatientsRow{}
+	}
+
+	jsonData, err := marshalJSON(r.Context(), payload)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise patients to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+// parseSearchPatientsParams reads the search and pagination query parameters
+// of the patient search
+func parseSearchPatientsParams(query url.Values) (db.SearchPatientsParams, error) {
+	var params db.SearchPatientsParams
+
+	params.Query = strings.TrimSpace(query.Get("q"))
+	if params.Query == "" {
+		return db.SearchPatientsParams{}, badRequest("q is required")
+	}
+	if utf8.RuneCountInString(params.Query) > maxSearchQueryLength {
+		return db.SearchPatientsParams{}, badRequest("q must be at most %d characters long", maxSearchQueryLength)
+	}
+
+	limit, err := parsePageLimit(query)
+	if err != nil {
+		return db.SearchPatientsParams{}, err
+	}
+	params.Limit = limit
+
+	if cursorString := query.Get("cursor"); cursorString != "" {
+		cursor, err := decodePageCursor(cursorString)
+		if err != nil {
+			return db.SearchPatientsParams{}, err
+		}
+		score, err := strconv.ParseFloat(cursor.Key, 32)
+		if err != nil || cursor.Sort != "" {
+			return db.SearchPatientsParams{}, badRequest("cursor doesn't belong to a search")
+		}
+		// The scores of the next page only follow the ones of the same query
+		if cursor.Query != searchQueryHash(params.Query) {
+			return db.SearchPatientsParams{}, badRequest("cursor doesn't match the search query")
+		}
+		params.AfterScore = float32(score)
+		params.AfterID = int32(cursor.ID)
+	}
+
+	return params, nil
+}
+
+// searchQueryHash identifies a search query in the cursors of its pages
+// without copying the patient data which the query contains
+func searchQueryHash(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
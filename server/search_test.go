@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_PatientSearch(t *testing.T) {
+	Convey("Patient search test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+		}
+
+		queries := &mockQueries{
+			Patients: []db.Patient{
+				{ID: 1, FirstName: "Bilbo", LastName: "Baggins"},
+				{ID: 2, FirstName: "Frodo", LastName: "Baggins"},
+				{ID: 3, FirstName: "Lobelia", LastName: "Sackville-Baggins"},
+			},
+		}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+
+		token, err := s.issueToken("bilbo", RoleReceptionist)
+		So(err, ShouldBeNil)
+
+		search := func(query string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/patients/search?"+query, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			s.getHTTPRouter().ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("the search should return ranked pages of patients", func() {
+			resp := search("q=bagins&limit=2")
+			So(resp.Code, ShouldEqual, http.StatusOK)
+			So(queries.SearchPatientsArgs.Query, ShouldEqual, "bagins")
+
+			var page struct {
+				Data       []db.SearchPatientsRow `json:"data"`
+				NextCursor string                 `json:"next_cursor"`
+			}
+			So(json.NewDecoder(resp.Body).Decode(&page), ShouldBeNil)
+			So(page.Data, ShouldHaveLength, 2)
+			So(page.Data[0].FirstName, ShouldEqual, "Bilbo")
+			So(page.Data[0].Score, ShouldEqual, 1)
+			So(page.Data[1].Score, ShouldEqual, 0.5)
+			So(resp.Header().Get("Link"), ShouldContainSubstring, `rel="next"`)
+
+			params, err := parseSearchPatientsParams(url.Values{"q": {"bagins"}, "cursor": {page.NextCursor}})
+			So(err, ShouldBeNil)
+			So(params.AfterScore, ShouldEqual, 0.5)
+			So(params.AfterID, ShouldEqual, 2)
+		})
+
+		Convey("the search should return an empty list without matches", func() {
+			queries.Patients = nil
+			resp := search("q=gollum")
+			So(resp.Code, ShouldEqual, http.StatusOK)
+			So(resp.Body.String(), ShouldEqual, `{"data":[]}`)
+		})
+
+		Convey("the search should not be mistaken for a patient ID", func() {
+			resp := search("")
+			So(resp.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("parseSearchPatientsParams should reject invalid parameters", func() {
+			for _, query := range []url.Values{
+				{},
+				{"q": {"   "}},
+				{"q": {strings.Repeat("a", maxSearchQueryLength+1)}},
+				{"q": {"bilbo"}, "limit": {"0"}},
+				{"q": {"bilbo"}, "cursor": {pageCursor{Sort: "last_name", Key: "Baggins", ID: 1}.encode()}},
+				{"q": {"bilbo"}, "cursor": {pageCursor{Key: "0.5", Query: searchQueryHash("frodo"), ID: 1}.encode()}},
+			} {
+				_, err := parseSearchPatientsParams(query)
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey("encrypted contact data should only be matched through blind indexes", func() {
+			pc, err := newPatientCipher([]byte(strings.Repeat("k", 32)))
+			So(err, ShouldBeNil)
+			s.database = newEncryptedStore(queries, pc)
+
+			resp := search("q=" + url.QueryEscape("bilbo@shire.example"))
+			So(resp.Code, ShouldEqual, http.StatusOK)
+			So(queries.SearchPatientsArgs.ExcludeContact, ShouldBeTrue)
+			So(queries.SearchPatientsArgs.EmailIndexes, ShouldResemble, []string{pc.emailIndex("bilbo@shire.example")})
+		})
+	})
+}
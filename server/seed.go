@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mihaitodor/ferrum/db"
+	"github.com/mihaitodor/ferrum/db/date"
+)
+
+// seedData returns a small set of demo physicians, patients and visits. The
+// visits are booked over the next few days, starting from now. The patients
+// get their MRNs from the allocator.
+func seedData(now time.Time) Export {
+	tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+
+	return Export{
+		Physicians: []db.Physician{
+			{ID: 1, FirstName: "Gregory", LastName: "House"},
+			{ID: 2, FirstName: "Meredith", LastName: "Grey"},
+		},
+		Patients: []db.Patient{
+			{ID: 1, FirstName: "Bilbo", LastName: "Baggins", Address: "Bag End, Hobbiton", Phone: "+441234567890", Email: "bilbo@shire.example", DateOfBirth: date.New(1937, time.September, 21)},
+			{ID: 2, FirstName: "Frodo", LastName: "Baggins", Address: "Bag End, Hobbiton", Phone: "+441234567891", Email: "frodo@shire.example", DateOfBirth: date.New(1954, time.July, 29)},
+			{ID: 3, FirstName: "Samwise", LastName: "Gamgee", Address: "3 Bagshot Row, Hobbiton", Phone: "+441234567892", Email: "sam@shire.example", DateOfBirth: date.New(1955, time.October, 20)},
+		},
+		Visits: []db.Visit{
+			{ID: 1, PatientID: 1, PhysicianID: 1, VisitedAt: tomorrow.Add(9 * time.Hour), DurationMinutes: 30, Location: "Room 1", Reason: "Check-up"},
+			{ID: 2, PatientID: 2, PhysicianID: 1, VisitedAt: tomorrow.Add(10 * time.Hour), DurationMinutes: 60, Location: "Room 1", Reason: "Shoulder pain"},
+			{ID: 3, PatientID: 3, PhysicianID: 2, VisitedAt: tomorrow.Add(33 * time.Hour), DurationMinutes: 30, Location: "Room 2", Reason: "Vaccination"},
+		},
+	}
+}
+
+// Seed fills an empty database with demo data. It leaves databases which
+// already contain patients or physicians untouched and returns false.
+func (s Server) Seed(ctx context.Context) (bool, error) {
+	patients, err := s.database.ListPatients(ctx, db.ListPatientsParams{SortBy: db.PatientSortLastName, Limit: 1})
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve patients: %v", err)
+	}
+	physicians, err := s.database.ListPhysicians(ctx, db.ListPhysiciansParams{Limit: 1})
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve physicians: %v", err)
+	}
+	if len(patients) > 0 || len(physicians) > 0 {
+		return false, nil
+	}
+
+	if err := s.Import(ctx, seedData(s.currentTimeFn())); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
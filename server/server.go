@@ -2,8 +2,10 @@ package server
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
@@ -15,14 +17,72 @@ import (
 
 type dbConn interface {
 	db.DBTX
-	Ping() error
+	BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+	PingContext(context.Context) error
+	Stats() sql.DBStats
 	Close() error
 }
 
 type queries interface {
 	AddPatient(context.Context, db.AddPatientParams) (db.Patient, error)
 	GetPatient(context.Context, int32) (db.Patient, error)
-	GetPatients(context.Context) ([]db.Patient, error)
+	GetPatientForUpdate(context.Context, int32) (db.Patient, error)
+	ListPatients(context.Context, db.ListPatientsParams) ([]db.Patient, error)
+	SearchPatients(context.Context, db.SearchPatientsParams) ([]db.SearchPatientsRow, error)
+	ListDuplicateCandidates(context.Context, db.ListDuplicateCandidatesParams) ([]db.ListDuplicateCandidatesRow, error)
+	UpdatePatient(context.Context, db.UpdatePatientParams) (db.Patient, error)
+	DeletePatient(context.Context, int32) (int32, error)
+	NextPatientMRN(context.Context) (int64, error)
+	PatientMRNExists(context.Context, string) (bool, error)
+	AddPatientIdentifier(context.Context, db.AddPatientIdentifierParams) (db.PatientIdentifier, error)
+	ListPatientIdentifiers(context.Context, int32) ([]db.PatientIdentifier, error)
+	ListIdentifiers(context.Context, db.ListIdentifiersParams) ([]db.PatientIdentifier, error)
+	DeletePatientIdentifier(context.Context, db.DeletePatientIdentifierParams) (int32, error)
+	MovePatientIdentifiers(context.Context, db.MovePatientIdentifiersParams) (int64, error)
+	SetPatientEmailIndex(context.Context, db.SetPatientEmailIndexParams) error
+	SetPatientPhoneIndex(context.Context, db.SetPatientPhoneIndexParams) error
+	ReencryptPatient(context.Context, db.ReencryptPatientParams) (int64, error)
+	AddPhysician(context.Context, db.AddPhysicianParams) (db.Physician, error)
+	GetPhysician(context.Context, int32) (db.Physician, error)
+	ListPhysicians(context.Context, db.ListPhysiciansParams) ([]db.Physician, error)
+	UpdatePhysician(context.Context, db.UpdatePhysicianParams) (db.Physician, error)
+	DeletePhysician(context.Context, int32) (int32, error)
+	AddVisit(context.Context, db.AddVisitParams) (db.Visit, error)
+	ImportVisit(context.Context, db.ImportVisitParams) (db.Visit, error)
+	GetVisit(context.Context, int32) (db.Visit, error)
+	ListVisits(context.Context, db.ListVisitsParams) ([]db.Visit, error)
+	ListPatientVisits(context.Context, db.ListPatientVisitsParams) ([]db.Visit, error)
+	MovePatientVisits(context.Context, db.MovePatientVisitsParams) (int64, error)
+	ListPhysicianVisits(context.Context, db.ListPhysicianVisitsParams) ([]db.Visit, error)
+	RescheduleVisit(context.Context, db.RescheduleVisitParams) (db.Visit, error)
+	CancelVisit(context.Context, int32) (db.Visit, error)
+	AddUser(context.Context, db.AddUserParams) (db.User, error)
+	GetUser(context.Context, int32) (db.User, error)
+	GetUserByUsername(context.Context, string) (db.User, error)
+	AddRefreshToken(context.Context, db.AddRefreshTokenParams) (db.RefreshToken, error)
+	RevokeRefreshToken(context.Context, string) (db.RefreshToken, error)
+	DeleteExpiredRefreshTokens(context.Context) error
+	AddRevokedToken(context.Context, db.AddRevokedTokenParams) error
+	ListRevokedTokens(context.Context) ([]db.RevokedToken, error)
+	DeleteExpiredRevokedTokens(context.Context) error
+	LockAuditLog(context.Context) error
+	GetLastAuditEntry(context.Context) (db.AuditLog, error)
+	GetAuditEntry(context.Context, int64) (db.AuditLog, error)
+	AddAuditEntry(context.Context, db.AddAuditEntryParams) error
+	ListAuditEntries(context.Context, db.ListAuditEntriesParams) ([]db.AuditLog, error)
+	ListAuditChain(context.Context, db.ListAuditChainParams) ([]db.AuditLog, error)
+	GetSchemaVersion(context.Context) (int64, error)
+}
+
+// store runs queries either on their own or in a transaction
+type store interface {
+	queries
+	// ExecTx runs fn in a transaction, which is committed if fn succeeds and
+	// rolled back otherwise
+	ExecTx(ctx context.Context, fn func(queries) error) error
+	// ReadTx runs fn in a read-only transaction, in which all the queries see
+	// the same snapshot of the database
+	ReadTx(ctx context.Context, fn func(queries) error) error
 }
 
 // Server implements the main processing logic
@@ -30,13 +90,47 @@ type Server struct {
 	config          config.Config
 	databaseConnURL string
 	databaseConn    dbConn
-	database        queries
+	database        store
+	migrator        *db.Migrator
+	health          *healthState
+	metrics         *metrics
+	accessLog       *log.Logger
+	keys            *keyring
+	checkpointKeys  *keyring
+	oidc            *oidcProvider
+	mrns            mrnAllocator
+	revokedTokens   *revocationList
 	httpServer      *http.Server
 	currentTimeFn   func() time.Time
 }
 
 // New creates a new Server instance
 func New(c config.Config) (Server, error) {
+	keys, err := loadKeyring(c)
+	if err != nil {
+		return Server{}, fmt.Errorf("failed to load JWT keys: %v", err)
+	}
+
+	checkpointKeys, err := loadCheckpointKeyring(c)
+	if err != nil {
+		return Server{}, fmt.Errorf("failed to load audit checkpoint keys: %v", err)
+	}
+
+	patientCipher, err := loadPatientCipher(c)
+	if err != nil {
+		return Server{}, fmt.Errorf("failed to load patient data keys: %v", err)
+	}
+
+	oidc, err := newOIDCProvider(c)
+	if err != nil {
+		return Server{}, fmt.Errorf("failed to configure OIDC: %v", err)
+	}
+
+	mrns, err := newMRNAllocator(c)
+	if err != nil {
+		return Server{}, fmt.Errorf("failed to configure the MRN allocator: %v", err)
+	}
+
 	databaseConnURL := db.GetConnectionURL(c)
 	databaseConn, err := db.Connect(databaseConnURL)
 	if err != nil {
@@ -45,10 +139,39 @@ func New(c config.Config) (Server, error) {
 		)
 	}
 
+	migrator, err := db.NewMigrator(databaseConn)
+	if err != nil {
+		return Server{}, fmt.Errorf("failed to load database migrations: %v", err)
+	}
+
+	metrics := newMetrics(c, databaseConn)
+
+	var database store = sqlStore{Queries: db.New(instrumentDB(metrics, databaseConn)), conn: databaseConn, metrics: metrics}
+	if patientCipher != nil {
+		database = newEncryptedStore(database, patientCipher)
+	}
+
+	var accessLog *log.Logger
+	if c.HTTPAccessLog {
+		accessLog = newAccessLogger(os.Stdout)
+	}
+
+	// Connections are only opened when needed, so the queries can be set up
+	// before the database is reachable
 	return Server{
 		config:          c,
 		databaseConnURL: databaseConnURL,
 		databaseConn:    databaseConn,
+		database:        database,
+		migrator:        migrator,
+		health:          newHealthState(migrator.Latest()),
+		metrics:         metrics,
+		accessLog:       accessLog,
+		keys:            keys,
+		checkpointKeys:  checkpointKeys,
+		oidc:            oidc,
+		mrns:            mrns,
+		revokedTokens:   newRevocationList(),
 		httpServer: &http.Server{
 			Addr:         ":" + strconv.FormatUint(uint64(c.HTTPAPIPort), 10),
 			ReadTimeout:  c.HTTPRequestTimeout,
@@ -58,7 +181,9 @@ func New(c config.Config) (Server, error) {
 	}, nil
 }
 
-// ConnectDatabase establishes a connection to the database
+// ConnectDatabase establishes a connection to the database and applies the
+// pending migrations if auto-migration is enabled. The server reports that it's
+// not ready until it returns.
 func (s Server) ConnectDatabase(ctx context.Context) error {
 	pingAttempts := 0
 	// TODO: Configure exponential backoff limits
@@ -67,8 +192,8 @@ func (s Server) ConnectDatabase(ctx context.Context) error {
 		func() error {
 			pingAttempts++
 
-			if err := s.databaseConn.Ping(); err != nil {
-				log.Warnf("Failed to ping database: %v", err)
+			if err := s.pingDatabase(ctx); err != nil {
+				log.WithContext(ctx).Warnf("Failed to ping database: %v", err)
 
 				return err
 			}
@@ -86,9 +211,15 @@ func (s Server) ConnectDatabase(ctx context.Context) error {
 		)
 	}
 
-	s.database = db.New(s.databaseConn)
+	log.WithContext(ctx).Infof("Connected to DB at %q", s.databaseConnURL)
+
+	if s.config.DatabaseAutoMigrate {
+		if err := s.MigrateUp(ctx); err != nil {
+			return fmt.Errorf("failed to migrate database: %v", err)
+		}
+	}
 
-	log.Infof("Connected to DB at %q", s.databaseConnURL)
+	s.health.setConnected()
 
 	return nil
 }
@@ -101,8 +232,17 @@ func (s Server) ListenAndServe() {
 	}
 }
 
-// Shutdown shuts down the server gracefully
+// Shutdown shuts down the server gracefully. It fails the readiness probe and
+// keeps serving requests for HTTPShutdownDrainDelay before it stops accepting
+// them, so the context must allow for the delay.
 func (s Server) Shutdown(ctx context.Context) error {
+	s.health.setShuttingDown()
+
+	select {
+	case <-time.After(s.config.HTTPShutdownDrainDelay):
+	case <-ctx.Done():
+	}
+
 	err := s.httpServer.Shutdown(ctx)
 
 	if errDBShutdown := s.databaseConn.Close(); errDBShutdown != nil {
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// sqlStore implements store on top of the sqlc queries
+type sqlStore struct {
+	*db.Queries
+	conn    dbConn
+	metrics *metrics
+}
+
+// instrumentDB traces and times the queries which run on conn
+func instrumentDB(m *metrics, conn db.DBTX) db.DBTX {
+	return tracedDB{DBTX: m.instrument(conn)}
+}
+
+func (s sqlStore) ExecTx(ctx context.Context, fn func(queries) error) error {
+	return s.execTx(ctx, nil, fn)
+}
+
+func (s sqlStore) ReadTx(ctx context.Context, fn func(queries) error) error {
+	return s.execTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}, fn)
+}
+
+func (s sqlStore) execTx(ctx context.Context, opts *sql.TxOptions, fn func(queries) error) error {
+	tx, err := s.conn.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+
+	// The error of fn is returned as is, since the callers check for specific
+	// errors, such as sql.ErrNoRows
+	if err := fn(db.New(instrumentDB(s.metrics, tx))); err != nil {
+		if errRollback := tx.Rollback(); errRollback != nil {
+			log.WithContext(ctx).Warnf("Failed to roll back transaction: %v", errRollback)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return nil
+}
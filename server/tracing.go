@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Supported config.TracingExporter values
+const (
+	tracingExporterNone   = "none"
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+)
+
+// tracer creates the spans of the server. It uses the global tracer provider,
+// which doesn't record anything until SetupTracing replaces it.
+var tracer = otel.Tracer("github.com/mihaitodor/ferrum/server")
+
+// traceContext reads and writes W3C traceparent headers
+var traceContext = propagation.TraceContext{}
+
+// SetupTracing configures the OpenTelemetry exporter. It returns a function which
+// flushes the pending spans, to be called on shutdown.
+func SetupTracing(c config.Config) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.TracingExporter {
+	case tracingExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case tracingExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.TracingOTLPEndpoint)}
+		if c.TracingOTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		// The exporter connects when it sends the first batch of spans
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case tracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", c.TracingExporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %v", c.TracingExporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.TracingSampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String("ferrum"),
+			semconv.ServiceVersionKey.String(c.Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(traceContext)
+
+	return provider.Shutdown, nil
+}
+
+// traceHTTP starts a span for each request served by router, which continues
+// the trace of the caller if the request has a traceparent header. The spans
+// are named after the route template and, since the query and the path can
+// contain patient data, they don't record the URL.
+func traceHTTP(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := routeTemplate(router, r)
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPRouteKey.String(route),
+			semconv.HTTPStatusCodeKey.Int(status),
+		)
+		// Client errors aren't failures of the server
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// marshalJSON serialises a response body in its own span, since it can take a
+// while for long lists
+func marshalJSON(ctx context.Context, v interface{}) ([]byte, error) {
+	_, span := tracer.Start(ctx, "json.Marshal")
+	defer span.End()
+
+	data, err := json.Marshal(v)
+	recordSpanError(span, err)
+
+	return data, err
+}
+
+// tracedDB starts a child span for each query which runs on it, named after its
+// sqlc `-- name:` comment
+type tracedDB struct {
+	db.DBTX
+}
+
+func startQuerySpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	name := queryName(query)
+
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationKey.String(name),
+		),
+	)
+}
+
+func (d tracedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startQuerySpan(ctx, query)
+	defer span.End()
+
+	result, err := d.DBTX.ExecContext(ctx, query, args...)
+	recordSpanError(span, err)
+
+	return result, err
+}
+
+func (d tracedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startQuerySpan(ctx, query)
+	defer span.End()
+
+	rows, err := d.DBTX.QueryContext(ctx, query, args...)
+	recordSpanError(span, err)
+
+	return rows, err
+}
+
+// QueryRowContext can't record errors, since they're returned by Scan
+func (d tracedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := startQuerySpan(ctx, query)
+	defer span.End()
+
+	return d.DBTX.QueryRowContext(ctx, query, args...)
+}
+
+// pingDatabase checks the database connection in its own span
+func (s Server) pingDatabase(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "Ping",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL),
+	)
+	defer span.End()
+
+	err := s.databaseConn.PingContext(ctx)
+	recordSpanError(span, err)
+
+	return err
+}
+
+// recordSpanError marks the span as failed, apart from queries which don't
+// return any rows, which the callers usually expect. Spans are exported to
+// systems which aren't cleared for PHI, so they only get a description of
+// the error.
+func recordSpanError(span trace.Span, err error) {
+	if err == nil || errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+
+	description := spanErrorDescription(err)
+	span.AddEvent(semconv.ExceptionEventName, trace.WithAttributes(
+		semconv.ExceptionTypeKey.String(fmt.Sprintf("%T", err)),
+		semconv.ExceptionMessageKey.String(description),
+	))
+	span.SetStatus(codes.Error, description)
+}
+
+// spanErrorDescription describes Postgres errors by their SQLSTATE code and
+// constraint, since their messages can contain the values of the rows. Other
+// errors are masked with the redaction rules of the logs.
+func spanErrorDescription(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		description := "SQLSTATE " + string(pqErr.Code)
+		if pqErr.Constraint != "" {
+			description += " (" + pqErr.Constraint + ")"
+		}
+		return description
+	}
+
+	description, _ := redact(err.Error())
+	return description
+}
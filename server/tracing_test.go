@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanRecorder     = tracetest.NewSpanRecorder()
+	spanRecorderOnce sync.Once
+)
+
+// recordSpans sends the spans of the package tracer to spanRecorder. The global
+// tracer provider can only be replaced once, so the tests share the recorder
+// and tell their spans apart by trace ID.
+func recordSpans() {
+	spanRecorderOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+}
+
+func endedSpans(traceID trace.TraceID) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spanRecorder.Ended() {
+		if span.SpanContext().TraceID() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+	return spans
+}
+
+func Test_Tracing(t *testing.T) {
+	Convey("Tracing test", t, func() {
+		recordSpans()
+
+		c := config.Config{
+			HTTPMaxPOSTSize:    102400,
+			HTTPRequestTimeout: 1 * time.Second,
+			HTTPJWTVClaimName:  "test",
+			HTTPJWTSigningKey:  "deadbeef",
+			HTTPJWTExpiration:  1 * time.Hour,
+		}
+
+		dbConn := &mockDBConn{}
+		queries := &mockQueries{Patients: []db.Patient{{ID: 123}}}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+		s.databaseConn = dbConn
+
+		token, err := s.issueToken("bilbo", RoleAdmin)
+		So(err, ShouldBeNil)
+
+		traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+		parentID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+
+		Convey("requests should continue the trace of the caller", func() {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/patients/123?name=Bilbo", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			s.getHTTPRouter().ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			spans := endedSpans(traceID)
+			server, ok := spans["GET /api/v1/patients/{id}"]
+			So(ok, ShouldBeTrue)
+			So(server.Parent().SpanID(), ShouldEqual, parentID)
+			So(server.SpanKind(), ShouldEqual, trace.SpanKindServer)
+			for _, attr := range server.Attributes() {
+				So(attr.Value.Emit(), ShouldNotContainSubstring, "Bilbo")
+			}
+
+			marshal, ok := spans["json.Marshal"]
+			So(ok, ShouldBeTrue)
+			So(marshal.Parent().SpanID(), ShouldEqual, server.SpanContext().SpanID())
+		})
+
+		Convey("server errors should fail the request span", func() {
+			queries.Err = context.DeadlineExceeded
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut, "http://example.com/api/v1/patients/123", bytes.NewReader([]byte(`{"first_name":"Bilbo","last_name":"Baggins"}`)))
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4737-00f067aa0ba902b7-01")
+			s.getHTTPRouter().ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusInternalServerError)
+
+			traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4737")
+			So(endedSpans(traceID)["PUT /api/v1/patients/{id}"].Status().Code, ShouldEqual, codes.Error)
+		})
+
+		Convey("queries and pings should have child spans", func() {
+			ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    traceID,
+				SpanID:     parentID,
+				TraceFlags: trace.FlagsSampled,
+				Remote:     true,
+			}))
+
+			_, err := tracedDB{DBTX: dbConn}.ExecContext(ctx, "-- name: DeletePatient :one\nDELETE FROM patient")
+			So(err, ShouldBeNil)
+
+			dbConn.failPing = true
+			So(s.pingDatabase(ctx), ShouldNotBeNil)
+
+			spans := endedSpans(traceID)
+			So(spans["DeletePatient"].Parent().SpanID(), ShouldEqual, parentID)
+			So(spans["DeletePatient"].SpanKind(), ShouldEqual, trace.SpanKindClient)
+			So(spans["Ping"].Status().Code, ShouldEqual, codes.Error)
+		})
+
+		Convey("failed spans shouldn't contain the error messages of Postgres", func() {
+			_, span := tracer.Start(context.Background(), "AddPatient")
+			recordSpanError(span, &pq.Error{
+				Code:       db.UniqueViolation,
+				Message:    `duplicate key value violates unique constraint "unique_patient_mrn"`,
+				Detail:     "Key (mrn)=(MRN00000123) already exists.",
+				Constraint: "unique_patient_mrn",
+			})
+			span.End()
+
+			recorded := spanRecorder.Ended()[len(spanRecorder.Ended())-1]
+			So(recorded.Status().Code, ShouldEqual, codes.Error)
+			So(recorded.Status().Description, ShouldEqual, "SQLSTATE 23505 (unique_patient_mrn)")
+			So(recorded.Events(), ShouldHaveLength, 1)
+			for _, attr := range recorded.Events()[0].Attributes {
+				So(attr.Value.Emit(), ShouldNotContainSubstring, "MRN00000123")
+			}
+		})
+
+		Convey("failed spans should mask the PHI in other errors", func() {
+			_, span := tracer.Start(context.Background(), "Decrypt")
+			recordSpanError(span, errors.New("failed to decrypt bilbo@shire.me"))
+			span.End()
+
+			recorded := spanRecorder.Ended()[len(spanRecorder.Ended())-1]
+			So(recorded.Status().Description, ShouldEqual, "failed to decrypt "+redacted)
+		})
+
+		Convey("log entries should contain the trace ID", func() {
+			ctx, span := tracer.Start(context.Background(), "test")
+			defer span.End()
+
+			var buf bytes.Buffer
+			logger := log.New()
+			logger.SetOutput(&buf)
+			logger.AddHook(contextLogHook{})
+			logger.WithContext(ctx).Info("Hello")
+			logger.Info("Hello again")
+
+			So(buf.String(), ShouldContainSubstring, "trace_id="+span.SpanContext().TraceID().String())
+			So(bytes.Count(buf.Bytes(), []byte("trace_id")), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mihaitodor/ferrum/db/date"
+)
+
+// timeType is the type of the timestamp fields
+var timeType = reflect.TypeOf(time.Time{})
+
+// readOnlyFields are returned by the API, but they're ignored in request bodies,
+// so clients can send back the records which they have read
+var readOnlyFields = map[string]bool{"id": true, "created_at": true}
+
+var (
+	// phoneSeparators are stripped from phone numbers before they're checked
+	phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+	// e164Regexp matches E.164 phone numbers, which have at most 15 digits
+	e164Regexp = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+)
+
+// validationRule checks a field and returns a message if it's invalid. Rules
+// can normalise the field, since they're given a settable value.
+type validationRule func(field reflect.Value, arg string) string
+
+// validationRules are the rules which can be used in `validate` struct tags,
+// such as `validate:"required,max=100"`. Strings are trimmed before they're
+// checked and, except for `required`, the rules skip empty strings.
+var validationRules = map[string]validationRule{
+	"required": func(field reflect.Value, _ string) string {
+		if field.IsZero() {
+			return "is required"
+		}
+		return ""
+	},
+	"min": func(field reflect.Value, arg string) string {
+		limit, _ := strconv.Atoi(arg)
+		switch field.Kind() {
+		case reflect.String:
+			if utf8.RuneCountInString(field.String()) < limit {
+				return fmt.Sprintf("must be at least %d characters long", limit)
+			}
+		default:
+			if field.Int() < int64(limit) {
+				return fmt.Sprintf("must be at least %d", limit)
+			}
+		}
+		return ""
+	},
+	"max": func(field reflect.Value, arg string) string {
+		limit, _ := strconv.Atoi(arg)
+		switch field.Kind() {
+		case reflect.String:
+			if utf8.RuneCountInString(field.String()) > limit {
+				return fmt.Sprintf("must be at most %d characters long", limit)
+			}
+		default:
+			if field.Int() > int64(limit) {
+				return fmt.Sprintf("must be at most %d", limit)
+			}
+		}
+		return ""
+	},
+	"email": func(field reflect.Value, _ string) string {
+		// Display names such as "Bilbo <bilbo@shire.example>" aren't allowed
+		address, err := mail.ParseAddress(field.String())
+		if err != nil || address.Address != field.String() {
+			return "must be an email address"
+		}
+		return ""
+	},
+	"phone": func(field reflect.Value, _ string) string {
+		phone := phoneSeparators.Replace(field.String())
+		if strings.HasPrefix(phone, "00") {
+			phone = "+" + phone[2:]
+		}
+		if !e164Regexp.MatchString(phone) {
+			return "must be an international phone number, such as +14155552671"
+		}
+		field.SetString(phone)
+		return ""
+	},
+	"uri": func(field reflect.Value, _ string) string {
+		if u, err := url.Parse(field.String()); err != nil || u.Scheme == "" {
+			return "must be an absolute URI, such as https://example.org/ids"
+		}
+		return ""
+	},
+	"date": func(field reflect.Value, _ string) string {
+		if _, err := date.Parse(field.String()); err != nil {
+			return "must be a date, such as 1990-04-17"
+		}
+		return ""
+	},
+	"past": func(field reflect.Value, _ string) string {
+		if d, _ := date.Parse(field.String()); d.Time.After(time.Now()) {
+			return "must be in the past"
+		}
+		return ""
+	},
+}
+
+// decodePayload decodes a JSON object into payload, which must be a pointer to
+// a struct, and validates it. The unknown fields are reported together with the
+// fields which break the rules in their `validate` tags.
+func decodePayload(body []byte, payload interface{}) error {
+	return decodeFields(body, payload, false)
+}
+
+// decodePatch applies a JSON Merge Patch (RFC 7396) on top of payload. Only the
+// fields in the patch are validated, so stored records which predate the rules
+// can still be patched.
+func decodePatch(body []byte, payload interface{}) error {
+	return decodeFields(body, payload, true)
+}
+
+// decodeFields decodes the fields of the JSON object one by one, so the fields
+// with the wrong type are reported together with the other invalid fields
+func decodeFields(body []byte, payload interface{}, onlyPresent bool) error {
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(body, &present); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(payload).Elem()
+	known := make(map[string]bool, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		known[jsonFieldName(v.Type().Field(i))] = true
+	}
+
+	var fields []fieldError
+	names := make([]string, 0, len(present))
+	for name := range present {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !known[name] && !readOnlyFields[name] {
+			fields = append(fields, fieldError{Field: name, Message: "isn't allowed"})
+		}
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		name := jsonFieldName(v.Type().Field(i))
+		raw, ok := present[name]
+		if onlyPresent && !ok {
+			continue
+		}
+		if ok {
+			var typeErr *json.UnmarshalTypeError
+			err := json.Unmarshal(raw, v.Field(i).Addr().Interface())
+			switch {
+			// Times are decoded from RFC 3339 strings, so malformed strings
+			// (*time.ParseError) and other JSON types get the same message
+			case err != nil && v.Field(i).Type() == timeType:
+				fields = append(fields, fieldError{Field: name, Message: "must be an RFC 3339 time, such as 2020-04-17T10:00:00Z"})
+				continue
+			case errors.As(err, &typeErr):
+				fields = append(fields, typeFieldError(name, typeErr))
+				continue
+			case err != nil:
+				return err
+			}
+		}
+		if message := validateField(v.Field(i), v.Type().Field(i).Tag.Get("validate")); message != "" {
+			fields = append(fields, fieldError{Field: name, Message: message})
+		}
+	}
+
+	if len(fields) > 0 {
+		return &validationError{fields: fields}
+	}
+
+	return nil
+}
+
+// validateField applies the rules of a `validate` tag in order and returns the
+// message of the first one which fails
+func validateField(field reflect.Value, tag string) string {
+	if field.Kind() == reflect.String {
+		field.SetString(strings.TrimSpace(field.String()))
+	}
+	if tag == "" {
+		return ""
+	}
+
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+
+		check, ok := validationRules[name]
+		if !ok {
+			panic(fmt.Sprintf("unknown validation rule %q", name))
+		}
+		if name != "required" && field.Kind() == reflect.String && field.Len() == 0 {
+			continue
+		}
+		if message := check(field, arg); message != "" {
+			return message
+		}
+	}
+
+	return ""
+}
+
+// jsonFieldName returns the name of a struct field in JSON
+func jsonFieldName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Validation(t *testing.T) {
+	Convey("Validation test", t, func() {
+		Convey("decodePayload should", func() {
+			Convey("accept valid payloads", func() {
+				var p patientPayload
+				err := decodePayload([]byte(`{"first_name":" Bilbo ","last_name":"Baggins","email":"bilbo@shire.example"}`), &p)
+				So(err, ShouldBeNil)
+				So(p.FirstName, ShouldEqual, "Bilbo")
+			})
+
+			Convey("normalise phone numbers", func() {
+				for input, expected := range map[string]string{
+					"+44 1234 567890":    "+441234567890",
+					"+44 (1234) 567-890": "+441234567890",
+					"0044.1234.567890":   "+441234567890",
+				} {
+					p := patientPayload{}
+					So(decodePayload([]byte(`{"first_name":"Bilbo","last_name":"Baggins","phone":"`+input+`"}`), &p), ShouldBeNil)
+					So(p.Phone, ShouldEqual, expected)
+				}
+			})
+
+			Convey("report every invalid field", func() {
+				var p patientPayload
+				err := decodePayload([]byte(`{"id":1,"first_name":"","email":"Bilbo <bilbo@shire.example>","phone":"1234","ring":true}`), &p)
+				So(err, ShouldResemble, &validationError{fields: []fieldError{
+					{Field: "ring", Message: "isn't allowed"},
+					{Field: "first_name", Message: "is required"},
+					{Field: "last_name", Message: "is required"},
+					{Field: "phone", Message: "must be an international phone number, such as +14155552671"},
+					{Field: "email", Message: "must be an email address"},
+				}})
+			})
+
+			Convey("report malformed times with the other invalid fields", func() {
+				var v visitPayload
+				err := decodePayload([]byte(`{"patient_id":1,"physician_id":2,"visited_at":"tomorrow at 10","duration_minutes":30,"location":"`+strings.Repeat("a", 201)+`"}`), &v)
+				So(err, ShouldResemble, &validationError{fields: []fieldError{
+					{Field: "visited_at", Message: "must be an RFC 3339 time, such as 2020-04-17T10:00:00Z"},
+					{Field: "location", Message: "must be at most 200 characters long"},
+				}})
+
+				So(decodePatch([]byte(`{"visited_at":42}`), &reschedulePayload{}), ShouldResemble,
+					invalidField("visited_at", "must be an RFC 3339 time, such as 2020-04-17T10:00:00Z"))
+			})
+
+			Convey("count characters instead of bytes", func() {
+				p := physicianPayload{}
+				So(decodePayload([]byte(`{"first_name":"`+strings.Repeat("é", 100)+`","last_name":"Half-elven"}`), &p), ShouldBeNil)
+				So(decodePayload([]byte(`{"first_name":"`+strings.Repeat("é", 101)+`","last_name":"Half-elven"}`), &p), ShouldResemble,
+					invalidField("first_name", "must be at most 100 characters long"))
+			})
+
+			Convey("check numeric limits", func() {
+				v := visitPayload{PatientID: 1, PhysicianID: 2, VisitedAt: time.Now()}
+				So(decodePayload([]byte(`{"duration_minutes":721}`), &v), ShouldResemble,
+					invalidField("duration_minutes", "must be at most 720"))
+				So(decodePayload([]byte(`{"duration_minutes":0}`), &v), ShouldResemble,
+					invalidField("duration_minutes", "must be at least 1"))
+			})
+		})
+
+		Convey("decodePatch should only validate the fields in the patch", func() {
+			p := patientPayload{FirstName: "Bilbo", Phone: "not a phone"}
+			So(decodePatch([]byte(`{"address":"Bag End"}`), &p), ShouldBeNil)
+			So(p.Address, ShouldEqual, "Bag End")
+
+			So(decodePatch([]byte(`{"last_name":""}`), &p), ShouldResemble, invalidField("last_name", "is required"))
+		})
+
+		Convey("all the payload tags should be valid", func() {
+			for _, payload := range []interface{}{patientPayload{}, physicianPayload{}, visitPayload{}, reschedulePayload{}} {
+				v := reflect.New(reflect.TypeOf(payload)).Elem()
+				for i := 0; i < v.NumField(); i++ {
+					So(func() { validateField(v.Field(i), v.Type().Field(i).Tag.Get("validate")) }, ShouldNotPanic)
+				}
+			}
+		})
+	})
+}
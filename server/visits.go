@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mihaitodor/ferrum/db"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultVisitDurationMinutes = 30
+
+// visitScope restricts the visits collection to a single patient or physician
+// for the nested /patients/{id}/visits and /physicians/{id}/visits endpoints
+type visitScope struct {
+	patientID   int32
+	physicianID int32
+}
+
+// visitPayload is the body of the requests which book visits
+type visitPayload struct {
+	PatientID       int32     `json:"patient_id" validate:"required"`
+	PhysicianID     int32     `json:"physician_id" validate:"required"`
+	VisitedAt       time.Time `json:"visited_at" validate:"required"`
+	DurationMinutes int32     `json:"duration_minutes" validate:"min=1,max=720"`
+	Location        string    `json:"location" validate:"max=200"`
+	Reason          string    `json:"reason" validate:"max=1000"`
+}
+
+// reschedulePayload contains the fields which can be changed when rescheduling
+// a visit
+type reschedulePayload struct {
+	VisitedAt       time.Time `json:"visited_at" validate:"required"`
+	DurationMinutes int32     `json:"duration_minutes" validate:"min=1,max=720"`
+	Location        string    `json:"location" validate:"max=200"`
+}
+
+func (s Server) visitsHandler(w http.ResponseWriter, r *http.Request) {
+	s.handleVisits(w, r, visitScope{})
+}
+
+func (s Server) patientVisitsHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r)
+	if !ok {
+		return
+	}
+
+	s.handleVisits(w, r, visitScope{patientID: id})
+}
+
+func (s Server) physicianVisitsHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r)
+	if !ok {
+		return
+	}
+
+	s.handleVisits(w, r, visitScope{physicianID: id})
+}
+
+func (s Server) handleVisits(w http.ResponseWriter, r *http.Request, scope visitScope) {
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	if r.Method == http.MethodPost {
+		body, ok := s.readRequestBody(w, r)
+		if !ok {
+			return
+		}
+
+		// The nested endpoints don't need the patient or physician ID in the body
+		visit := visitPayload{
+			PatientID:       scope.patientID,
+			PhysicianID:     scope.physicianID,
+			DurationMinutes: defaultVisitDurationMinutes,
+		}
+		if err := decodePayload(body, &visit); err != nil {
+			log.WithContext(r.Context()).Debugf("Rejecting new visit data: %v", err)
+			writeRequestProblem(w, r, err)
+			return
+		}
+		if scope.patientID != 0 {
+			visit.PatientID = scope.patientID
+		}
+		if scope.physicianID != 0 {
+			visit.PhysicianID = scope.physicianID
+		}
+
+		var visitRecord db.Visit
+		err := s.mutate(ctx, func(q queries) (string, int32, error) {
+			var err error
+			visitRecord, err = q.AddVisit(ctx, db.AddVisitParams(visit))
+			return "visit", visitRecord.ID, err
+		})
+		if err != nil {
+			log.WithContext(r.Context()).Warnf("Failed to insert visit data into database: %v", err)
+			writeProblem(w, r, visitProblem(err), "")
+			return
+		}
+
+		jsonData, err := marshalJSON(r.Context(), visitRecord)
+		if err != nil {
+			log.WithContext(r.Context()).Warnf("Failed to serialise visit data to JSON: %v", err)
+			writeProblem(w, r, problemInternal, "")
+			return
+		}
+
+		// The canonical location of a visit is the top-level collection, even
+		// when it was created through one of the nested ones
+		// TODO: Try to determine the scheme from the Origin header, since r.URL
+		// does not attempt to populate it
+		w.Header().Set("Location", fmt.Sprintf("http://%s/api/v1/visits/%s", r.Host, strconv.Itoa(int(visitRecord.ID))))
+		w.WriteHeader(http.StatusCreated)
+
+		fmt.Fprint(w, string(jsonData))
+	} else if r.Method == http.MethodGet {
+		limit, after, afterID, err := parseListVisitsParams(r.URL.Query())
+		if err != nil {
+			log.WithContext(r.Context()).Debugf("Invalid visits query %q: %v", r.URL.RawQuery, err)
+			writeRequestProblem(w, r, err)
+			return
+		}
+
+		// Fetch one extra row to find out if there is a next page
+		var visits []db.Visit
+		switch {
+		case scope.patientID != 0:
+			visits, err = s.database.ListPatientVisits(ctx, db.ListPatientVisitsParams{
+				PatientID: scope.patientID, VisitedAt: after, ID: afterID, Limit: limit + 1,
+			})
+		case scope.physicianID != 0:
+			visits, err = s.database.ListPhysicianVisits(ctx, db.ListPhysicianVisitsParams{
+				PhysicianID: scope.physicianID, VisitedAt: after, ID: afterID, Limit: limit + 1,
+			})
+		default:
+			visits, err = s.database.ListVisits(ctx, db.ListVisitsParams{
+				VisitedAt: after, ID: afterID, Limit: limit + 1,
+			})
+		}
+		if err != nil {
+			log.WithContext(r.Context()).Warnf("Failed to retrieve visits from the database: %v", err)
+			writeProblem(w, r, problemInternal, "")
+			return
+		}
+
+		payload := pagePayload{Data: visits}
+		if int32(len(visits)) > limit {
+			visits = visits[:limit]
+			payload.Data = visits
+
+			last := visits[len(visits)-1]
+			setNextPage(w, r, &payload, pageCursor{
+				Key: last.VisitedAt.UTC().Format(time.RFC3339Nano),
+				ID:  int64(last.ID),
+			})
+		} else if visits == nil {
+			payload.Data = []db.Visit{}
+		}
+
+		jsonData, err := marshalJSON(r.Context(), payload)
+		if err != nil {
+			log.WithContext(r.Context()).Warnf("Failed to serialise visits to JSON: %v", err)
+			writeProblem(w, r, problemInternal, "")
+			return
+		}
+
+		fmt.Fprint(w, string(jsonData))
+	} else {
+		methodNotAllowedHandler(w, r)
+	}
+}
+
+// parseListVisitsParams reads the pagination query parameters of the visits
+// collections, which are sorted chronologically
+func parseListVisitsParams(query url.Values) (limit int32, after time.Time, afterID int32, err error) {
+	limit, err = parsePageLimit(query)
+	if err != nil {
+		return 0, time.Time{}, 0, err
+	}
+
+	if cursorString := query.Get("cursor"); cursorString != "" {
+		cursor, err := decodePageCursor(cursorString)
+		if err != nil {
+			return 0, time.Time{}, 0, err
+		}
+
+		after, err = time.Parse(time.RFC3339Nano, cursor.Key)
+		if err != nil {
+			return 0, time.Time{}, 0, &requestError{detail: "cursor is invalid", cause: err}
+		}
+		afterID = int32(cursor.ID)
+	}
+
+	return limit, after, afterID, nil
+}
+
+func (s Server) visitHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	switch r.Method {
+	case http.MethodGet:
+		visit, err := s.database.GetVisit(ctx, id)
+		if err != nil {
+			log.WithContext(r.Context()).Warnf("Failed to retrieve visit %d data from the database: %v", id, err)
+			if err == sql.ErrNoRows {
+				writeProblem(w, r, problemNotFound, "")
+			} else {
+				writeProblem(w, r, problemInternal, "")
+			}
+			return
+		}
+
+		s.writeVisit(w, r, visit)
+	case http.MethodPatch:
+		s.rescheduleVisit(ctx, w, r, id)
+	default:
+		methodNotAllowedHandler(w, r)
+	}
+}
+
+// rescheduleVisit applies a JSON Merge Patch (RFC 7396) which can only change
+// the time, duration and location of a visit which wasn't cancelled
+func (s Server) rescheduleVisit(ctx context.Context, w http.ResponseWriter, r *http.Request, id int32) {
+	body, ok := s.readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	if err := checkMergePatch(body); err != nil {
+		log.WithContext(r.Context()).Debugf("Rejecting merge patch for visit %d: %v", id, err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	current, err := s.database.GetVisit(ctx, id)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to retrieve visit %d data from the database: %v", id, err)
+		if err == sql.ErrNoRows {
+			writeProblem(w, r, problemNotFound, "")
+		} else {
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	visit := reschedulePayload{
+		VisitedAt:       current.VisitedAt,
+		DurationMinutes: current.DurationMinutes,
+		Location:        current.Location,
+	}
+	// The fields which can't be changed are reported as unknown
+	if err := decodePatch(body, &visit); err != nil {
+		log.WithContext(r.Context()).Debugf("Rejecting merge patch for visit %d: %v", id, err)
+		writeRequestProblem(w, r, err)
+		return
+	}
+
+	var visitRecord db.Visit
+	err = s.mutate(ctx, func(q queries) (string, int32, error) {
+		var err error
+		visitRecord, err = q.RescheduleVisit(ctx, db.RescheduleVisitParams{
+			ID:              current.ID,
+			VisitedAt:       visit.VisitedAt,
+			DurationMinutes: visit.DurationMinutes,
+			Location:        visit.Location,
+		})
+		return "visit", id, err
+	})
+	if err == sql.ErrNoRows {
+		// The visit exists, so it must have been cancelled
+		log.WithContext(r.Context()).Debugf("Can't reschedule cancelled visit %d", id)
+		writeProblem(w, r, problemVisitCancelled, "Cancelled visits can't be rescheduled")
+		return
+	} else if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to reschedule visit %d: %v", id, err)
+		writeProblem(w, r, visitProblem(err), "")
+		return
+	}
+
+	s.writeVisit(w, r, visitRecord)
+}
+
+func (s Server) cancelVisitHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, done := context.WithTimeout(r.Context(), s.config.HTTPRequestTimeout)
+	defer done()
+
+	var visit db.Visit
+	err := s.mutate(ctx, func(q queries) (string, int32, error) {
+		var err error
+		visit, err = q.CancelVisit(ctx, id)
+		return "visit", id, err
+	})
+	if err == sql.ErrNoRows {
+		// Find out if the visit is missing or if it was already cancelled
+		if _, err = s.database.GetVisit(ctx, id); err == nil {
+			log.WithContext(r.Context()).Debugf("Visit %d is already cancelled", id)
+			writeProblem(w, r, problemVisitCancelled, "The visit has already been cancelled")
+			return
+		}
+	}
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to cancel visit %d: %v", id, err)
+		if err == sql.ErrNoRows {
+			writeProblem(w, r, problemNotFound, "")
+		} else {
+			writeProblem(w, r, problemInternal, "")
+		}
+		return
+	}
+
+	s.writeVisit(w, r, visit)
+}
+
+func (s Server) writeVisit(w http.ResponseWriter, r *http.Request, visit db.Visit) {
+	jsonData, err := marshalJSON(r.Context(), visit)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("Failed to serialise visit data to JSON: %v", err)
+		writeProblem(w, r, problemInternal, "")
+		return
+	}
+
+	fmt.Fprint(w, string(jsonData))
+}
+
+// visitProblem maps the errors raised when booking a visit to problem types
+func visitProblem(err error) problemType {
+	switch {
+	case db.IsConstraintViolation(err, db.ExclusionViolation, ""):
+		return problemBookingConflict
+	case db.IsConstraintViolation(err, db.ForeignKeyViolation, ""),
+		db.IsConstraintViolation(err, db.CheckViolation, ""):
+		return problemInvalidReference
+	default:
+		return problemInternal
+	}
+}
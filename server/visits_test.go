@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+	"github.com/mihaitodor/ferrum/config"
+	"github.com/mihaitodor/ferrum/db"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_VisitHandlers(t *testing.T) {
+	Convey("Visit handlers test", t, func() {
+		c := config.Config{
+			HTTPMaxPOSTSize:   102400,
+			HTTPJWTVClaimName: "test",
+			HTTPJWTSigningKey: "deadbeef",
+			HTTPJWTExpiration: 1 * time.Second,
+		}
+
+		queries := &mockQueries{}
+
+		jwt.TimeFunc = func() time.Time {
+			return time.Date(
+				2020, 4, 17, 0, 0, 0, 0, time.UTC)
+		}
+		s := newTestServer(c, queries)
+
+		router := s.getHTTPRouter()
+		w := httptest.NewRecorder()
+
+		serve := func(method, url string, body []byte) *http.Response {
+			req := httptest.NewRequest(method, url, bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+dummyJWTToken)
+			router.ServeHTTP(w, req)
+			return w.Result()
+		}
+
+		visitedAt := time.Date(2020, 4, 20, 9, 30, 0, 0, time.UTC)
+
+		Convey("creating a visit should", func() {
+			Convey("use the default duration", func() {
+				resp := serve(http.MethodPost, "http://example.com/api/v1/visits", []byte(`{"patient_id":1,"physician_id":2,"visited_at":"2020-04-20T09:30:00Z","location":"Rivendell","reason":"Checkup"}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusCreated)
+				So(resp.Header.Get("Location"), ShouldEqual, "http://example.com/api/v1/visits/1")
+				So(queries.Visits[0].DurationMinutes, ShouldEqual, defaultVisitDurationMinutes)
+				So(queries.Visits[0].VisitedAt.Equal(visitedAt), ShouldBeTrue)
+			})
+
+			Convey("take the patient from the nested collection URL", func() {
+				resp := serve(http.MethodPost, "http://example.com/api/v1/patients/5/visits", []byte(`{"patient_id":1,"physician_id":2,"visited_at":"2020-04-20T09:30:00Z","duration_minutes":15}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusCreated)
+				So(resp.Header.Get("Location"), ShouldEqual, "http://example.com/api/v1/visits/1")
+				So(queries.Visits[0].PatientID, ShouldEqual, 5)
+				So(queries.Visits[0].DurationMinutes, ShouldEqual, 15)
+			})
+
+			Convey("reject visits without a time", func() {
+				resp := serve(http.MethodPost, "http://example.com/api/v1/visits", []byte(`{"patient_id":1,"physician_id":2}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusUnprocessableEntity)
+			})
+
+			Convey("reject double bookings", func() {
+				queries.Err = &pq.Error{Code: db.ExclusionViolation, Constraint: "no_overlapping_physician_visits"}
+
+				resp := serve(http.MethodPost, "http://example.com/api/v1/visits", []byte(`{"patient_id":1,"physician_id":2,"visited_at":"2020-04-20T09:30:00Z"}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+			})
+
+			Convey("reject unknown patients", func() {
+				queries.Err = &pq.Error{Code: db.ForeignKeyViolation, Constraint: "visit_patient_id_fkey"}
+
+				resp := serve(http.MethodPost, "http://example.com/api/v1/visits", []byte(`{"patient_id":1,"physician_id":2,"visited_at":"2020-04-20T09:30:00Z"}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusUnprocessableEntity)
+			})
+		})
+
+		Convey("listing visits should filter by physician", func() {
+			queries.Visits = []db.Visit{{ID: 1, PhysicianID: 2}, {ID: 2, PhysicianID: 3}}
+
+			resp := serve(http.MethodGet, "http://example.com/api/v1/physicians/3/visits", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var payload struct {
+				Data []db.Visit `json:"data"`
+			}
+			So(json.NewDecoder(resp.Body).Decode(&payload), ShouldBeNil)
+			So(payload.Data, ShouldHaveLength, 1)
+			So(payload.Data[0].ID, ShouldEqual, 2)
+		})
+
+		Convey("rescheduling a visit should", func() {
+			queries.Visits = []db.Visit{{ID: 1, VisitedAt: visitedAt, DurationMinutes: 30, Location: "Rivendell", Reason: "Checkup"}}
+
+			Convey("change only the patched fields", func() {
+				resp := serve(http.MethodPatch, "http://example.com/api/v1/visits/1", []byte(`{"visited_at":"2020-04-21T10:00:00Z"}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(queries.Visits[0].VisitedAt.Equal(time.Date(2020, 4, 21, 10, 0, 0, 0, time.UTC)), ShouldBeTrue)
+				So(queries.Visits[0].DurationMinutes, ShouldEqual, 30)
+				So(queries.Visits[0].Location, ShouldEqual, "Rivendell")
+			})
+
+			Convey("reject changes to other fields", func() {
+				resp := serve(http.MethodPatch, "http://example.com/api/v1/visits/1", []byte(`{"reason":"Second breakfast"}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusUnprocessableEntity)
+			})
+
+			Convey("reject cancelled visits", func() {
+				queries.Visits[0].CancelledAt = sql.NullTime{Time: visitedAt, Valid: true}
+
+				resp := serve(http.MethodPatch, "http://example.com/api/v1/visits/1", []byte(`{"location":"Lothlorien"}`))
+				So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+			})
+		})
+
+		Convey("cancelling a visit should", func() {
+			queries.Visits = []db.Visit{{ID: 1, VisitedAt: visitedAt}}
+
+			Convey("succeed only once", func() {
+				resp := serve(http.MethodPost, "http://example.com/api/v1/visits/1/cancel", nil)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(queries.Visits[0].CancelledAt.Valid, ShouldBeTrue)
+
+				w = httptest.NewRecorder()
+				resp = serve(http.MethodPost, "http://example.com/api/v1/visits/1/cancel", nil)
+				So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+			})
+
+			Convey("return not found for missing visits", func() {
+				resp := serve(http.MethodPost, "http://example.com/api/v1/visits/2/cancel", nil)
+				So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+			})
+		})
+	})
+}